@@ -0,0 +1,402 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrNotCached is returned for an issuer that isn't in the cache when
+// running -offline.
+var ErrNotCached = errors.New("not in the aia cache")
+
+// aiaCache keeps AIA downloads on disk between runs.  Certificates are
+// stored by the SHA-256 of their contents, and found through two indexes:
+// by the URL they were downloaded from, and by their subject and subject key
+// identifier, which a child names as its issuer and authority key
+// identifier.  The layout is
+//
+//	certs/<sha256>.der
+//	urls/<sha256 of url>.json
+//	issuers/<sha256 of subject and key id>/<sha256>
+//
+// and every file is written to a temporary name first and renamed into
+// place, so concurrent runs can share a cache.
+type aiaCache struct {
+	dir string
+	// ttl is how long an entry is used before it's fetched again.  Offline,
+	// entries are used however old they are.
+	ttl     time.Duration
+	offline bool
+}
+
+// urlEntry records what a URL served and when.
+type urlEntry struct {
+	URL       string    `json:"url"`
+	SHA256    []string  `json:"sha256"`
+	FetchedAt time.Time `json:"fetched_at"`
+}
+
+// cacheDirEnv names the environment variable -cache-dir defaults to.
+// Nothing is cached unless one or the other is set.
+const cacheDirEnv = "WHICHCA_CACHE_DIR"
+
+// cacheOptions holds the flags for the AIA cache.
+type cacheOptions struct {
+	dir     string
+	ttl     time.Duration
+	offline bool
+}
+
+func (co *cacheOptions) register(f *flag.FlagSet) {
+	f.StringVar(&co.dir, "cache-dir", os.Getenv(cacheDirEnv), "cache intermediates fetched through AIA in "+
+		"`path`, $"+cacheDirEnv+" by default.  nothing is cached without one")
+	f.DurationVar(&co.ttl, "cache-ttl", 30*24*time.Hour, "fetch cached intermediates again once they're older "+
+		"than `duration`")
+}
+
+// registerOffline adds -offline, for the commands that fetch intermediates.
+func (co *cacheOptions) registerOffline(f *flag.FlagSet) {
+	f.BoolVar(&co.offline, "offline", false, "only find missing intermediates in the cache, never over the network")
+}
+
+func (co *cacheOptions) validate() error {
+	if co.offline && co.dir == "" {
+		return errors.New("-offline needs a -cache-dir")
+	}
+	if co.ttl < 0 {
+		return fmt.Errorf("invalid -cache-ttl %s, must not be negative", co.ttl)
+	}
+	return nil
+}
+
+// cache returns the cache the flags describe, or nil for none.
+func (co *cacheOptions) cache() *aiaCache {
+	if co.dir == "" {
+		return nil
+	}
+	return &aiaCache{dir: co.dir, ttl: co.ttl, offline: co.offline}
+}
+
+func hashHex(parts ...[]byte) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func (ac *aiaCache) certPath(sum string) string {
+	return filepath.Join(ac.dir, "certs", sum+".der")
+}
+
+func (ac *aiaCache) urlPath(url string) string {
+	return filepath.Join(ac.dir, "urls", hashHex([]byte(url))+".json")
+}
+
+func (ac *aiaCache) issuerDir(rawSubject, keyID []byte) string {
+	return filepath.Join(ac.dir, "issuers", hashHex(rawSubject, keyID))
+}
+
+// fresh says whether an entry stored at t can be used without fetching it
+// again.
+func (ac *aiaCache) fresh(t time.Time) bool {
+	return ac.offline || ac.ttl == 0 || time.Since(t) < ac.ttl
+}
+
+func (ac *aiaCache) readCert(sum string) (*x509.Certificate, error) {
+	raw, err := os.ReadFile(ac.certPath(sum))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing cached certificate %s: %w", sum, err)
+	}
+	if hashHex(cert.Raw) != sum {
+		return nil, fmt.Errorf("cached certificate %s doesn't match its name", sum)
+	}
+	return cert, nil
+}
+
+// byURL returns the certificates url served when it was last fetched, or
+// nil if they aren't cached or are too old.
+func (ac *aiaCache) byURL(url string) []*x509.Certificate {
+	raw, err := os.ReadFile(ac.urlPath(url))
+	if err != nil {
+		return nil
+	}
+	var ue urlEntry
+	if err = json.Unmarshal(raw, &ue); err != nil || ue.URL != url || !ac.fresh(ue.FetchedAt) {
+		return nil
+	}
+	var ret []*x509.Certificate
+	for _, sum := range ue.SHA256 {
+		cert, err := ac.readCert(sum)
+		if err != nil {
+			return nil
+		}
+		ret = append(ret, cert)
+	}
+	return ret
+}
+
+// issuer returns a cached certificate that signed cert, or nil if there
+// isn't one or it's too old.  When more than one did, the one that expires
+// last wins.
+func (ac *aiaCache) issuer(cert *x509.Certificate) *x509.Certificate {
+	dir := ac.issuerDir(cert.RawIssuer, cert.AuthorityKeyId)
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var candidates []*x509.Certificate
+	for _, de := range des {
+		fi, err := de.Info()
+		if err != nil || !fi.Mode().IsRegular() || !ac.fresh(fi.ModTime()) {
+			continue
+		}
+		if candidate, err := ac.readCert(de.Name()); err == nil {
+			candidates = append(candidates, candidate)
+		}
+	}
+	return issuerOf(cert, candidates)
+}
+
+// store adds certs to the cache, indexed by url if it's set.
+func (ac *aiaCache) store(url string, certs ...*x509.Certificate) error {
+	ue := &urlEntry{URL: url, FetchedAt: time.Now().UTC()}
+	for _, cert := range certs {
+		sum := hashHex(cert.Raw)
+		if _, err := os.Stat(ac.certPath(sum)); err != nil {
+			if err = writeFileAtomic(ac.certPath(sum), cert.Raw); err != nil {
+				return err
+			}
+		}
+		if err := writeFileAtomic(filepath.Join(ac.issuerDir(cert.RawSubject, cert.SubjectKeyId), sum), nil); err != nil {
+			return err
+		}
+		ue.SHA256 = append(ue.SHA256, sum)
+	}
+	if url == "" {
+		return nil
+	}
+	raw, err := json.Marshal(ue)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(ac.urlPath(url), raw)
+}
+
+// writeFileAtomic writes data to path by way of a temporary file, so readers
+// never see it half written.
+func writeFileAtomic(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("error creating cache directory: %w", err)
+	}
+	f, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("error writing to cache: %w", err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return fmt.Errorf("error writing to cache: %w", err)
+	}
+	return nil
+}
+
+// cachedCert is a certificate in the cache, with the URLs it was fetched
+// from and when it was last stored.
+type cachedCert struct {
+	sum      string
+	cert     *x509.Certificate
+	urls     []*urlEntry
+	storedAt time.Time
+	// err is set for a file in certs that can't be read.
+	err error
+}
+
+func (cc *cachedCert) String() string {
+	if cc.err != nil {
+		return fmt.Sprintf("%s: %s", cc.sum, cc.err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: sha256 %s, expires %s, cached %s", cc.cert.Subject.CommonName, cc.sum,
+		cc.cert.NotAfter.UTC().Format(time.DateOnly), cc.storedAt.UTC().Format(time.RFC3339))
+	for _, ue := range cc.urls {
+		fmt.Fprintf(&b, "\n  from %s, fetched %s", ue.URL, ue.FetchedAt.UTC().Format(time.RFC3339))
+	}
+	return b.String()
+}
+
+// entries reads every certificate in the cache, in subject order.
+func (ac *aiaCache) entries() ([]*cachedCert, error) {
+	des, err := os.ReadDir(filepath.Join(ac.dir, "certs"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading cache: %w", err)
+	}
+	bySum := make(map[string]*cachedCert)
+	var ret []*cachedCert
+	for _, de := range des {
+		sum := strings.TrimSuffix(de.Name(), ".der")
+		if sum == de.Name() {
+			continue
+		}
+		cc := &cachedCert{sum: sum}
+		cc.cert, cc.err = ac.readCert(sum)
+		if fi, err := de.Info(); err == nil {
+			cc.storedAt = fi.ModTime()
+		}
+		if cc.cert != nil {
+			if fi, err := os.Stat(filepath.Join(ac.issuerDir(cc.cert.RawSubject, cc.cert.SubjectKeyId), sum)); err == nil {
+				cc.storedAt = fi.ModTime()
+			}
+		}
+		bySum[sum] = cc
+		ret = append(ret, cc)
+	}
+	urls, err := ac.urlEntries()
+	if err != nil {
+		return nil, err
+	}
+	for _, ue := range urls {
+		for _, sum := range ue.SHA256 {
+			if cc, ok := bySum[sum]; ok {
+				cc.urls = append(cc.urls, ue)
+			}
+		}
+	}
+	sortCachedCerts(ret)
+	return ret, nil
+}
+
+// urlEntries reads the URL index, skipping anything unreadable.
+func (ac *aiaCache) urlEntries() ([]*urlEntry, error) {
+	des, err := os.ReadDir(filepath.Join(ac.dir, "urls"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading cache: %w", err)
+	}
+	var ret []*urlEntry
+	for _, de := range des {
+		if !strings.HasSuffix(de.Name(), ".json") {
+			continue
+		}
+		raw, err := os.ReadFile(filepath.Join(ac.dir, "urls", de.Name()))
+		if err != nil {
+			continue
+		}
+		ue := &urlEntry{}
+		if json.Unmarshal(raw, ue) == nil {
+			ret = append(ret, ue)
+		}
+	}
+	return ret, nil
+}
+
+// prune removes URL and issuer entries older than the TTL, or all of them,
+// then any certificate that has expired, can't be read or is no longer
+// indexed.  It returns the certificates removed.
+func (ac *aiaCache) prune(all bool) ([]*cachedCert, error) {
+	stale := func(t time.Time) bool {
+		return all || (ac.ttl > 0 && time.Since(t) >= ac.ttl)
+	}
+	urls, err := ac.urlEntries()
+	if err != nil {
+		return nil, err
+	}
+	indexed := make(map[string]bool)
+	for _, ue := range urls {
+		if stale(ue.FetchedAt) {
+			if err = os.Remove(ac.urlPath(ue.URL)); err != nil {
+				return nil, fmt.Errorf("error pruning cache: %w", err)
+			}
+			continue
+		}
+		for _, sum := range ue.SHA256 {
+			indexed[sum] = true
+		}
+	}
+	issuers := filepath.Join(ac.dir, "issuers")
+	dirs, err := os.ReadDir(issuers)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("error reading cache: %w", err)
+	}
+	for _, d := range dirs {
+		des, err := os.ReadDir(filepath.Join(issuers, d.Name()))
+		if err != nil {
+			continue
+		}
+		left := 0
+		for _, de := range des {
+			fi, err := de.Info()
+			if err == nil && !stale(fi.ModTime()) {
+				indexed[de.Name()] = true
+				left++
+				continue
+			}
+			if err = os.Remove(filepath.Join(issuers, d.Name(), de.Name())); err != nil {
+				return nil, fmt.Errorf("error pruning cache: %w", err)
+			}
+		}
+		if left == 0 {
+			os.Remove(filepath.Join(issuers, d.Name()))
+		}
+	}
+	entries, err := ac.entries()
+	if err != nil {
+		return nil, err
+	}
+	var removed []*cachedCert
+	now := time.Now()
+	for _, cc := range entries {
+		if indexed[cc.sum] && cc.err == nil && now.Before(cc.cert.NotAfter) {
+			continue
+		}
+		if err = os.Remove(ac.certPath(cc.sum)); err != nil {
+			return nil, fmt.Errorf("error pruning cache: %w", err)
+		}
+		if cc.cert != nil {
+			dir := ac.issuerDir(cc.cert.RawSubject, cc.cert.SubjectKeyId)
+			os.Remove(filepath.Join(dir, cc.sum))
+			os.Remove(dir)
+		}
+		for _, ue := range cc.urls {
+			os.Remove(ac.urlPath(ue.URL))
+		}
+		removed = append(removed, cc)
+	}
+	return removed, nil
+}
+
+// sortCachedCerts orders entries by subject, then by fingerprint.
+func sortCachedCerts(entries []*cachedCert) {
+	subject := func(cc *cachedCert) string {
+		if cc.cert == nil {
+			return ""
+		}
+		return cc.cert.Subject.String()
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		si, sj := subject(entries[i]), subject(entries[j])
+		if si != sj {
+			return si < sj
+		}
+		return entries[i].sum < entries[j].sum
+	})
+}
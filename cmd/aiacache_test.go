@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testAIAURL = "http://ca.example/intermediate.crt"
+
+func TestAIACacheLookups(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	intermediate := newTestCA(t, "Test Intermediate", root)
+	leaf, _ := intermediate.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+	ac := &aiaCache{dir: t.TempDir(), ttl: time.Hour}
+	if err := ac.store(testAIAURL, intermediate.cert, root.cert); err != nil {
+		t.Fatal(err)
+	}
+	// the same entries, seen by a cache that thinks they're too old
+	stale := *ac
+	stale.ttl = time.Nanosecond
+	staleOffline := stale
+	staleOffline.offline = true
+
+	tests := []struct {
+		name string
+		ac   *aiaCache
+		// fresh is whether the entries are used
+		fresh bool
+	}{
+		{name: "fresh", ac: ac, fresh: true},
+		{name: "no ttl", ac: &aiaCache{dir: ac.dir}, fresh: true},
+		{name: "stale", ac: &stale},
+		{name: "stale but offline", ac: &staleOffline, fresh: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			certs := tt.ac.byURL(testAIAURL)
+			issuer := tt.ac.issuer(leaf)
+			if !tt.fresh {
+				if len(certs) > 0 || issuer != nil {
+					t.Fatalf("got %s and %v from a stale cache", certNamesList(certs), issuer)
+				}
+				return
+			}
+			if len(certs) != 2 || !certs[0].Equal(intermediate.cert) || !certs[1].Equal(root.cert) {
+				t.Fatalf("%s served %s, wanted the intermediate and root", testAIAURL, certNamesList(certs))
+			}
+			if issuer == nil || !issuer.Equal(intermediate.cert) {
+				t.Fatalf("got issuer %v, wanted the intermediate", issuer)
+			}
+			if tt.ac.byURL("http://ca.example/other.crt") != nil {
+				t.Fatal("found certificates for a URL that was never stored")
+			}
+			if tt.ac.issuer(intermediate.cert) == nil {
+				t.Fatal("didn't find the root by subject and key id")
+			}
+		})
+	}
+}
+
+func TestAIACacheReadCert(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	intermediate := newTestCA(t, "Test Intermediate", root)
+	leaf, _ := intermediate.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+	ac := &aiaCache{dir: t.TempDir(), ttl: time.Hour}
+	if err := ac.store(testAIAURL, intermediate.cert); err != nil {
+		t.Fatal(err)
+	}
+	sum := hashHex(intermediate.cert.Raw)
+	if _, err := ac.readCert(sum); err != nil {
+		t.Fatal(err)
+	}
+
+	// a file whose contents aren't what its name says
+	if err := os.WriteFile(ac.certPath(sum), root.cert.Raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.readCert(sum); err == nil || !strings.Contains(err.Error(), "doesn't match its name") {
+		t.Fatalf("got %v, wanted a mismatch", err)
+	}
+	if certs := ac.byURL(testAIAURL); certs != nil {
+		t.Fatalf("got %s for a URL whose certificate doesn't match", certNamesList(certs))
+	}
+	if issuer := ac.issuer(leaf); issuer != nil {
+		t.Fatalf("got issuer %s from a certificate that doesn't match", issuer.Subject.CommonName)
+	}
+
+	if err := os.WriteFile(ac.certPath(sum), []byte("garbage"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ac.readCert(sum); err == nil || !strings.Contains(err.Error(), "error parsing") {
+		t.Fatalf("got %v, wanted a parse error", err)
+	}
+}
+
+func TestAIAFetcherOffline(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	intermediate := newTestCA(t, "Test Intermediate", root)
+	ac := &aiaCache{dir: t.TempDir(), ttl: time.Nanosecond, offline: true}
+	if err := ac.store(testAIAURL, intermediate.cert); err != nil {
+		t.Fatal(err)
+	}
+	af := newAIAFetcher(time.Second)
+	af.cache = ac
+
+	// however old, a cached URL is used offline
+	certs, err := af.fetchCerts(context.Background(), testAIAURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !certs[0].Equal(intermediate.cert) {
+		t.Fatalf("got %s, wanted the intermediate", certNamesList(certs))
+	}
+
+	// and one that isn't cached is never fetched
+	_, err = af.fetchCerts(context.Background(), "http://ca.example/other.crt")
+	if !errors.Is(err, ErrNotCached) {
+		t.Fatalf("got %v, wanted %v", err, ErrNotCached)
+	}
+}
+
+func TestAIACachePrune(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	kept := newTestCA(t, "Kept Intermediate", root)
+	imported := newTestCA(t, "Imported Intermediate", root)
+	staleImport := newTestCA(t, "Stale Intermediate", root)
+	expired, _ := root.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Expired Intermediate"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		NotBefore:             time.Now().AddDate(-2, 0, 0),
+		NotAfter:              time.Now().AddDate(-1, 0, 0),
+	})
+	unindexed := newTestCA(t, "Unindexed Intermediate", root)
+
+	setup := func(t *testing.T) *aiaCache {
+		ac := &aiaCache{dir: t.TempDir(), ttl: time.Hour}
+		for _, err := range []error{
+			ac.store(testAIAURL, kept.cert),
+			ac.store("http://ca.example/expired.crt", expired),
+			ac.store("", imported.cert),
+			ac.store("", staleImport.cert),
+			writeFileAtomic(ac.certPath(hashHex(unindexed.cert.Raw)), unindexed.cert.Raw),
+			writeFileAtomic(ac.certPath(hashHex([]byte("garbage"))), []byte("garbage")),
+		} {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		old := time.Now().Add(-2 * time.Hour)
+		path := filepath.Join(ac.issuerDir(staleImport.cert.RawSubject, staleImport.cert.SubjectKeyId),
+			hashHex(staleImport.cert.Raw))
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatal(err)
+		}
+		return ac
+	}
+	names := func(entries []*cachedCert) []string {
+		var ret []string
+		for _, e := range entries {
+			if e.cert == nil {
+				ret = append(ret, "unreadable")
+				continue
+			}
+			ret = append(ret, e.cert.Subject.CommonName)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+
+	tests := []struct {
+		name        string
+		all         bool
+		wantRemoved []string
+		wantLeft    []string
+	}{
+		{
+			name: "stale, expired, unindexed and unreadable",
+			wantRemoved: []string{"Expired Intermediate", "Stale Intermediate", "Unindexed Intermediate",
+				"unreadable"},
+			wantLeft: []string{"Imported Intermediate", "Kept Intermediate"},
+		},
+		{
+			name: "all",
+			all:  true,
+			wantRemoved: []string{"Expired Intermediate", "Imported Intermediate", "Kept Intermediate",
+				"Stale Intermediate", "Unindexed Intermediate", "unreadable"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ac := setup(t)
+			removed, err := ac.prune(tt.all)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(removed); strings.Join(got, ",") != strings.Join(tt.wantRemoved, ",") {
+				t.Fatalf("removed %q, wanted %q", got, tt.wantRemoved)
+			}
+			left, err := ac.entries()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := names(left); strings.Join(got, ",") != strings.Join(tt.wantLeft, ",") {
+				t.Fatalf("left %q, wanted %q", got, tt.wantLeft)
+			}
+			if !tt.all && ac.byURL(testAIAURL) == nil {
+				t.Fatal("pruned the URL entry for a certificate that was kept")
+			}
+			if ac.byURL("http://ca.example/expired.crt") != nil {
+				t.Fatal("kept the URL entry for an expired certificate")
+			}
+		})
+	}
+}
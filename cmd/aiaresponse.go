@@ -0,0 +1,186 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"mime"
+	"strings"
+
+	"golang.org/x/crypto/cryptobyte"
+	casn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// The formats CAs serve from AIA issuer URLs.  RFC 5280 calls for a single
+// DER certificate or a certs-only PKCS#7, but PEM turns up too.
+const (
+	aiaDER   = "der"
+	aiaPKCS7 = "pkcs7"
+	aiaPEM   = "pem"
+)
+
+// aiaContentTypes maps the content types seen on AIA responses to formats.
+// application/pkix-cert is often sent for whatever the file happens to be,
+// so the body gets sniffed when the format it names doesn't parse.
+var aiaContentTypes = map[string]string{
+	"application/pkix-cert":             aiaDER,
+	"application/x-x509-ca-cert":        aiaDER,
+	"application/pkcs7-mime":            aiaPKCS7,
+	"application/x-pkcs7-certificates":  aiaPKCS7,
+	"application/pkcs7-certificates":    aiaPKCS7,
+	"application/x-pem-file":            aiaPEM,
+	"application/pem-certificate-chain": aiaPEM,
+}
+
+// parseAIAResponse returns every certificate in an AIA response body.  The
+// format is taken from contentType when it names one, then from the body.
+func parseAIAResponse(contentType string, body []byte) ([]*x509.Certificate, error) {
+	var formats []string
+	if mt, _, err := mime.ParseMediaType(contentType); err == nil && aiaContentTypes[mt] != "" {
+		formats = append(formats, aiaContentTypes[mt])
+	}
+	if sniffed := sniffAIAFormat(body); len(formats) == 0 || formats[0] != sniffed {
+		formats = append(formats, sniffed)
+	}
+	var firstErr error
+	for _, format := range formats {
+		var (
+			certs []*x509.Certificate
+			err   error
+		)
+		switch format {
+		case aiaPEM:
+			certs, err = parsePEMCerts(body)
+		case aiaPKCS7:
+			certs, err = parsePKCS7Certs(body)
+		default:
+			var cert *x509.Certificate
+			if cert, err = x509.ParseCertificate(body); err == nil {
+				certs = []*x509.Certificate{cert}
+			}
+		}
+		if err == nil && len(certs) == 0 {
+			err = errors.New("no certificates found")
+		}
+		if err == nil {
+			return certs, nil
+		}
+		if firstErr == nil {
+			firstErr = fmt.Errorf("as %s: %w", format, err)
+		}
+	}
+	return nil, firstErr
+}
+
+// sniffAIAFormat guesses the format of body.  PEM starts with a BEGIN line,
+// and in DER a PKCS#7 ContentInfo opens with its content type OID where a
+// certificate opens with a SEQUENCE.
+func sniffAIAFormat(body []byte) string {
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("-----BEGIN")) {
+		return aiaPEM
+	}
+	in := cryptobyte.String(body)
+	var seq cryptobyte.String
+	if in.ReadASN1(&seq, casn1.SEQUENCE) && seq.PeekASN1Tag(casn1.OBJECT_IDENTIFIER) {
+		return aiaPKCS7
+	}
+	return aiaDER
+}
+
+// parsePEMCerts returns the certificates in CERTIFICATE and PKCS7 blocks.
+func parsePEMCerts(body []byte) ([]*x509.Certificate, error) {
+	var ret []*x509.Certificate
+	for rest := body; ; {
+		var blk *pem.Block
+		blk, rest = pem.Decode(rest)
+		if blk == nil {
+			break
+		}
+		switch blk.Type {
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(blk.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, cert)
+		case "PKCS7", "CERTIFICATES":
+			certs, err := parsePKCS7Certs(blk.Bytes)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, certs...)
+		}
+	}
+	return ret, nil
+}
+
+// parsePKCS7Certs returns the certificates in a DER PKCS#7 SignedData, such
+// as a .p7c.  Anything but the certificates is skipped, and BER's indefinite
+// lengths aren't supported.
+func parsePKCS7Certs(der []byte) ([]*x509.Certificate, error) {
+	var (
+		in           = cryptobyte.String(der)
+		contentInfo  cryptobyte.String
+		contentType  asn1.ObjectIdentifier
+		content      cryptobyte.String
+		signedData   cryptobyte.String
+		certificates cryptobyte.String
+		present      bool
+	)
+	if !in.ReadASN1(&contentInfo, casn1.SEQUENCE) ||
+		!contentInfo.ReadASN1ObjectIdentifier(&contentType) {
+		return nil, errors.New("malformed PKCS#7")
+	}
+	if !contentType.Equal(oidPKCS7SignedData) {
+		return nil, fmt.Errorf("PKCS#7 content type %s is not signed data", contentType)
+	}
+	if !contentInfo.ReadASN1(&content, explicit0) ||
+		!content.ReadASN1(&signedData, casn1.SEQUENCE) ||
+		!signedData.SkipASN1(casn1.INTEGER) ||
+		!signedData.SkipASN1(casn1.SET) ||
+		!signedData.SkipASN1(casn1.SEQUENCE) ||
+		!signedData.ReadOptionalASN1(&certificates, &present, explicit0) {
+		return nil, errors.New("malformed PKCS#7 signed data")
+	}
+	var ret []*x509.Certificate
+	for !certificates.Empty() {
+		var raw cryptobyte.String
+		if !certificates.ReadASN1Element(&raw, casn1.SEQUENCE) {
+			return nil, errors.New("malformed PKCS#7 certificate set")
+		}
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cert)
+	}
+	return ret, nil
+}
+
+// issuerOf returns the certificate among candidates that signed cert.  When
+// more than one did, as with a reissued intermediate, the one that expires
+// last wins.
+func issuerOf(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	var best *x509.Certificate
+	for _, c := range candidates {
+		if !bytes.Equal(c.RawSubject, cert.RawIssuer) || cert.CheckSignatureFrom(c) != nil {
+			continue
+		}
+		if best == nil || c.NotAfter.After(best.NotAfter) {
+			best = c
+		}
+	}
+	return best
+}
+
+// certNamesList describes certs for an error message.
+func certNamesList(certs []*x509.Certificate) string {
+	names := make([]string, 0, len(certs))
+	for _, c := range certs {
+		names = append(names, c.Subject.CommonName)
+	}
+	return strings.Join(names, ", ")
+}
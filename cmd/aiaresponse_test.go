@@ -0,0 +1,221 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	casn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+func TestParseAIAResponse(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	intermediate := newTestCA(t, "Test Intermediate", root)
+	p7c, err := encodePKCS7(certEntries([]*x509.Certificate{intermediate.cert, root.cert}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pemOf := func(typ string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	}
+	chain := append(pemOf("CERTIFICATE", intermediate.cert.Raw), pemOf("CERTIFICATE", root.cert.Raw)...)
+
+	tests := []struct {
+		name        string
+		contentType string
+		body        []byte
+		// sniffed is what the body alone looks like
+		sniffed string
+		want    []*x509.Certificate
+	}{
+		{
+			name:        "der",
+			contentType: "application/pkix-cert",
+			body:        intermediate.cert.Raw,
+			sniffed:     aiaDER,
+			want:        []*x509.Certificate{intermediate.cert},
+		},
+		{
+			name:        "der with parameters",
+			contentType: "application/x-x509-ca-cert; charset=binary",
+			body:        intermediate.cert.Raw,
+			sniffed:     aiaDER,
+			want:        []*x509.Certificate{intermediate.cert},
+		},
+		{
+			name:        "der as pkcs7",
+			contentType: "application/pkcs7-mime",
+			body:        intermediate.cert.Raw,
+			sniffed:     aiaDER,
+			want:        []*x509.Certificate{intermediate.cert},
+		},
+		{
+			name:        "p7c",
+			contentType: "application/pkcs7-mime",
+			body:        p7c,
+			sniffed:     aiaPKCS7,
+			want:        []*x509.Certificate{intermediate.cert, root.cert},
+		},
+		{
+			name:        "p7c as pkix-cert",
+			contentType: "application/pkix-cert",
+			body:        p7c,
+			sniffed:     aiaPKCS7,
+			want:        []*x509.Certificate{intermediate.cert, root.cert},
+		},
+		{
+			name:    "p7c without a content type",
+			body:    p7c,
+			sniffed: aiaPKCS7,
+			want:    []*x509.Certificate{intermediate.cert, root.cert},
+		},
+		{
+			name:        "pem chain",
+			contentType: "application/octet-stream",
+			body:        chain,
+			sniffed:     aiaPEM,
+			want:        []*x509.Certificate{intermediate.cert, root.cert},
+		},
+		{
+			name:        "pem chain as pkix-cert",
+			contentType: "application/pkix-cert",
+			body:        append([]byte("\n"), chain...),
+			sniffed:     aiaPEM,
+			want:        []*x509.Certificate{intermediate.cert, root.cert},
+		},
+		{
+			name:        "pem pkcs7",
+			contentType: "text/plain",
+			body:        pemOf("PKCS7", p7c),
+			sniffed:     aiaPEM,
+			want:        []*x509.Certificate{intermediate.cert, root.cert},
+		},
+		{
+			name:        "garbage",
+			contentType: "application/pkix-cert",
+			body:        []byte("<html>not found</html>"),
+			sniffed:     aiaDER,
+		},
+		{
+			name:        "pem without certificates",
+			contentType: "application/x-pem-file",
+			body:        pemOf("PRIVATE KEY", []byte{1, 2, 3}),
+			sniffed:     aiaPEM,
+		},
+		{
+			name:        "empty",
+			contentType: "application/pkix-cert",
+			sniffed:     aiaDER,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sniffAIAFormat(tt.body); got != tt.sniffed {
+				t.Fatalf("sniffed %s, wanted %s", got, tt.sniffed)
+			}
+			got, err := parseAIAResponse(tt.contentType, tt.body)
+			if tt.want == nil {
+				if err == nil {
+					t.Fatalf("got %s, wanted an error", certNamesList(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %s, wanted %s", certNamesList(got), certNamesList(tt.want))
+			}
+			for i := range got {
+				if !got[i].Equal(tt.want[i]) {
+					t.Fatalf("got %s, wanted %s", certNamesList(got), certNamesList(tt.want))
+				}
+			}
+		})
+	}
+}
+
+func TestParsePKCS7CertsMalformed(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	p7c, err := encodePKCS7(certEntries([]*x509.Certificate{root.cert}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(oidPKCS7Data)
+		b.AddASN1(explicit0, func(b *cryptobyte.Builder) {
+			b.AddASN1OctetString(root.cert.Raw)
+		})
+	})
+	data := b.BytesOrPanic()
+
+	tests := []struct {
+		name string
+		der  []byte
+	}{
+		{name: "data, not signed data", der: data},
+		{name: "truncated", der: p7c[:len(p7c)-1]},
+		{name: "a certificate", der: root.cert.Raw},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if certs, err := parsePKCS7Certs(tt.der); err == nil {
+				t.Fatalf("got %s, wanted an error", certNamesList(certs))
+			}
+		})
+	}
+}
+
+func TestIssuerOf(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	older := newTestCA(t, "Test Intermediate", root)
+	leaf, _ := older.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+	// a reissue of the intermediate with the same name and key, valid for
+	// longer
+	reissue := func(notAfter time.Time) *x509.Certificate {
+		tmpl := *older.cert
+		tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+		tmpl.NotAfter = notAfter
+		der, err := x509.CreateCertificate(rand.Reader, &tmpl, root.cert, older.key.Public(), root.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	newer := reissue(older.cert.NotAfter.AddDate(1, 0, 0))
+	// the same name but another key, which didn't sign the leaf, and which
+	// expires last so it would win if that weren't checked
+	impostor := newTestCA(t, "Test Intermediate", root)
+	impostor.cert.NotAfter = newer.NotAfter.AddDate(1, 0, 0)
+
+	tests := []struct {
+		name       string
+		candidates []*x509.Certificate
+		want       *x509.Certificate
+	}{
+		{name: "the one", candidates: []*x509.Certificate{older.cert}, want: older.cert},
+		{name: "later expiring first", candidates: []*x509.Certificate{newer, older.cert}, want: newer},
+		{name: "later expiring last", candidates: []*x509.Certificate{older.cert, newer}, want: newer},
+		{name: "impostor skipped", candidates: []*x509.Certificate{impostor.cert, older.cert}, want: older.cert},
+		{name: "root didn't sign it", candidates: []*x509.Certificate{root.cert}},
+		{name: "nothing", candidates: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := issuerOf(leaf, tt.candidates)
+			if (got == nil) != (tt.want == nil) || (got != nil && !got.Equal(tt.want)) {
+				t.Fatalf("got %v, wanted %v", got, tt.want)
+			}
+		})
+	}
+}
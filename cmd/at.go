@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// atparam is the time given to -at, either an RFC3339 date or an offset
+// from now such as +30d, -7d or +36h.  The zero value means now.
+type atparam struct {
+	t time.Time
+	v string
+}
+
+func (ap *atparam) Set(v string) error {
+	t, err := parseAt(v, time.Now())
+	if err != nil {
+		return err
+	}
+	ap.t, ap.v = t, v
+	return nil
+}
+
+func (ap *atparam) String() string {
+	return ap.v
+}
+
+// time returns the time given, or now if none was.
+func (ap *atparam) time() time.Time {
+	if ap.t.IsZero() {
+		return time.Now()
+	}
+	return ap.t
+}
+
+func parseAt(v string, now time.Time) (time.Time, error) {
+	if strings.HasPrefix(v, "+") || strings.HasPrefix(v, "-") {
+		if days := strings.TrimSuffix(v, "d"); days != v {
+			n, err := strconv.Atoi(days)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid offset %q: %w", v, err)
+			}
+			return now.AddDate(0, 0, n), nil
+		}
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid offset %q: %w", v, err)
+		}
+		return now.Add(d), nil
+	}
+	if t, err := time.Parse(time.DateOnly, v); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, must be RFC3339 or an offset like +30d", v)
+	}
+	return t, nil
+}
+
+// atTime returns a verifier that verifies as of t, sharing cv's downloads.
+func (cv *chainVerifier) atTime(t time.Time) *chainVerifier {
+	ret := cv.withRoots(cv.roots)
+	ret.now = t
+	return ret
+}
+
+// time returns the time cv verifies as of, which is now unless -at says
+// otherwise.  Revocation responses and staples are judged current against it
+// too.
+func (cv *chainVerifier) time() time.Time {
+	if cv.now.IsZero() {
+		return time.Now()
+	}
+	return cv.now
+}
+
+// sweepInfo is the first time after a check that the target stops verifying.
+type sweepInfo struct {
+	// from is the time the sweep started at, the -at time
+	from    time.Time
+	failsAt time.Time
+	err     error
+}
+
+func (si *sweepInfo) String() string {
+	return fmt.Sprintf("sweep: first fails verification at %s (in %d days): %s",
+		si.failsAt.Format(time.RFC3339), int(si.failsAt.Sub(si.from).Hours()/24), si.err)
+}
+
+// sweep finds the first time after from that certs stop verifying.  Chains
+// only stop verifying when something in them expires, so it's enough to try
+// just past each expiry, in order, picking up the expiries of any new chains
+// found along the way.  It returns nil if certs don't verify at from.
+func (cv *chainVerifier) sweep(ctx context.Context, certs []*x509.Certificate, from time.Time) *sweepInfo {
+	var candidates []time.Time
+	tried := make(map[time.Time]bool)
+	add := func(chains [][]*x509.Certificate) {
+		for _, chain := range chains {
+			for _, cert := range chain {
+				t := cert.NotAfter.Add(time.Second)
+				if t.After(from) && !tried[t] {
+					tried[t] = true
+					candidates = append(candidates, t)
+				}
+			}
+		}
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].Before(candidates[j]) })
+	}
+	chains, _, err := cv.atTime(from).verifyChains(ctx, certs)
+	if err != nil {
+		return nil
+	}
+	add(chains)
+	for len(candidates) > 0 {
+		t := candidates[0]
+		candidates = candidates[1:]
+		chains, _, err = cv.atTime(t).verifyChains(ctx, certs)
+		if err != nil {
+			return &sweepInfo{from: from, failsAt: t, err: err}
+		}
+		add(chains)
+	}
+	return nil
+}
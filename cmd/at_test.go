@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseAt(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		v       string
+		want    time.Time
+		wantErr bool
+	}{
+		{v: "+30d", want: now.AddDate(0, 0, 30)},
+		{v: "-7d", want: now.AddDate(0, 0, -7)},
+		{v: "+36h", want: now.Add(36 * time.Hour)},
+		{v: "-90m", want: now.Add(-90 * time.Minute)},
+		{v: "2025-01-02", want: time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)},
+		{v: "2025-01-02T03:04:05Z", want: time.Date(2025, 1, 2, 3, 4, 5, 0, time.UTC)},
+		{v: "+xd", wantErr: true},
+		{v: "+3w", wantErr: true},
+		{v: "next tuesday", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.v, func(t *testing.T) {
+			got, err := parseAt(tt.v, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %s, wanted an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !got.Equal(tt.want) {
+				t.Fatalf("got %s, wanted %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweepCountsDaysFromAt(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	leaf, _ := root.issue(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "leaf"},
+		DNSNames: []string{"www.example.com"},
+		NotAfter: time.Now().AddDate(0, 0, 100),
+	})
+	pool := x509.NewCertPool()
+	pool.AddCert(root.cert)
+	cv := newChainVerifier(pool, time.Second)
+	from := leaf.NotAfter.AddDate(0, 0, -40)
+	si := cv.sweep(context.Background(), []*x509.Certificate{leaf}, from)
+	if si == nil {
+		t.Fatal("sweep found no failure")
+	}
+	if want := leaf.NotAfter.Add(time.Second); !si.failsAt.Equal(want) {
+		t.Errorf("fails at %s, wanted %s", si.failsAt, want)
+	}
+	// counted from the -at time, not from now
+	if s := si.String(); !strings.Contains(s, "(in 40 days)") {
+		t.Errorf("got %q, wanted it to fail in 40 days", s)
+	}
+}
+
+func TestRevocationAsOfAt(t *testing.T) {
+	now := time.Now()
+	issuer := newTestCA(t, "Test Issuing CA", nil)
+	leaf, _ := issuer.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+	// a CRL that went stale a week ago
+	der, err := x509.CreateRevocationList(rand.Reader, &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: now.AddDate(0, 0, -14),
+		NextUpdate: now.AddDate(0, 0, -7),
+	}, issuer.cert, issuer.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "stale.crl")
+	if err = os.WriteFile(path, der, 0644); err != nil {
+		t.Fatal(err)
+	}
+	leaf.CRLDistributionPoints = []string{"file://" + path}
+
+	cv := newChainVerifier(nil, time.Second)
+	if rs := cv.checkCRL(context.Background(), leaf, issuer.cert); rs.err == nil {
+		t.Errorf("stale CRL was accepted as of now: %s", rs)
+	}
+	rs := cv.atTime(now.AddDate(0, 0, -10)).checkCRL(context.Background(), leaf, issuer.cert)
+	if rs.err != nil || rs.status != revocationGood {
+		t.Errorf("CRL wasn't current as of -at: %s", rs)
+	}
+}
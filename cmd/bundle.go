@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bundleEntry is a certificate in a minimum bundle, with the targets that
+// needed it and their tags.
+type bundleEntry struct {
+	cert     *x509.Certificate
+	neededBy []string
+	tags     []string
+}
+
+func (be *bundleEntry) fingerprint() string {
+	sum := sha256.Sum256(be.cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// minBundle collects the certificates targets need, each once.
+type minBundle struct {
+	entries map[string]*bundleEntry
+}
+
+func newMinBundle() *minBundle {
+	return &minBundle{entries: make(map[string]*bundleEntry)}
+}
+
+// add records that target, tagged with tags, needed certs.
+func (mb *minBundle) add(target string, tags []string, certs []*x509.Certificate) {
+	for _, cert := range certs {
+		be, ok := mb.entries[thumb(cert)]
+		if !ok {
+			be = &bundleEntry{cert: cert}
+			mb.entries[thumb(cert)] = be
+		}
+		if !containsString(be.neededBy, target) {
+			be.neededBy = append(be.neededBy, target)
+		}
+		for _, tag := range tags {
+			if !containsString(be.tags, tag) {
+				be.tags = append(be.tags, tag)
+			}
+		}
+	}
+}
+
+// sorted returns the entries ordered by subject, then by fingerprint, with
+// their targets and tags sorted too, so the same inputs always make the same
+// bundle whatever order they came in.
+func (mb *minBundle) sorted() []*bundleEntry {
+	ret := make([]*bundleEntry, 0, len(mb.entries))
+	for _, be := range mb.entries {
+		sort.Strings(be.neededBy)
+		sort.Strings(be.tags)
+		ret = append(ret, be)
+	}
+	sort.Slice(ret, func(i, j int) bool {
+		si, sj := ret[i].cert.Subject.String(), ret[j].cert.Subject.String()
+		if si != sj {
+			return si < sj
+		}
+		return ret[i].fingerprint() < ret[j].fingerprint()
+	})
+	return ret
+}
+
+// writeBundleEntry writes the certificate as PEM, headed by comments saying
+// what it is and which targets, if any, needed it and how they were tagged.
+func writeBundleEntry(w io.Writer, be *bundleEntry) error {
+	cert := be.cert
+	_, err := fmt.Fprintf(w, "# %s\n# subject: %s\n# sha256: %s\n# valid: %s to %s\n",
+		cert.Subject.CommonName, cert.Subject, be.fingerprint(),
+		cert.NotBefore.UTC().Format(time.RFC3339), cert.NotAfter.UTC().Format(time.RFC3339))
+	if err != nil {
+		return err
+	}
+	if len(be.neededBy) > 0 {
+		if _, err = fmt.Fprintf(w, "# needed by: %s\n", strings.Join(be.neededBy, ", ")); err != nil {
+			return err
+		}
+	}
+	if len(be.tags) > 0 {
+		if _, err = fmt.Fprintf(w, "# tags: %s\n", strings.Join(be.tags, ", ")); err != nil {
+			return err
+		}
+	}
+	return pem.Encode(w, &pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: cert.Raw,
+	})
+}
@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"sort"
+	"testing"
+)
+
+func TestMinBundleSorted(t *testing.T) {
+	rootB := newTestCA(t, "B Root", nil)
+	rootA := newTestCA(t, "A Root", nil)
+	// two intermediates with the same subject, told apart by fingerprint
+	twin1 := newTestCA(t, "Twin Intermediate", rootA)
+	twin2 := newTestCA(t, "Twin Intermediate", rootA)
+	if twin1.cert.Subject.String() != twin2.cert.Subject.String() {
+		t.Fatal("twins have different subjects")
+	}
+	first, second := twin1.cert, twin2.cert
+	if hashHex(second.Raw) < hashHex(first.Raw) {
+		first, second = second, first
+	}
+
+	type input struct {
+		target string
+		tags   []string
+		certs  []*x509.Certificate
+	}
+	inputs := []input{
+		{target: "www.example.com:443", tags: []string{"web", "prod"}, certs: []*x509.Certificate{twin1.cert, rootA.cert}},
+		{target: "api.example.com:443", tags: []string{"api"}, certs: []*x509.Certificate{rootB.cert, twin2.cert, rootA.cert}},
+		{target: "mail.example.com:25", tags: []string{"prod"}, certs: []*x509.Certificate{rootB.cert}},
+	}
+	wantOrder := []*x509.Certificate{rootA.cert, rootB.cert, first, second}
+
+	var want []byte
+	for _, perm := range [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}} {
+		for _, reverse := range []bool{false, true} {
+			mb := newMinBundle()
+			for _, i := range perm {
+				in := inputs[i]
+				certs := append([]*x509.Certificate(nil), in.certs...)
+				tags := append([]string(nil), in.tags...)
+				if reverse {
+					sort.Sort(sort.Reverse(sort.StringSlice(tags)))
+					for l, r := 0, len(certs)-1; l < r; l, r = l+1, r-1 {
+						certs[l], certs[r] = certs[r], certs[l]
+					}
+				}
+				mb.add(in.target, tags, certs)
+			}
+			entries := mb.sorted()
+			if len(entries) != len(wantOrder) {
+				t.Fatalf("%v: got %d entries, wanted %d", perm, len(entries), len(wantOrder))
+			}
+			var got bytes.Buffer
+			for i, be := range entries {
+				if !be.cert.Equal(wantOrder[i]) {
+					t.Fatalf("%v: entry %d is %s, wanted %s", perm, i, be.cert.Subject.CommonName,
+						wantOrder[i].Subject.CommonName)
+				}
+				if err := writeBundleEntry(&got, be); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if want == nil {
+				want = got.Bytes()
+				continue
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Fatalf("%v, reversed %v: got\n%s\nwanted\n%s", perm, reverse, got.Bytes(), want)
+			}
+		}
+	}
+
+	// the annotations name every target and tag, whatever order they came in
+	for _, needle := range []string{
+		"# needed by: api.example.com:443, www.example.com:443\n# tags: api, prod, web\n",
+		"# needed by: api.example.com:443, mail.example.com:25\n# tags: api, prod\n",
+	} {
+		if !bytes.Contains(want, []byte(needle)) {
+			t.Fatalf("bundle is missing %q:\n%s", needle, want)
+		}
+	}
+}
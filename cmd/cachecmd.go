@@ -0,0 +1,200 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	cacheList   = "list"
+	cachePrune  = "prune"
+	cacheImport = "import"
+	cacheExport = "export"
+)
+
+// CacheCmd manages the AIA cache.  Each action is its own subcommand, and
+// without one it only shows help.
+type CacheCmd struct {
+	action string
+	format string
+	out    string
+	files  globparams
+	all    bool
+	storeOptions
+	cacheOptions
+	*BaseCmd
+}
+
+func NewCacheCmd(action string) *CacheCmd {
+	cc := &CacheCmd{
+		action:  action,
+		BaseCmd: &BaseCmd{},
+	}
+	cc.BaseCmd.Init(strings.TrimSpace("cache " + action))
+	cc.f.SetOutput(cc.b)
+	if action == "" {
+		return cc
+	}
+	cc.cacheOptions.register(cc.f)
+	switch action {
+	case cacheList:
+		cc.f.StringVar(&cc.format, "format", formatText, "output `format`, one of text, json or ndjson")
+	case cachePrune:
+		cc.f.BoolVar(&cc.all, "all", false, "empty the cache, rather than only removing what's older than "+
+			"-cache-ttl or has expired")
+	case cacheImport:
+		cc.f.Var(&cc.files, "p", "import the intermediates in the pem, der or p7b files in `pathspec`")
+	case cacheExport:
+		cc.f.StringVar(&cc.format, "format", formatPEM, "output `format`, one of pem, der, p7b, p12 or jks")
+		cc.f.StringVar(&cc.out, "out", "-", "write the cached intermediates to `path`.  use - for stdout")
+		cc.storeOptions.register(cc.f)
+	}
+	return cc
+}
+
+func (cc *CacheCmd) Synopsis() string {
+	switch cc.action {
+	case cacheList:
+		return "list the intermediates in the AIA cache"
+	case cachePrune:
+		return "remove stale and expired intermediates from the AIA cache"
+	case cacheImport:
+		return "add intermediates from certificate files to the AIA cache, for use with -offline"
+	case cacheExport:
+		return "write every intermediate in the AIA cache to a bundle"
+	}
+	return "manage the cache of intermediates fetched through AIA"
+}
+
+func (cc *CacheCmd) Run(args []string) int {
+	err := cc.f.Parse(args)
+	if err != nil || cc.action == "" || (cc.action == cacheImport && len(cc.files) == 0) {
+		return RunResultHelp
+	}
+	if cc.dir == "" {
+		log.Println("no cache: set -cache-dir or $" + cacheDirEnv)
+		return RunResultHelp
+	}
+	if err = cc.cacheOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	switch cc.action {
+	case cacheList:
+		err = validateFormat(cc.format, formatText, formatJSON, formatNDJSON)
+	case cacheExport:
+		err = validateFormat(cc.format, bundleFormats...)
+		if err == nil {
+			err = cc.storeOptions.validate()
+		}
+	}
+	if err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	ac := cc.cacheOptions.cache()
+	switch cc.action {
+	case cacheList:
+		err = cc.list(ac)
+	case cachePrune:
+		err = cc.prune(ac)
+	case cacheImport:
+		err = cc.importFiles(ac)
+	case cacheExport:
+		err = cc.export(ac)
+	}
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func (cc *CacheCmd) list(ac *aiaCache) error {
+	entries, err := ac.entries()
+	if err != nil {
+		return err
+	}
+	if !isJSONFormat(cc.format) {
+		for _, e := range entries {
+			fmt.Println(e)
+		}
+		return nil
+	}
+	rw := newRecordWriter(os.Stdout, cc.format)
+	for _, e := range entries {
+		if err = rw.write(newCachedCertRecord(ac, e)); err != nil {
+			return err
+		}
+	}
+	return rw.close()
+}
+
+func (cc *CacheCmd) prune(ac *aiaCache) error {
+	removed, err := ac.prune(cc.all)
+	if err != nil {
+		return err
+	}
+	for _, e := range removed {
+		if e.cert != nil {
+			log.Printf("removed %s (%s)", e.cert.Subject.CommonName, e.sum)
+		} else {
+			log.Printf("removed %s", e.sum)
+		}
+	}
+	log.Printf("removed %d certificates", len(removed))
+	return nil
+}
+
+// importFiles stores every CA certificate in the -p files.  Imported
+// certificates are only found by subject and key id, as there's no URL they
+// came from.
+func (cc *CacheCmd) importFiles(ac *aiaCache) error {
+	imported := 0
+	for _, path := range cc.files {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("error reading file %s: %w", path, err)
+		}
+		certs, err := parseAIAResponse("", raw)
+		if err != nil {
+			return fmt.Errorf("error parsing certificates for file %s: %w", path, err)
+		}
+		for _, cert := range certs {
+			if !cert.IsCA {
+				log.Printf("skipping %s from %s, it isn't a CA", cert.Subject.CommonName, path)
+				continue
+			}
+			if err = ac.store("", cert); err != nil {
+				return err
+			}
+			imported++
+		}
+	}
+	log.Printf("imported %d certificates", imported)
+	return nil
+}
+
+func (cc *CacheCmd) export(ac *aiaCache) error {
+	entries, err := ac.entries()
+	if err != nil {
+		return err
+	}
+	var certs []*x509.Certificate
+	for _, e := range entries {
+		if e.cert != nil {
+			certs = append(certs, e.cert)
+		}
+	}
+	w, err := openOutput(cc.out)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	if err = writeBundle(w, cc.format, certEntries(certs), &cc.storeOptions); err != nil {
+		return err
+	}
+	return w.Close()
+}
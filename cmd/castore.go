@@ -0,0 +1,198 @@
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// caStoreSystem names the system trust store in -ca.
+const caStoreSystem = "system"
+
+// caStore is a named set of trusted roots.
+type caStore struct {
+	name string
+	// path is the bundle the roots come from, empty for the system store.
+	path string
+	// roots is nil for the system store, so that platform verification is
+	// used where there is one.
+	roots *x509.CertPool
+}
+
+func (cs *caStore) load() error {
+	if cs.path == "" {
+		return nil
+	}
+	var err error
+	_, cs.roots, err = loadCABundle(cs.path)
+	if err != nil {
+		return fmt.Errorf("error loading ca store %s: %w", cs.name, err)
+	}
+	return nil
+}
+
+// poolWith returns a copy of the store's roots with cert added.
+func (cs *caStore) poolWith(cert *x509.Certificate) (*x509.CertPool, error) {
+	base := cs.roots
+	if base == nil {
+		var err error
+		if base, err = x509.SystemCertPool(); err != nil {
+			return nil, err
+		}
+	}
+	pool := base.Clone()
+	pool.AddCert(cert)
+	return pool, nil
+}
+
+// castoreparams collects repeated -ca flags, each of which is a bundle path,
+// name=path, or system for the system store.
+type castoreparams []*caStore
+
+func (cp *castoreparams) Set(v string) error {
+	cs := &caStore{name: v, path: v}
+	if i := strings.Index(v, "="); i > 0 {
+		cs.name, cs.path = v[:i], v[i+1:]
+	}
+	if cs.path == "" {
+		return fmt.Errorf("no bundle given for ca store %s", cs.name)
+	}
+	if cs.path == caStoreSystem {
+		cs.path = ""
+	}
+	for _, other := range *cp {
+		if other.name == cs.name {
+			return fmt.Errorf("ca store %s given more than once", cs.name)
+		}
+	}
+	*cp = append(*cp, cs)
+	return nil
+}
+
+func (cp *castoreparams) String() string {
+	return ""
+}
+
+// primary is the store checks are judged by, the first given or else the
+// system store.
+func (cp castoreparams) primary() *caStore {
+	if len(cp) == 0 {
+		return &caStore{name: caStoreSystem}
+	}
+	return cp[0]
+}
+
+// storeResult is how a target fared against one trust store.
+type storeResult struct {
+	store  *caStore
+	chains [][]*x509.Certificate
+	err    error
+	// missing holds the roots other stores verified with that would let
+	// this one verify too.
+	missing []*x509.Certificate
+}
+
+func (sr *storeResult) ok() bool {
+	return sr.err == nil
+}
+
+// checkStores verifies the certificates res was served against every store.
+// cv verifies against the primary store, whose outcome is already in res.
+func checkStores(ctx context.Context, cv *chainVerifier, stores castoreparams, res *checkResult) []*storeResult {
+	served := append([]*x509.Certificate{res.leaf}, res.intermediates...)
+	fetched := append([]*x509.Certificate{}, res.fetched...)
+	ret := make([]*storeResult, len(stores))
+	for i, store := range stores {
+		sr := &storeResult{store: store}
+		if i == 0 {
+			sr.chains, sr.err = res.chains, res.chainErr
+		} else {
+			var dled []*x509.Certificate
+			sr.chains, dled, sr.err = cv.withRoots(store.roots).verifyChains(ctx, served)
+			fetched = append(fetched, dled...)
+		}
+		ret[i] = sr
+	}
+
+	var anchors []*x509.Certificate
+	for _, sr := range ret {
+		for _, chain := range sr.chains {
+			if a := anchorOf(chain); certIndex(anchors, a) < 0 {
+				anchors = append(anchors, a)
+			}
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range served[1:] {
+		intermediates.AddCert(cert)
+	}
+	for _, cert := range fetched {
+		intermediates.AddCert(cert)
+	}
+	for _, sr := range ret {
+		if sr.ok() {
+			continue
+		}
+		for _, a := range anchors {
+			roots, err := sr.store.poolWith(a)
+			if err != nil {
+				continue
+			}
+			// as of the same time and for the same purpose as the verdict
+			_, err = res.leaf.Verify(cv.withRoots(roots).verifyOptions(intermediates))
+			if err == nil {
+				sr.missing = append(sr.missing, a)
+			}
+		}
+	}
+	return ret
+}
+
+// writeStoreMatrix writes a table of which targets verified against which
+// stores, followed by what each failing store is missing.
+func writeStoreMatrix(w io.Writer, stores castoreparams, results []*checkResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprint(tw, "target")
+	for _, store := range stores {
+		fmt.Fprintf(tw, "\t%s", store.name)
+	}
+	fmt.Fprintln(tw)
+	var notes []string
+	for _, res := range results {
+		if res == nil {
+			continue
+		}
+		fmt.Fprint(tw, res.target)
+		if len(res.stores) == 0 {
+			for range stores {
+				fmt.Fprint(tw, "\t-")
+			}
+			fmt.Fprintln(tw)
+			continue
+		}
+		for _, sr := range res.stores {
+			if sr.ok() {
+				fmt.Fprint(tw, "\tok")
+				continue
+			}
+			fmt.Fprint(tw, "\tFAIL")
+			for _, m := range sr.missing {
+				notes = append(notes, fmt.Sprintf("%s: %s is missing %s",
+					res.target, sr.store.name, m.Subject.CommonName))
+			}
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	for _, n := range notes {
+		if _, err := fmt.Fprintln(w, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
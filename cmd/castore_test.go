@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"testing"
+	"time"
+)
+
+func TestCheckStoresMissing(t *testing.T) {
+	rootA := newTestCA(t, "Root A", nil)
+	rootB := newTestCA(t, "Root B", nil)
+	intermediate := newTestCA(t, "Intermediate A", rootA)
+	now := time.Now()
+	// expired now, but valid half an hour ago
+	expired, _ := intermediate.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "expired leaf"},
+		NotBefore:   now.Add(-50 * time.Minute),
+		NotAfter:    now.Add(-10 * time.Minute),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	// valid now, but expired a month from now
+	expiring, _ := intermediate.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "expiring leaf"},
+		NotAfter:    now.AddDate(0, 0, 7),
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	client, _ := intermediate.issue(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client leaf"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	pool := func(ca *testCA) *x509.CertPool {
+		p := x509.NewCertPool()
+		p.AddCert(ca.cert)
+		return p
+	}
+	stores := castoreparams{
+		{name: "a", roots: pool(rootA)},
+		{name: "b", roots: pool(rootB)},
+	}
+
+	tests := []struct {
+		name    string
+		leaf    *x509.Certificate
+		at      time.Time
+		purpose string
+		// primaryOK is whether the primary store verifies, and missing
+		// whether store b is found to be missing Root A
+		primaryOK bool
+		missing   bool
+	}{
+		{name: "valid", leaf: client, purpose: "clientAuth", primaryOK: true, missing: true},
+		{name: "valid at -at", leaf: expired, at: now.Add(-30 * time.Minute), purpose: purposeServerAuth,
+			primaryOK: true, missing: true},
+		{name: "expired at -at", leaf: expiring, at: now.AddDate(0, 1, 0), purpose: purposeServerAuth},
+		{name: "wrong purpose", leaf: client, purpose: purposeServerAuth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cv := newChainVerifier(stores.primary().roots, time.Second)
+			cv.now = tt.at
+			cv.keyUsages = purposeKeyUsages(tt.purpose)
+			res := &checkResult{leaf: tt.leaf, intermediates: []*x509.Certificate{intermediate.cert}}
+			res.chains, _, res.chainErr = cv.verifyChains(context.Background(),
+				[]*x509.Certificate{tt.leaf, intermediate.cert})
+
+			srs := checkStores(context.Background(), cv, stores, res)
+			if srs[0].ok() != tt.primaryOK {
+				t.Fatalf("primary store ok is %v, wanted %v: %v", srs[0].ok(), tt.primaryOK, srs[0].err)
+			}
+			if srs[1].ok() {
+				t.Fatal("store b verified without Root A")
+			}
+			switch {
+			case tt.missing && (len(srs[1].missing) != 1 || !srs[1].missing[0].Equal(rootA.cert)):
+				t.Fatalf("store b is missing %v, wanted Root A", srs[1].missing)
+			case !tt.missing && len(srs[1].missing) > 0:
+				t.Fatalf("store b is missing %s, but the primary store didn't verify either",
+					srs[1].missing[0].Subject.CommonName)
+			}
+		})
+	}
+}
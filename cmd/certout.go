@@ -0,0 +1,420 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/cryptobyte"
+	casn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// Formats certificates can be written to -out in, besides PEM.
+const (
+	formatDER = "der"
+	formatP7B = "p7b"
+	formatP12 = "p12"
+	formatJKS = "jks"
+)
+
+// bundleFormats are the formats writeBundle can write.
+var bundleFormats = []string{formatPEM, formatDER, formatP7B, formatP12, formatJKS}
+
+func isBundleFormat(format string) bool {
+	return containsString(bundleFormats, format)
+}
+
+// defaultStorePassword is what Java uses for its own truststore.  A
+// truststore holds nothing secret, so the password only guards against
+// tampering.
+const defaultStorePassword = "changeit"
+
+// storeOptions holds the flags for the keystore formats, p12 and jks.
+type storeOptions struct {
+	passEnv string
+	alias   string
+	tmpl    *template.Template
+}
+
+func (so *storeOptions) register(f *flag.FlagSet) {
+	f.StringVar(&so.passEnv, "store-pass-env", "WHICHCA_STORE_PASSWORD", "read the p12 or jks store password "+
+		"from environment variable `name`, using "+defaultStorePassword+" if it isn't set")
+	f.StringVar(&so.alias, "alias", "{{.CN}}", "name p12 and jks entries with `template`, using any of "+
+		"{{.CN}}, {{.Subject}}, {{.SHA256}}, {{.Serial}}, {{.Index}} and {{.Tags}}")
+}
+
+func (so *storeOptions) validate() error {
+	var err error
+	if so.tmpl, err = template.New("alias").Option("missingkey=error").Parse(so.alias); err != nil {
+		return fmt.Errorf("invalid alias template: %w", err)
+	}
+	return nil
+}
+
+func (so *storeOptions) password() string {
+	if v, ok := os.LookupEnv(so.passEnv); ok && so.passEnv != "" {
+		return v
+	}
+	return defaultStorePassword
+}
+
+// aliases names each certificate with the alias template.  Aliases are
+// lowercased, as Java looks them up without regard to case, and made unique
+// by numbering any repeats.
+func (so *storeOptions) aliases(entries []*bundleEntry) ([]string, error) {
+	ret := make([]string, 0, len(entries))
+	seen := make(map[string]bool)
+	for i, be := range entries {
+		var b strings.Builder
+		err := so.tmpl.Execute(&b, struct {
+			CN, Subject, SHA256, Serial, Tags string
+			Index                             int
+		}{
+			CN:      be.cert.Subject.CommonName,
+			Subject: be.cert.Subject.String(),
+			SHA256:  be.fingerprint(),
+			Serial:  serialHex(be.cert.SerialNumber),
+			Index:   i + 1,
+			Tags:    strings.Join(be.tags, ","),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error naming %s: %w", be.cert.Subject, err)
+		}
+		alias := strings.ToLower(strings.TrimSpace(b.String()))
+		if alias == "" {
+			alias = be.fingerprint()
+		}
+		unique := alias
+		for n := 2; seen[unique]; n++ {
+			unique = fmt.Sprintf("%s-%d", alias, n)
+		}
+		seen[unique] = true
+		ret = append(ret, unique)
+	}
+	return ret, nil
+}
+
+// openOutput opens path for writing, or stdout for -.
+func openOutput(path string) (io.WriteCloser, error) {
+	if path == "-" {
+		return nopWriteCloser{os.Stdout}, nil
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open file %s for writing: %w", path, err)
+	}
+	return f, nil
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// certEntries wraps certificates that weren't needed by any target in
+// particular.
+func certEntries(certs []*x509.Certificate) []*bundleEntry {
+	ret := make([]*bundleEntry, 0, len(certs))
+	for _, cert := range certs {
+		ret = append(ret, &bundleEntry{cert: cert})
+	}
+	return ret
+}
+
+// writeBundle writes entries to w in format, one of bundleFormats.  DER
+// certificates are written back to back, which suits the tools that take DER
+// when there's only one.
+func writeBundle(w io.Writer, format string, entries []*bundleEntry, so *storeOptions) error {
+	var (
+		out []byte
+		err error
+	)
+	switch format {
+	case formatPEM:
+		for _, be := range entries {
+			if err = writeBundleEntry(w, be); err != nil {
+				return err
+			}
+		}
+		return nil
+	case formatDER:
+		for _, be := range entries {
+			out = append(out, be.cert.Raw...)
+		}
+	case formatP7B:
+		out, err = encodePKCS7(entries)
+	case formatP12:
+		out, err = encodePKCS12(entries, so)
+	case formatJKS:
+		out, err = encodeJKS(entries, so)
+	default:
+		return validateFormat(format, bundleFormats...)
+	}
+	if err != nil {
+		return fmt.Errorf("error encoding %s: %w", format, err)
+	}
+	_, err = w.Write(out)
+	return err
+}
+
+var (
+	oidPKCS7Data       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidPKCS7SignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+var explicit0 = casn1.Tag(0).Constructed().ContextSpecific()
+
+// encodePKCS7 writes a certs-only PKCS#7 SignedData, the .p7b Windows and
+// some appliances import.
+func encodePKCS7(entries []*bundleEntry) ([]byte, error) {
+	b := cryptobyte.NewBuilder(nil)
+	b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(oidPKCS7SignedData)
+		b.AddASN1(explicit0, func(b *cryptobyte.Builder) {
+			b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				b.AddASN1Int64(1)
+				// no digest algorithms, no content and no signers
+				b.AddASN1(casn1.SET, func(b *cryptobyte.Builder) {})
+				b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(oidPKCS7Data)
+				})
+				b.AddASN1(explicit0, func(b *cryptobyte.Builder) {
+					for _, be := range entries {
+						b.AddBytes(be.cert.Raw)
+					}
+				})
+				b.AddASN1(casn1.SET, func(b *cryptobyte.Builder) {})
+			})
+		})
+	})
+	return b.Bytes()
+}
+
+var (
+	oidCertBag          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidSHA256           = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidAnyExtendedUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+	// oidJavaTrustedKeyUsage marks a certificate bag as a trusted entry,
+	// without which Java ignores certificates that have no key.
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+)
+
+// pkcs12Iterations is the MAC key derivation work factor, as OpenSSL uses.
+const pkcs12Iterations = 2048
+
+// encodePKCS12 writes a PKCS#12 truststore of trusted certificate entries,
+// integrity protected with an HMAC-SHA256 keyed from the store password.
+// The certificates themselves aren't encrypted, there being nothing secret
+// in them.
+func encodePKCS12(entries []*bundleEntry, so *storeOptions) ([]byte, error) {
+	aliases, err := so.aliases(entries)
+	if err != nil {
+		return nil, err
+	}
+	safe := cryptobyte.NewBuilder(nil)
+	safe.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for i, be := range entries {
+			b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				b.AddASN1ObjectIdentifier(oidCertBag)
+				b.AddASN1(explicit0, func(b *cryptobyte.Builder) {
+					b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+						b.AddASN1ObjectIdentifier(oidX509Certificate)
+						b.AddASN1(explicit0, func(b *cryptobyte.Builder) {
+							b.AddASN1OctetString(be.cert.Raw)
+						})
+					})
+				})
+				b.AddASN1(casn1.SET, func(b *cryptobyte.Builder) {
+					b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+						b.AddASN1ObjectIdentifier(oidFriendlyName)
+						b.AddASN1(casn1.SET, func(b *cryptobyte.Builder) {
+							b.AddASN1(casn1.Tag(30), func(b *cryptobyte.Builder) {
+								b.AddBytes(bmpString(aliases[i], false))
+							})
+						})
+					})
+					b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+						b.AddASN1ObjectIdentifier(oidJavaTrustedKeyUsage)
+						b.AddASN1(casn1.SET, func(b *cryptobyte.Builder) {
+							b.AddASN1ObjectIdentifier(oidAnyExtendedUsage)
+						})
+					})
+				})
+			})
+		}
+	})
+	safeContents, err := safe.Bytes()
+	if err != nil {
+		return nil, err
+	}
+	auth := cryptobyte.NewBuilder(nil)
+	auth.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		addPKCS7Data(b, safeContents)
+	})
+	authSafe, err := auth.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err = rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key := pkcs12KDF(bmpString(so.password(), true), salt, 3, pkcs12Iterations, sha256.Size)
+	mac := hmac.New(sha256.New, key)
+	mac.Write(authSafe)
+
+	pfx := cryptobyte.NewBuilder(nil)
+	pfx.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1Int64(3)
+		addPKCS7Data(b, authSafe)
+		b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+			b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+				b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					b.AddASN1ObjectIdentifier(oidSHA256)
+					b.AddASN1NULL()
+				})
+				b.AddASN1OctetString(mac.Sum(nil))
+			})
+			b.AddASN1OctetString(salt)
+			b.AddASN1Int64(pkcs12Iterations)
+		})
+	})
+	return pfx.Bytes()
+}
+
+// addPKCS7Data adds a PKCS#7 ContentInfo holding data.
+func addPKCS7Data(b *cryptobyte.Builder, data []byte) {
+	b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		b.AddASN1ObjectIdentifier(oidPKCS7Data)
+		b.AddASN1(explicit0, func(b *cryptobyte.Builder) {
+			b.AddASN1OctetString(data)
+		})
+	})
+}
+
+// bmpString encodes s as UTF-16BE, optionally with the terminating NUL
+// PKCS#12 passwords carry.
+func bmpString(s string, terminated bool) []byte {
+	var ret []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		ret = append(ret, byte(r>>8), byte(r))
+	}
+	if terminated {
+		ret = append(ret, 0, 0)
+	}
+	return ret
+}
+
+// pkcs12KDF derives size bytes of key material of the given purpose id from
+// a BMPString password, as described in RFC 7292 appendix B.2, using SHA-256.
+func pkcs12KDF(pass, salt []byte, id byte, iterations, size int) []byte {
+	const u, v = sha256.Size, 64
+	fill := func(src []byte) []byte {
+		if len(src) == 0 {
+			return nil
+		}
+		ret := make([]byte, v*((len(src)+v-1)/v))
+		for i := range ret {
+			ret[i] = src[i%len(src)]
+		}
+		return ret
+	}
+	d := bytes.Repeat([]byte{id}, v)
+	in := append(fill(salt), fill(pass)...)
+	var out []byte
+	for len(out) < size {
+		h := sha256.New()
+		h.Write(d)
+		h.Write(in)
+		a := h.Sum(nil)
+		for r := 1; r < iterations; r++ {
+			sum := sha256.Sum256(a)
+			a = sum[:]
+		}
+		out = append(out, a...)
+		if len(out) >= size {
+			break
+		}
+		bb := make([]byte, v)
+		for i := range bb {
+			bb[i] = a[i%u]
+		}
+		// each v byte block of in becomes (block + bb + 1) mod 2^(8v)
+		for j := 0; j < len(in); j += v {
+			carry := 1
+			for k := v - 1; k >= 0; k-- {
+				sum := int(in[j+k]) + int(bb[k]) + carry
+				in[j+k] = byte(sum)
+				carry = sum >> 8
+			}
+		}
+	}
+	return out[:size]
+}
+
+// JKS constants, from the format Sun's keytool has always written.
+const (
+	jksMagic          = 0xfeedfeed
+	jksVersion        = 2
+	jksTrustedCertTag = 2
+	jksDigestWhitener = "Mighty Aphrodite"
+)
+
+// encodeJKS writes a Java keystore of trusted certificate entries, with the
+// keyed SHA-1 digest Java checks the store password against.
+func encodeJKS(entries []*bundleEntry, so *storeOptions) ([]byte, error) {
+	aliases, err := so.aliases(entries)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	writeUTF := func(s string) error {
+		if len(s) > 0xffff {
+			return fmt.Errorf("%q is too long for a jks string", s)
+		}
+		binary.Write(&buf, binary.BigEndian, uint16(len(s)))
+		buf.WriteString(s)
+		return nil
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(jksMagic))
+	binary.Write(&buf, binary.BigEndian, uint32(jksVersion))
+	binary.Write(&buf, binary.BigEndian, uint32(len(entries)))
+	created := time.Now().UnixMilli()
+	for i, be := range entries {
+		binary.Write(&buf, binary.BigEndian, uint32(jksTrustedCertTag))
+		if err = writeUTF(aliases[i]); err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.BigEndian, created)
+		if err = writeUTF("X.509"); err != nil {
+			return nil, err
+		}
+		binary.Write(&buf, binary.BigEndian, uint32(len(be.cert.Raw)))
+		buf.Write(be.cert.Raw)
+	}
+	h := sha1.New()
+	h.Write(bmpString(so.password(), false))
+	h.Write([]byte(jksDigestWhitener))
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+	return buf.Bytes(), nil
+}
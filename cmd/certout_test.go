@@ -0,0 +1,363 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+	"unicode/utf16"
+
+	"golang.org/x/crypto/cryptobyte"
+	casn1 "golang.org/x/crypto/cryptobyte/asn1"
+)
+
+// testEntries returns bundle entries for a root, an intermediate and a
+// second root.
+func testEntries(t *testing.T) []*bundleEntry {
+	t.Helper()
+	root := newTestCA(t, "Test Root", nil)
+	intermediate := newTestCA(t, "Test Intermediate", root)
+	other := newTestCA(t, "Other Root", nil)
+	return certEntries([]*x509.Certificate{root.cert, intermediate.cert, other.cert})
+}
+
+// testStoreOptions returns store options with the default alias template,
+// reading the password from envVar.
+func testStoreOptions(t *testing.T, envVar string) *storeOptions {
+	t.Helper()
+	so := &storeOptions{passEnv: envVar, alias: "{{.CN}}"}
+	if err := so.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return so
+}
+
+func TestSerialHex(t *testing.T) {
+	tests := []struct {
+		serial *big.Int
+		want   string
+	}{
+		{big.NewInt(1), "01"},
+		{big.NewInt(0x0a1b), "0a1b"},
+		{big.NewInt(0x8000), "8000"},
+		{big.NewInt(-1), "-01"},
+		{big.NewInt(-0x8000), "-8000"},
+		{new(big.Int).Lsh(big.NewInt(1), 152), "01" + strings.Repeat("00", 19)},
+	}
+	for _, tt := range tests {
+		if got := serialHex(tt.serial); got != tt.want {
+			t.Errorf("serialHex(%s) = %s, wanted %s", tt.serial, got, tt.want)
+		}
+	}
+}
+
+func TestPKCS12KDF(t *testing.T) {
+	// expected values are from OpenSSL's PKCS12KDF with SHA2-256
+	tests := []struct {
+		pass       []byte
+		salt       string
+		id         byte
+		iterations int
+		want       string
+	}{
+		{
+			pass:       bmpString("changeit", true),
+			salt:       "0001020304050607",
+			id:         3,
+			iterations: 2048,
+			want:       "80e37e8c410c89e0ccfe53d60bfe7305275f6351561066c7588c21fd2311990b",
+		},
+		{
+			// a password longer than a block, and more than one hash's worth
+			// of output
+			pass:       bmpString("correct horse battery staple, then some more to pass 64 bytes", true),
+			salt:       "ffeeddccbbaa99887766554433221100",
+			id:         1,
+			iterations: 1,
+			want: "632b6efc825d9f44feadb7ad6e4b7f2cebfda3b5f85780762bc5a9bd2efcc343" +
+				"c43c3f3192d5e4c45cdbf2bf4e6f83a8b8a8b95cf75837cb3b43fe9cc9e77660" +
+				"235e2d6f1872597ed58845ed6030bb66",
+		},
+		{
+			salt:       "0102030405060708",
+			id:         2,
+			iterations: 1000,
+			want: "97abcb13e770a341013c7e8dcc7e91abd8b2dea069827cf5bb575403df6c597c" +
+				"50635842b9b7d4580e989032fea782be",
+		},
+	}
+	for i, tt := range tests {
+		t.Run(fmt.Sprint(i), func(t *testing.T) {
+			salt, err := hex.DecodeString(tt.salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := hex.DecodeString(tt.want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := pkcs12KDF(tt.pass, salt, tt.id, tt.iterations, len(want)); !bytes.Equal(got, want) {
+				t.Fatalf("got %x, wanted %x", got, want)
+			}
+		})
+	}
+}
+
+func TestEncodePKCS7(t *testing.T) {
+	entries := testEntries(t)
+	der, err := encodePKCS7(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sniffAIAFormat(der) != aiaPKCS7 {
+		t.Error("encoded PKCS#7 doesn't sniff as PKCS#7")
+	}
+	certs, err := parsePKCS7Certs(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != len(entries) {
+		t.Fatalf("got %d certificates back, wanted %d", len(certs), len(entries))
+	}
+	for i, cert := range certs {
+		if !cert.Equal(entries[i].cert) {
+			t.Errorf("certificate %d is %s, wanted %s", i, cert.Subject, entries[i].cert.Subject)
+		}
+	}
+}
+
+// pkcs12Bag is a certificate bag read back from a PKCS#12 store.
+type pkcs12Bag struct {
+	der          []byte
+	friendlyName string
+	trusted      bool
+}
+
+// decodePKCS12 reads back what encodePKCS12 writes, checking the MAC with
+// password.
+func decodePKCS12(t *testing.T, pfx []byte, password string) ([]pkcs12Bag, error) {
+	t.Helper()
+	in := cryptobyte.String(pfx)
+	var (
+		seq, authSafeInfo, macData, digestInfo, algID cryptobyte.String
+		version, iterations                           int
+		mac, salt, authSafe                           []byte
+	)
+	if !in.ReadASN1(&seq, casn1.SEQUENCE) || !in.Empty() ||
+		!seq.ReadASN1Integer(&version) || version != 3 ||
+		!seq.ReadASN1(&authSafeInfo, casn1.SEQUENCE) ||
+		!seq.ReadASN1(&macData, casn1.SEQUENCE) || !seq.Empty() {
+		t.Fatal("malformed PFX")
+	}
+	authSafe = readPKCS7Data(t, authSafeInfo)
+	var oid asn1.ObjectIdentifier
+	if !macData.ReadASN1(&digestInfo, casn1.SEQUENCE) ||
+		!digestInfo.ReadASN1(&algID, casn1.SEQUENCE) ||
+		!algID.ReadASN1ObjectIdentifier(&oid) || !oid.Equal(oidSHA256) ||
+		!digestInfo.ReadASN1Bytes(&mac, casn1.OCTET_STRING) ||
+		!macData.ReadASN1Bytes(&salt, casn1.OCTET_STRING) ||
+		!macData.ReadASN1Integer(&iterations) {
+		t.Fatal("malformed MacData")
+	}
+	key := pkcs12KDF(bmpString(password, true), salt, 3, iterations, sha256.Size)
+	h := hmac.New(sha256.New, key)
+	h.Write(authSafe)
+	if !hmac.Equal(h.Sum(nil), mac) {
+		return nil, fmt.Errorf("MAC mismatch")
+	}
+
+	in = cryptobyte.String(authSafe)
+	var infos, info cryptobyte.String
+	if !in.ReadASN1(&infos, casn1.SEQUENCE) || !infos.ReadASN1(&info, casn1.SEQUENCE) || !infos.Empty() {
+		t.Fatal("malformed AuthenticatedSafe")
+	}
+	in = cryptobyte.String(readPKCS7Data(t, info))
+	var bags cryptobyte.String
+	if !in.ReadASN1(&bags, casn1.SEQUENCE) {
+		t.Fatal("malformed SafeContents")
+	}
+	var ret []pkcs12Bag
+	for !bags.Empty() {
+		var bag, bagValue, certBag, certValue, attrs cryptobyte.String
+		var bagID, certID asn1.ObjectIdentifier
+		var b pkcs12Bag
+		if !bags.ReadASN1(&bag, casn1.SEQUENCE) ||
+			!bag.ReadASN1ObjectIdentifier(&bagID) || !bagID.Equal(oidCertBag) ||
+			!bag.ReadASN1(&bagValue, explicit0) ||
+			!bagValue.ReadASN1(&certBag, casn1.SEQUENCE) ||
+			!certBag.ReadASN1ObjectIdentifier(&certID) || !certID.Equal(oidX509Certificate) ||
+			!certBag.ReadASN1(&certValue, explicit0) ||
+			!certValue.ReadASN1Bytes(&b.der, casn1.OCTET_STRING) ||
+			!bag.ReadASN1(&attrs, casn1.SET) {
+			t.Fatal("malformed SafeBag")
+		}
+		for !attrs.Empty() {
+			var attr, values cryptobyte.String
+			var attrID asn1.ObjectIdentifier
+			if !attrs.ReadASN1(&attr, casn1.SEQUENCE) || !attr.ReadASN1ObjectIdentifier(&attrID) ||
+				!attr.ReadASN1(&values, casn1.SET) {
+				t.Fatal("malformed bag attribute")
+			}
+			switch {
+			case attrID.Equal(oidFriendlyName):
+				var name cryptobyte.String
+				if !values.ReadASN1(&name, casn1.Tag(30)) || len(name)%2 != 0 {
+					t.Fatal("malformed friendlyName")
+				}
+				u := make([]uint16, len(name)/2)
+				for i := range u {
+					u[i] = binary.BigEndian.Uint16(name[2*i:])
+				}
+				b.friendlyName = string(utf16.Decode(u))
+			case attrID.Equal(oidJavaTrustedKeyUsage):
+				var usage asn1.ObjectIdentifier
+				b.trusted = values.ReadASN1ObjectIdentifier(&usage) && usage.Equal(oidAnyExtendedUsage)
+			}
+		}
+		ret = append(ret, b)
+	}
+	return ret, nil
+}
+
+// readPKCS7Data returns the content of a PKCS#7 data ContentInfo.
+func readPKCS7Data(t *testing.T, info cryptobyte.String) []byte {
+	t.Helper()
+	var oid asn1.ObjectIdentifier
+	var content cryptobyte.String
+	var data []byte
+	if !info.ReadASN1ObjectIdentifier(&oid) || !oid.Equal(oidPKCS7Data) ||
+		!info.ReadASN1(&content, explicit0) || !content.ReadASN1Bytes(&data, casn1.OCTET_STRING) {
+		t.Fatal("malformed PKCS#7 data")
+	}
+	return data
+}
+
+func TestEncodePKCS12(t *testing.T) {
+	entries := testEntries(t)
+	const envVar = "WHICHCA_TEST_STORE_PASSWORD"
+	for _, password := range []string{"", "s3cret", "pässwörd"} {
+		t.Run(password, func(t *testing.T) {
+			want := defaultStorePassword
+			if password != "" {
+				t.Setenv(envVar, password)
+				want = password
+			}
+			pfx, err := encodePKCS12(entries, testStoreOptions(t, envVar))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err = decodePKCS12(t, pfx, want+"x"); err == nil {
+				t.Error("MAC verified with the wrong password")
+			}
+			bags, err := decodePKCS12(t, pfx, want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(bags) != len(entries) {
+				t.Fatalf("got %d bags, wanted %d", len(bags), len(entries))
+			}
+			for i, b := range bags {
+				be := entries[i]
+				if !bytes.Equal(b.der, be.cert.Raw) {
+					t.Errorf("bag %d holds the wrong certificate", i)
+				}
+				if wantName := strings.ToLower(be.cert.Subject.CommonName); b.friendlyName != wantName {
+					t.Errorf("bag %d is named %q, wanted %q", i, b.friendlyName, wantName)
+				}
+				if !b.trusted {
+					t.Errorf("bag %d isn't marked trusted", i)
+				}
+			}
+		})
+	}
+}
+
+// jksEntry is a trusted certificate entry read back from a JKS store.
+type jksEntry struct {
+	alias string
+	der   []byte
+}
+
+// decodeJKS reads back what encodeJKS writes, checking the digest with
+// password.
+func decodeJKS(t *testing.T, raw []byte, password string) ([]jksEntry, error) {
+	t.Helper()
+	if len(raw) < sha1.Size {
+		t.Fatal("short jks")
+	}
+	body, digest := raw[:len(raw)-sha1.Size], raw[len(raw)-sha1.Size:]
+	h := sha1.New()
+	h.Write(bmpString(password, false))
+	h.Write([]byte(jksDigestWhitener))
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), digest) {
+		return nil, fmt.Errorf("digest mismatch")
+	}
+	in := cryptobyte.String(body)
+	var magic, version, count uint32
+	if !in.ReadUint32(&magic) || magic != jksMagic || !in.ReadUint32(&version) || version != jksVersion ||
+		!in.ReadUint32(&count) {
+		t.Fatal("malformed jks header")
+	}
+	var ret []jksEntry
+	for i := uint32(0); i < count; i++ {
+		var (
+			tag, size       uint32
+			created         uint64
+			alias, certType cryptobyte.String
+			der             []byte
+		)
+		if !in.ReadUint32(&tag) || tag != jksTrustedCertTag ||
+			!in.ReadUint16LengthPrefixed(&alias) ||
+			!in.ReadUint64(&created) ||
+			!in.ReadUint16LengthPrefixed(&certType) || string(certType) != "X.509" ||
+			!in.ReadUint32(&size) || !in.ReadBytes(&der, int(size)) {
+			t.Fatalf("malformed jks entry %d", i)
+		}
+		ret = append(ret, jksEntry{alias: string(alias), der: der})
+	}
+	if !in.Empty() {
+		t.Fatal("trailing data in jks")
+	}
+	return ret, nil
+}
+
+func TestEncodeJKS(t *testing.T) {
+	entries := testEntries(t)
+	so := testStoreOptions(t, "")
+	so.alias = "{{.Index}}-{{.CN}}"
+	if err := so.validate(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := encodeJKS(entries, so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = decodeJKS(t, raw, "changeme"); err == nil {
+		t.Error("digest verified with the wrong password")
+	}
+	got, err := decodeJKS(t, raw, defaultStorePassword)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(entries) {
+		t.Fatalf("got %d entries, wanted %d", len(got), len(entries))
+	}
+	for i, e := range got {
+		be := entries[i]
+		if !bytes.Equal(e.der, be.cert.Raw) {
+			t.Errorf("entry %d holds the wrong certificate", i)
+		}
+		if want := strings.ToLower(fmt.Sprintf("%d-%s", i+1, be.cert.Subject.CommonName)); e.alias != want {
+			t.Errorf("entry %d is named %q, wanted %q", i, e.alias, want)
+		}
+	}
+}
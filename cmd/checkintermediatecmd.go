@@ -1,24 +1,61 @@
 package cmd
 
 import (
-	"crypto/tls"
+	"context"
 	"crypto/x509"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
 	"strings"
+	"time"
 )
 
 type CheckIntermediateCmd struct {
 	hostports stringparams
 	files     globparams
-	cafile    string
-	ca        *x509.CertPool
-	iFile     string
+	// targetsFile lists more targets, each with its own options
+	targetsFile string
+	// cas are the trust stores to check against.  The first decides the
+	// result, the rest only add to the compatibility matrix.
+	cas   castoreparams
+	iFile string
+	// outFormat is the format of the intermediates saved to iFile
+	outFormat string
+	storeOptions
 	quiet     bool
 	dumpCerts bool
+	name      string
+	warnDays  int
+	critDays  int
+	format    string
+	// contOnError keeps going past targets that fail
+	contOnError bool
+	revocation  revocationparams
+	// concurrency is the number of targets checked at once
+	concurrency int
+	// at is the time to check as of, and sweep looks for the first time
+	// after that each target stops verifying.
+	at    atparam
+	sweep bool
+	// purpose is the extended key usage to verify for
+	purpose string
+	// keyFile holds a private key to match against each leaf.  Without it,
+	// keys found alongside the certificates in -p files are matched.
+	keyFile    string
+	passphrase passphraseSource
+	// ctLogFile is a log list to verify SCTs against, which enables the CT
+	// policy check.
+	ctLogFile string
+	ctLogs    ctLogList
+	// enumerate probes -hp targets for every protocol version and cipher
+	// suite they accept.
+	enumerate bool
+	// lint runs the lint rules over the chain.
+	lint bool
+	lintOptions
+	dialOptions
+	cacheOptions
 	*BaseCmd
 }
 
@@ -29,109 +66,393 @@ func NewCheckIntermediateCmd() *CheckIntermediateCmd {
 	ci.BaseCmd.Init("check")
 	ci.f.Var(&ci.hostports, "hp", "inspect site at `host:port` for correctness")
 	ci.f.Var(&ci.files, "p", "search `pathspec` for certificate files")
-	ci.f.StringVar(&ci.cafile, "ca", "", "path to a ca bundle.  defaults to the system bundle")
+	ci.f.StringVar(&ci.targetsFile, "targets", "", "read targets from `path`, one per line, or - for stdin.  "+
+		"each line is a host:port, https URL or file, optionally followed by sni=, starttls=, name= and tags=")
+	ci.f.Var(&ci.cas, "ca", "path to a ca bundle, given as `[name=]path` or system for the system bundle.  "+
+		"defaults to the system bundle.  repeat to check against each and print a compatibility matrix")
 	ci.f.StringVar(&ci.iFile, "out", "-", "path to file to save any intermediates needed. use - for stdout")
+	ci.f.StringVar(&ci.outFormat, "out-format", formatPEM, "save intermediates in `format`, one of pem, der, "+
+		"p7b, p12 or jks")
+	ci.storeOptions.register(ci.f)
 	ci.f.BoolVar(&ci.quiet, "q", false, "whether to suppress writing to path specified in -out")
 	ci.f.BoolVar(&ci.dumpCerts, "dump", false, "if true, dump leaf and intermediate certs returned from server")
+	ci.f.StringVar(&ci.name, "name", "", "verify the leaf certificate is valid for `hostname`.  defaults to the "+
+		"host of each -hp target, -p files are only checked for a name when this is set")
+	ci.f.IntVar(&ci.warnDays, "warn-days", 0, "warn when any certificate in the chain expires within `N` days")
+	ci.f.IntVar(&ci.critDays, "crit-days", 0, "critical when any certificate in the chain expires within `N` days")
+	ci.f.StringVar(&ci.format, "format", formatText, "output `format`, one of text, json or ndjson")
+	ci.f.IntVar(&ci.concurrency, "concurrency", 1, "check up to `N` targets at once")
+	ci.f.BoolVar(&ci.contOnError, "continue", false, "continue on error, then print a summary "+
+		"and exit with a status for the worst result")
+	ci.f.Var(&ci.revocation, "revocation", "check each certificate in the chain for revocation using `method`, "+
+		"ocsp or crl.  both may be given")
+	ci.f.Var(&ci.at, "at", "verify as of `time`, either RFC3339 or an offset from now like +30d")
+	ci.f.BoolVar(&ci.sweep, "sweep", false, "find the first time after -at that each target stops verifying")
+	ci.f.StringVar(&ci.purpose, "purpose", purposeServerAuth, "verify certificates for `purpose`, one of "+
+		"serverAuth, clientAuth, codeSigning, emailProtection or any")
+	ci.f.StringVar(&ci.keyFile, "key", "", "check the private key in `path` matches the leaf.  defaults to "+
+		"any private key in the same file as a -p certificate")
+	ci.f.StringVar(&ci.passphrase.env, "key-pass-env", "WHICHCA_KEY_PASSPHRASE", "read the passphrase for an "+
+		"encrypted private key from environment variable `name`, prompting if it isn't set")
+	ci.f.StringVar(&ci.ctLogFile, "ct-logs", "", "verify the leaf's signed certificate timestamps against the "+
+		"CT log list in `path`, in the format of Chrome's log_list.json, and check it meets the CT policy")
+	ci.f.BoolVar(&ci.enumerate, "enumerate", false, "probe -hp targets for the TLS versions and cipher suites "+
+		"they accept, in the server's order of preference, and the chains served for each")
+	ci.f.BoolVar(&ci.lint, "lint", false, "lint the chain for problems verification lets through, such as SHA-1 "+
+		"signatures, short RSA keys or leaves valid for too long")
+	ci.lintOptions.register(ci.f)
+	ci.cacheOptions.register(ci.f)
+	ci.cacheOptions.registerOffline(ci.f)
+	ci.dialOptions.register(ci.f)
 
 	return ci
 }
 
 func (ci *CheckIntermediateCmd) Run(args []string) int {
 	err := ci.f.Parse(args)
-	if err != nil || (len(ci.files) == 0 && len(ci.hostports) == 0) {
+	if err != nil || (len(ci.files) == 0 && len(ci.hostports) == 0 && ci.targetsFile == "") {
+		return RunResultHelp
+	}
+	if err = ci.dialOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = ci.cacheOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validateFormat(ci.format, formatText, formatJSON, formatNDJSON); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validatePurpose(ci.purpose); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = ci.lintOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validateFormat(ci.outFormat, bundleFormats...); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if ci.dumpCerts && ci.outFormat != formatPEM {
+		log.Println("-dump only works with -out-format pem")
+		return RunResultHelp
+	}
+	if err = ci.storeOptions.validate(); err != nil {
+		log.Println(err)
 		return RunResultHelp
 	}
 
-	if err = ci.run(); err != nil {
+	status, err := ci.run()
+	if err != nil {
 		log.Println(err)
 		return 1
 	}
-	return 0
+	return status
 }
-func (ci *CheckIntermediateCmd) run() error {
-	if ci.cafile != "" {
-		var err error
-		_, ci.ca, err = loadCABundle(ci.cafile)
-		if err != nil {
-			return err
+
+// run checks every target, returning the exit status for the worst result.
+// It stops at the first target that fails unless -continue is set, in which
+// case it keeps going and prints a summary as well.
+func (ci *CheckIntermediateCmd) run() (int, error) {
+	specs, err := loadTargetSpecs(ci.files, ci.hostports, ci.targetsFile)
+	if err != nil {
+		return 1, err
+	}
+	for _, store := range ci.cas {
+		if err := store.load(); err != nil {
+			return 1, err
 		}
 	}
+	if ci.ctLogFile != "" {
+		if ci.ctLogs, err = loadCTLogList(ci.ctLogFile); err != nil {
+			return 1, err
+		}
+	}
+	jsonOut := isJSONFormat(ci.format)
 	save := true
 	var w io.Writer = os.Stdout
+	// the -out file, closed once everything is written to it
+	var out *os.File
 	if ci.quiet || ci.iFile == "" {
 		save = false
 	} else {
 		switch ci.iFile {
 		case "-":
+			// stdout belongs to the json records
+			save = !jsonOut
 			defer os.Stdout.Sync()
 		default:
 			f, err := os.OpenFile(ci.iFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 			if err != nil {
-				return err
+				return 1, err
 			}
-			defer f.Sync()
-			defer f.Close()
-			w = f
+			out, w = f, f
 		}
 	}
-	process := func(ok bool, leaf *x509.Certificate, ints []*x509.Certificate, missing []*x509.Certificate) error {
-		if leaf == nil {
-			return errors.New("no leaf certificate found")
+	var rw *recordWriter
+	if jsonOut {
+		rw = newRecordWriter(os.Stdout, ci.format)
+	}
+	warn := time.Duration(ci.warnDays) * 24 * time.Hour
+	crit := time.Duration(ci.critDays) * 24 * time.Hour
+	summary := newCheckSummary()
+	// the intermediates each target was missing, saved once all are checked
+	missing := newMinBundle()
+	process := func(res *checkResult) error {
+		if res.leaf != nil {
+			res.nameErr = checkName(res.leaf, res.name)
+			if warn > 0 || crit > 0 {
+				chains := res.chains
+				if len(chains) == 0 {
+					// nothing verified, so fall back to what we were given
+					chains = [][]*x509.Certificate{append([]*x509.Certificate{res.leaf}, res.intermediates...)}
+				}
+				res.expiry = soonestExpiry(chains, ci.at.time(), warn, crit)
+			}
 		}
-		if ok {
-			log.Printf("%s is good! :)", leaf.Subject.CommonName)
-		} else {
-			log.Printf("%s is not good :(️", leaf.Subject.CommonName)
-			for _, m := range missing {
-				log.Printf("%s is missing", m.Subject.CommonName)
-				if save {
-					err := writeCert(w, m)
-					if err != nil {
-						return err
-					}
+		summary.add(res.status())
+		if jsonOut {
+			if err := rw.write(res.record()); err != nil {
+				return err
+			}
+		}
+		if err := res.fatal(); err != nil && !ci.contOnError {
+			return err
+		}
+		if res.err != nil {
+			log.Println(res.err)
+			return nil
+		}
+		leaf := res.leaf
+		if !jsonOut {
+			switch res.status() {
+			case statusGood, statusExpiryWarning, statusExpiryCritical:
+				log.Printf("%s is good! :)", leaf.Subject.CommonName)
+			case statusNameMismatch:
+				log.Printf("%s has a good chain but the wrong name :(", leaf.Subject.CommonName)
+			case statusRevoked:
+				log.Printf("%s has a revoked certificate in its chain :(", leaf.Subject.CommonName)
+			case statusServedChain:
+				log.Printf("%s has a good chain but serves it out of shape :(", leaf.Subject.CommonName)
+			case statusKeyMismatch:
+				log.Printf("%s doesn't go with its private key :(", leaf.Subject.CommonName)
+			case statusLintErrors:
+				log.Printf("%s has a good chain but fails linting :(", leaf.Subject.CommonName)
+			case statusCTNonCompliant:
+				log.Printf("%s has a good chain but doesn't meet the CT policy :(", leaf.Subject.CommonName)
+			case statusMustStaple:
+				log.Printf("%s is must-staple but the server didn't staple a usable OCSP response :(", leaf.Subject.CommonName)
+			default:
+				log.Printf("%s is not good :(️", leaf.Subject.CommonName)
+			}
+			if len(res.tags) > 0 {
+				log.Printf("tags: %s", strings.Join(res.tags, ", "))
+			}
+			if res.chainErr != nil {
+				log.Println(res.chainErr)
+			}
+			for i, cp := range rankChains(res.chains) {
+				log.Printf("path %d: %s", i+1, cp)
+			}
+			if res.nameErr != nil {
+				log.Println(res.nameErr)
+			}
+			if res.key != nil {
+				log.Println(res.key)
+			}
+			if res.expiry != nil {
+				log.Println(res.expiry)
+			}
+			for _, rs := range res.revocation {
+				log.Println(rs)
+			}
+			if res.staple != nil {
+				log.Println(res.staple)
+			}
+			if res.servedChain != nil && !res.servedChain.ok() {
+				log.Println(res.servedChain)
+			}
+			if res.ct != nil {
+				log.Println(res.ct)
+			}
+			for _, lf := range res.lint {
+				log.Println(lf)
+			}
+			if res.enum != nil {
+				log.Println(res.enum)
+			}
+			if res.sweep != nil {
+				log.Println(res.sweep)
+			}
+		}
+		if !res.ok {
+			for _, m := range res.missing {
+				if !jsonOut {
+					log.Printf("%s is missing", m.Subject.CommonName)
 				}
 			}
+			missing.add(res.target, res.tags, res.missing)
 		}
-		if ci.dumpCerts {
+		if ci.dumpCerts && (save || !jsonOut) {
 
 			fmt.Fprintf(w, "#  ---------- dumping return from server ----------\n")
 			fmt.Fprintf(w, "#  ----------         leaf               ----------\n")
 			writeCert(w, leaf)
 
 			fmt.Fprintf(w, "#  ----------       intermediates        ----------\n")
-			if len(ints) == 0 {
+			if len(res.intermediates) == 0 {
 				fmt.Fprintf(w, "#  ----------       none returned        ----------\n")
 			}
-			for _, c := range ints {
+			for _, c := range res.intermediates {
 				writeCert(w, c)
 			}
 		}
 
 		return nil
 	}
-	for _, f := range ci.files {
-		ok, leaf, ints, missing, err := checkFile(f, ci.ca)
-		if err != nil {
-			return err
+	cv := newChainVerifier(ci.cas.primary().roots, ci.timeout)
+	cv.now = ci.at.t
+	cv.keyUsages = purposeKeyUsages(ci.purpose)
+	cv.aia.cache = ci.cacheOptions.cache()
+	results := make([]*checkResult, len(specs))
+	var procErr error
+	runOrdered(len(specs), ci.concurrency, func(i int) {
+		results[i] = ci.check(cv, specs[i])
+	}, func(i int) bool {
+		procErr = process(results[i])
+		return procErr == nil
+	})
+	err = procErr
+	if save && len(missing.entries) > 0 {
+		if werr := writeBundle(w, ci.outFormat, missing.sorted(), &ci.storeOptions); werr != nil && err == nil {
+			err = werr
 		}
-		err = process(ok, leaf, ints, missing)
-		if err != nil {
-			return err
+	}
+	if err == nil && len(ci.cas) > 1 && !jsonOut {
+		err = writeStoreMatrix(log.Writer(), ci.cas, results)
+	}
+	if err == nil && ci.contOnError {
+		if jsonOut {
+			err = rw.write(summary.record())
+		} else {
+			log.Println(summary)
 		}
 	}
+	// json output is only written on close, and the -out file may only fail
+	// to write on close, so neither can be left to a defer
+	if rw != nil {
+		err = firstErr(err, rw.close())
+	}
+	if out != nil {
+		err = firstErr(err, out.Close())
+	}
+	if err != nil {
+		return 1, err
+	}
+	return summary.worst.exitStatus(), nil
+}
 
-	for _, hp := range ci.hostports {
-		ok, leaf, ints, missing, err := checkAddr(hp, ci.ca)
-		if err != nil {
-			return err
+// firstErr returns err, or next if err is nil.  next is logged when it would
+// otherwise be lost.
+func firstErr(err, next error) error {
+	if err == nil {
+		return next
+	}
+	if next != nil {
+		log.Println(next)
+	}
+	return err
+}
+
+// check checks a single target within the configured timeout.
+func (ci *CheckIntermediateCmd) check(cv *chainVerifier, spec targetSpec) *checkResult {
+	started := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), ci.timeout)
+	defer cancel()
+	var (
+		res *checkResult
+		t   *hostTarget
+		err error
+	)
+	switch spec.kind {
+	case targetKindFile:
+		res, err = checkFile(ctx, spec.target, cv)
+	default:
+		t, err = ci.specTarget(spec)
+		if err == nil {
+			if ci.name != "" && spec.name == "" {
+				t.name = ci.name
+			}
+			res, err = checkAddr(ctx, t, cv)
 		}
-		err = process(ok, leaf, ints, missing)
-		if err != nil {
-			return err
+	}
+	if err != nil {
+		res = &checkResult{err: err}
+	}
+	if res.leaf != nil {
+		served := append([]*x509.Certificate{res.leaf}, res.intermediates...)
+		res.servedChain = checkServedChain(served, res.chains)
+	}
+	if res.leaf != nil {
+		res.key = ci.matchKey(spec, res.leaf)
+	}
+	if ci.ctLogs != nil && res.leaf != nil {
+		res.ct = checkCT(ci.ctLogs, res.leaf, res.leafIssuer(), res.tlsSCTs, res.ocspResponse, ci.at.time())
+	}
+	if ci.lint && res.leaf != nil {
+		chain := append([]*x509.Certificate{res.leaf}, res.intermediates...)
+		if len(res.chains) > 0 {
+			chain = res.chains[0]
 		}
+		res.lint = lintChain(chain, ci.lintOptions.rules())
 	}
-	return nil
+	if ci.enumerate && t != nil && res.err == nil {
+		res.enum = enumerate(ctx, t, ci.timeout)
+	}
+	if len(ci.cas) > 1 && res.leaf != nil {
+		res.stores = checkStores(ctx, cv, ci.cas, res)
+	}
+	if ci.sweep && len(res.chains) > 0 {
+		res.sweep = cv.sweep(ctx, append([]*x509.Certificate{res.leaf}, res.intermediates...), ci.at.time())
+	}
+	if len(ci.revocation) > 0 && len(res.chains) > 0 {
+		res.revocation = cv.checkRevocation(ctx, res.chains[0], ci.revocation)
+	}
+	res.target, res.kind, res.host, res.started = spec.target, spec.kind, t, started
+	res.tags = spec.tags
+	res.name = ci.name
+	if spec.name != "" {
+		res.name = spec.name
+	}
+	if t != nil {
+		res.name = t.name
+	}
+	res.duration = time.Since(started)
+	return res
+}
+
+// matchKey compares leaf with the -key file, or for -p targets with any
+// private key in the same file.  It returns nil when there's no key to match.
+func (ci *CheckIntermediateCmd) matchKey(spec targetSpec, leaf *x509.Certificate) *keyMatch {
+	path := ci.keyFile
+	if path == "" {
+		if spec.kind != targetKindFile {
+			return nil
+		}
+		path = spec.target
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return &keyMatch{source: path, leaf: leaf, err: fmt.Errorf("error reading key file %s: %w", path, err)}
+	}
+	if ci.keyFile == "" && len(privateKeyBlocks(raw)) == 0 {
+		return nil
+	}
+	return matchKey(raw, path, leaf, &ci.passphrase)
 }
 
 func (ci *CheckIntermediateCmd) Synopsis() string {
@@ -140,89 +461,160 @@ func (ci *CheckIntermediateCmd) Synopsis() string {
 		"dump any missing intermediates needed to correct the configuration."
 }
 
-func checkAddr(addr string, ca *x509.CertPool) (ok bool, leaf *x509.Certificate, intermediates []*x509.Certificate, missing []*x509.Certificate, err error) {
-	hostport := strings.Split(addr, ":")
-	if len(hostport) != 2 {
-		err = fmt.Errorf("invalid host:port specification: %s", addr)
-		return
-	}
-	var PeerCertificates []*x509.Certificate
-	var conn net.Conn
-
-	var innerError error
-	conn, err = tls.Dial("tcp", addr, &tls.Config{
-		ServerName:         hostport[0],
-		InsecureSkipVerify: true,
-		// Mamually verify certs, catch case where intermediates are missing
-		// and dowload them.
-		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
-			if len(rawCerts) == 0 {
-				return fmt.Errorf("no certificates returned from %s", addr)
-			}
-
-			PeerCertificates = make([]*x509.Certificate, 0, len(rawCerts))
-			for _, raw := range rawCerts {
-				cert, err := x509.ParseCertificate(raw)
-				if err != nil {
-					return fmt.Errorf("error parsing cert from %s: %s", addr, err)
-				}
-				PeerCertificates = append(PeerCertificates, cert)
-			}
+// checkResult is the outcome of checking a single -hp or -p target.
+type checkResult struct {
+	target string
+	kind   string
+	// tags are the target's tags from -targets
+	tags []string
+	// host is set for -hp targets
+	host          *hostTarget
+	ok            bool
+	leaf          *x509.Certificate
+	intermediates []*x509.Certificate
+	// fetched holds every certificate downloaded through AIA, and missing
+	// the subset of those that made it into a verified chain.
+	fetched  []*x509.Certificate
+	missing  []*x509.Certificate
+	chains   [][]*x509.Certificate
+	chainErr error
+	// name is the name the leaf is expected to be valid for, and nameErr is
+	// set when it isn't.  This is independent of ok, which only reflects the
+	// chain.
+	name    string
+	nameErr error
+	expiry  *expiryInfo
+	// revocation holds the revocation status of each certificate in the
+	// first verified chain, when asked for.
+	revocation []*revocationStatus
+	// staple describes the stapled OCSP response, for -hp targets.
+	staple *stapleInfo
+	// tlsSCTs and ocspResponse are the SCTs and OCSP response the server
+	// sent in the handshake, kept for the CT check.
+	tlsSCTs      [][]byte
+	ocspResponse []byte
+	ct           *ctInfo
+	enum         *enumInfo
+	// lint holds the lint findings for the first verified chain, or the
+	// served chain when none verified.
+	lint []*lintFinding
+	// servedChain labels each served certificate against the verified path.
+	servedChain *servedChainInfo
+	// stores holds the outcome against each -ca store, when there's more
+	// than one.
+	stores []*storeResult
+	sweep  *sweepInfo
+	// key is set when there was a private key to match against the leaf.
+	key *keyMatch
+	// err is set when the target couldn't be checked at all.  chainErr is
+	// set when the chain couldn't be verified.
+	err      error
+	started  time.Time
+	duration time.Duration
+}
 
-			_, missing, innerError = verifyChains(PeerCertificates, ca)
-			return nil
-		},
-	})
+// fatal returns the error, if any, that stops a run without -continue.
+// Chains that can't be completed for want of an AIA URL, or of a cached
+// intermediate when offline, are reported, but aren't fatal.
+func (res *checkResult) fatal() error {
+	if res.err != nil {
+		return res.err
+	}
+	if res.chainErr != nil && !errors.Is(res.chainErr, ErrNoIssuingCertURL) &&
+		!errors.Is(res.chainErr, ErrNotCached) {
+		return res.chainErr
+	}
+	return nil
+}
+
+func checkAddr(ctx context.Context, t *hostTarget, cv *chainVerifier) (*checkResult, error) {
+	state, err := fetchConnectionState(ctx, t)
 	if err != nil {
-		err = fmt.Errorf("error connecting to host %s: %w", addr, err)
-		return
+		return nil, fmt.Errorf("error connecting to host %s: %w", t, err)
 	}
-	conn.Close()
-	if innerError != nil {
-		if !errors.Is(innerError, ErrNoIssuingCertURL) {
-			err = innerError
-			return
-		}
-		ok = false
-	} else {
-		ok = len(missing) == 0
+	PeerCertificates := state.PeerCertificates
+	res := &checkResult{
+		leaf:          PeerCertificates[0],
+		intermediates: PeerCertificates[1:],
 	}
-	if len(PeerCertificates) > 0 {
-		leaf = PeerCertificates[0]
-		intermediates = PeerCertificates[1:]
+	res.chains, res.fetched, err = cv.verifyChains(ctx, PeerCertificates)
+	if err != nil {
+		res.chainErr = err
+		res.ok = false
+	} else {
+		res.missing = missingCerts(res.fetched, res.chains)
+		res.ok = len(res.missing) == 0
 	}
-	return ok, leaf, intermediates, missing, nil
+	res.staple = checkStaple(state.OCSPResponse, res.leaf, res.leafIssuer(), cv.time())
+	res.tlsSCTs, res.ocspResponse = state.SignedCertificateTimestamps, state.OCSPResponse
+	return res, nil
 }
 
-func checkFile(certfile string, ca *x509.CertPool) (ok bool, leafe *x509.Certificate, intermediates []*x509.Certificate, missing []*x509.Certificate, err error) {
+func checkFile(ctx context.Context, certfile string, cv *chainVerifier) (*checkResult, error) {
 	fbytes, err := os.ReadFile(certfile)
 	if err != nil {
-		err = fmt.Errorf("error reading file %s: %w", certfile, err)
-		return
+		return nil, fmt.Errorf("error reading file %s: %w", certfile, err)
 	}
 	certders := decodePemsByType(fbytes, "CERTIFICATE")
 	if len(certders) == 0 {
-		err = fmt.Errorf("no certificates found in passed bundle %s", certfile)
-		return
+		return nil, fmt.Errorf("no certificates found in passed bundle %s", certfile)
 	}
 	certs, err := x509.ParseCertificates(certders)
 	if err != nil {
-		err = fmt.Errorf("error parsing certificates for file %s: %w", certfile, err)
-		return
+		return nil, fmt.Errorf("error parsing certificates for file %s: %w", certfile, err)
 	}
 
 	if len(certs) == 0 {
-		err = fmt.Errorf("no proper ASN1 certificate data found in file %s", certfile)
-		return
+		return nil, fmt.Errorf("no proper ASN1 certificate data found in file %s", certfile)
 	}
 
-	_, missing, err = verifyChains(certs, ca)
-
+	res := &checkResult{
+		leaf:          certs[0],
+		intermediates: certs[1:],
+	}
+	res.chains, res.fetched, err = cv.verifyChains(ctx, certs)
 	if err != nil {
-		err = fmt.Errorf("error on verification of file %s: %w", certfile, err)
-		return
+		res.chainErr = fmt.Errorf("error on verification of file %s: %w", certfile, err)
+		return res, nil
 	}
+	res.missing = missingCerts(res.fetched, res.chains)
+	res.ok = len(res.missing) == 0
+	return res, nil
+}
 
-	ok = len(missing) == 0
-	return ok, certs[0], certs[1:], missing, nil
+// checkName verifies that leaf is valid for name, which can be a DNS name or
+// an IP address.  Wildcard SANs are matched the same way a browser would.  An
+// empty name is not checked.
+func checkName(leaf *x509.Certificate, name string) error {
+	if name == "" {
+		return nil
+	}
+	if err := leaf.VerifyHostname(name); err != nil {
+		names := certNames(leaf)
+		if len(names) == 0 {
+			return fmt.Errorf("name mismatch: %s has no subject alternative names, so is not valid for %s",
+				leaf.Subject.CommonName, name)
+		}
+		return fmt.Errorf("name mismatch: %s is not valid for %s, it is valid for: %s",
+			leaf.Subject.CommonName, name, strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// missingCerts returns the fetched certificates that appear in one of chains
+// below its anchor, which are the ones that should have been provided.
+func missingCerts(fetched []*x509.Certificate, chains [][]*x509.Certificate) []*x509.Certificate {
+	used := make(map[string]bool)
+	for _, chain := range chains {
+		for _, cert := range chain[:len(chain)-1] {
+			used[thumb(cert)] = true
+		}
+	}
+	var ret []*x509.Certificate
+	for _, cert := range fetched {
+		if used[thumb(cert)] {
+			ret = append(ret, cert)
+		}
+	}
+	return ret
 }
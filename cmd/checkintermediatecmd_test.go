@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCheckName(t *testing.T) {
+	ca := newTestCA(t, "Test Root", nil)
+	leaf := func(dnsNames []string, ips ...string) *x509.Certificate {
+		tmpl := &x509.Certificate{
+			Subject:  pkix.Name{CommonName: "leaf"},
+			DNSNames: dnsNames,
+		}
+		for _, ip := range ips {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, net.ParseIP(ip))
+		}
+		cert, _ := ca.issue(t, tmpl)
+		return cert
+	}
+	tests := []struct {
+		name string
+		leaf *x509.Certificate
+		host string
+		// wantErr is empty when host should match, otherwise what the error
+		// should contain
+		wantErr string
+	}{
+		{
+			name: "no name",
+			leaf: leaf([]string{"www.example.com"}),
+		},
+		{
+			name: "exact",
+			leaf: leaf([]string{"www.example.com"}),
+			host: "www.example.com",
+		},
+		{
+			name: "case insensitive",
+			leaf: leaf([]string{"www.example.com"}),
+			host: "WWW.Example.COM",
+		},
+		{
+			name:    "mismatch lists sans",
+			leaf:    leaf([]string{"www.example.com", "example.com"}),
+			host:    "mail.example.com",
+			wantErr: "it is valid for: www.example.com, example.com",
+		},
+		{
+			name:    "no sans",
+			leaf:    leaf(nil),
+			host:    "leaf",
+			wantErr: "has no subject alternative names",
+		},
+		{
+			name: "wildcard",
+			leaf: leaf([]string{"*.example.com"}),
+			host: "www.example.com",
+		},
+		{
+			name:    "wildcard only covers one label",
+			leaf:    leaf([]string{"*.example.com"}),
+			host:    "a.b.example.com",
+			wantErr: "not valid for a.b.example.com",
+		},
+		{
+			name:    "wildcard doesn't cover the bare domain",
+			leaf:    leaf([]string{"*.example.com"}),
+			host:    "example.com",
+			wantErr: "not valid for example.com",
+		},
+		{
+			name: "ipv4 san",
+			leaf: leaf(nil, "192.0.2.1"),
+			host: "192.0.2.1",
+		},
+		{
+			name: "ipv6 san",
+			leaf: leaf(nil, "2001:db8::1"),
+			host: "2001:db8::1",
+		},
+		{
+			name: "bracketed ipv6",
+			leaf: leaf(nil, "2001:db8::1"),
+			host: "[2001:db8::1]",
+		},
+		{
+			name:    "ip mismatch",
+			leaf:    leaf([]string{"www.example.com"}, "192.0.2.1"),
+			host:    "192.0.2.2",
+			wantErr: "it is valid for: www.example.com, 192.0.2.1",
+		},
+		{
+			name:    "ip doesn't match a dns san",
+			leaf:    leaf([]string{"192.0.2.1"}),
+			host:    "192.0.2.1",
+			wantErr: "not valid for 192.0.2.1",
+		},
+		{
+			name: "idn",
+			leaf: leaf([]string{"xn--bcher-kva.example"}),
+			host: "xn--bcher-kva.example",
+		},
+		{
+			name: "idn wildcard",
+			leaf: leaf([]string{"*.xn--bcher-kva.example"}),
+			host: "www.xn--bcher-kva.example",
+		},
+		{
+			name:    "idn mismatch",
+			leaf:    leaf([]string{"xn--bcher-kva.example"}),
+			host:    "xn--bcher-kva.test",
+			wantErr: "it is valid for: xn--bcher-kva.example",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkName(tt.leaf, tt.host)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, wanted one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,475 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+	casn1 "golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/ocsp"
+)
+
+// Where an SCT was delivered.
+const (
+	sctSourceEmbedded = "embedded"
+	sctSourceTLS      = "tls"
+	sctSourceOCSP     = "ocsp"
+)
+
+var (
+	// oidSCTList is the X.509 extension embedding SCTs in a certificate.
+	oidSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 2}
+	// oidOCSPSCTList is the OCSP single response extension carrying SCTs.
+	oidOCSPSCTList = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11129, 2, 4, 5}
+)
+
+// Log states from the log list, as they bear on the CT policy.
+const (
+	ctLogPending   = "pending"
+	ctLogQualified = "qualified"
+	ctLogUsable    = "usable"
+	ctLogReadOnly  = "readonly"
+	ctLogRetired   = "retired"
+	ctLogRejected  = "rejected"
+)
+
+// ctLog is a log from the log list.
+type ctLog struct {
+	description string
+	operator    string
+	key         crypto.PublicKey
+	state       string
+	// stateSince is when the log entered its current state.
+	stateSince time.Time
+}
+
+// approved reports whether the log is currently trusted for new SCTs.
+func (l *ctLog) approved() bool {
+	switch l.state {
+	case ctLogQualified, ctLogUsable, ctLogReadOnly:
+		return true
+	}
+	return false
+}
+
+// onceApproved reports whether an SCT issued at ts counts, which it does for
+// approved logs and for logs retired since.
+func (l *ctLog) onceApproved(ts time.Time) bool {
+	return l.approved() || (l.state == ctLogRetired && ts.Before(l.stateSince))
+}
+
+// ctLogList is the set of known logs, keyed by log ID.
+type ctLogList map[[sha256.Size]byte]*ctLog
+
+// loadCTLogList reads a log list in the format of Chrome's log_list.json.
+func loadCTLogList(path string) (ctLogList, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading CT log list %s: %w", path, err)
+	}
+	type logJSON struct {
+		Description string `json:"description"`
+		LogID       string `json:"log_id"`
+		Key         string `json:"key"`
+		State       map[string]struct {
+			Timestamp time.Time `json:"timestamp"`
+		} `json:"state"`
+	}
+	var list struct {
+		Operators []struct {
+			Name      string    `json:"name"`
+			Logs      []logJSON `json:"logs"`
+			TiledLogs []logJSON `json:"tiled_logs"`
+		} `json:"operators"`
+	}
+	if err = json.Unmarshal(raw, &list); err != nil {
+		return nil, fmt.Errorf("error parsing CT log list %s: %w", path, err)
+	}
+	logs := make(ctLogList)
+	for _, op := range list.Operators {
+		for _, lj := range append(op.Logs, op.TiledLogs...) {
+			der, err := base64.StdEncoding.DecodeString(lj.Key)
+			if err != nil {
+				return nil, fmt.Errorf("error decoding key for CT log %s: %w", lj.Description, err)
+			}
+			key, err := x509.ParsePKIXPublicKey(der)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing key for CT log %s: %w", lj.Description, err)
+			}
+			l := &ctLog{
+				description: lj.Description,
+				operator:    op.Name,
+				key:         key,
+				state:       ctLogPending,
+			}
+			for state, st := range lj.State {
+				l.state, l.stateSince = state, st.Timestamp
+			}
+			// the log ID is defined as the hash of the key
+			logs[sha256.Sum256(der)] = l
+		}
+	}
+	return logs, nil
+}
+
+// sct is a signed certificate timestamp, and the outcome of verifying it.
+type sct struct {
+	source    string
+	logID     [sha256.Size]byte
+	timestamp time.Time
+	// log is nil when the log isn't in the log list.
+	log *ctLog
+	err error
+
+	version    uint8
+	rawTS      uint64
+	extensions []byte
+	hashAlg    uint8
+	sigAlg     uint8
+	signature  []byte
+}
+
+func (s *sct) valid() bool {
+	return s.err == nil
+}
+
+func (s *sct) logName() string {
+	if s.log == nil {
+		return "unknown log " + s.logIDString()
+	}
+	return s.log.description
+}
+
+// logIDString is the log ID as it appears in log lists.
+func (s *sct) logIDString() string {
+	return base64.StdEncoding.EncodeToString(s.logID[:])
+}
+
+func (s *sct) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s SCT from %s", s.source, s.logName())
+	if s.log != nil {
+		fmt.Fprintf(&b, " (%s, %s)", s.log.operator, s.log.state)
+	}
+	fmt.Fprintf(&b, " at %s", s.timestamp.Format(time.RFC3339))
+	if s.err != nil {
+		fmt.Fprintf(&b, ": %s", s.err)
+	} else {
+		b.WriteString(": valid")
+	}
+	return b.String()
+}
+
+// parseSCT parses a single TLS encoded SCT.
+func parseSCT(raw []byte, source string) (*sct, error) {
+	s := &sct{source: source}
+	in := cryptobyte.String(raw)
+	var logID, ext, sig cryptobyte.String
+	if !in.ReadUint8(&s.version) || s.version != 0 {
+		return nil, fmt.Errorf("unsupported %s SCT version", source)
+	}
+	if !in.ReadBytes((*[]byte)(&logID), sha256.Size) ||
+		!in.ReadUint64(&s.rawTS) ||
+		!in.ReadUint16LengthPrefixed(&ext) ||
+		!in.ReadUint8(&s.hashAlg) ||
+		!in.ReadUint8(&s.sigAlg) ||
+		!in.ReadUint16LengthPrefixed(&sig) ||
+		!in.Empty() {
+		return nil, fmt.Errorf("malformed %s SCT", source)
+	}
+	copy(s.logID[:], logID)
+	s.extensions, s.signature = ext, sig
+	s.timestamp = time.UnixMilli(int64(s.rawTS)).UTC()
+	return s, nil
+}
+
+// parseSCTList splits a TLS encoded SignedCertificateTimestampList.
+func parseSCTList(raw []byte, source string) ([]*sct, error) {
+	in := cryptobyte.String(raw)
+	var list cryptobyte.String
+	if !in.ReadUint16LengthPrefixed(&list) || !in.Empty() {
+		return nil, fmt.Errorf("malformed %s SCT list", source)
+	}
+	var ret []*sct
+	for !list.Empty() {
+		var one cryptobyte.String
+		if !list.ReadUint16LengthPrefixed(&one) {
+			return nil, fmt.Errorf("malformed %s SCT list", source)
+		}
+		s, err := parseSCT(one, source)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, s)
+	}
+	return ret, nil
+}
+
+// extensionSCTs parses the SCT list carried in an X.509 or OCSP extension,
+// which wraps it in an OCTET STRING.
+func extensionSCTs(value []byte, source string) ([]*sct, error) {
+	var list []byte
+	if _, err := asn1.Unmarshal(value, &list); err != nil {
+		return nil, fmt.Errorf("malformed %s SCT extension: %w", source, err)
+	}
+	return parseSCTList(list, source)
+}
+
+// collectSCTs gathers the SCTs for leaf from wherever they were delivered:
+// embedded in the certificate, in the TLS handshake, or in the stapled OCSP
+// response.  Problems parsing any of them are returned alongside whatever
+// could be parsed.
+func collectSCTs(leaf *x509.Certificate, tlsSCTs [][]byte, stapled []byte) ([]*sct, []error) {
+	var (
+		scts []*sct
+		errs []error
+	)
+	for _, ext := range leaf.Extensions {
+		if ext.Id.Equal(oidSCTList) {
+			found, err := extensionSCTs(ext.Value, sctSourceEmbedded)
+			scts = append(scts, found...)
+			if err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	for _, raw := range tlsSCTs {
+		s, err := parseSCT(raw, sctSourceTLS)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		scts = append(scts, s)
+	}
+	if len(stapled) > 0 {
+		// Only the SCTs are wanted here, and their own signatures are what
+		// make them trustworthy, so the response signature isn't checked.
+		if resp, err := ocsp.ParseResponseForCert(stapled, leaf, nil); err == nil {
+			for _, ext := range resp.Extensions {
+				if ext.Id.Equal(oidOCSPSCTList) {
+					found, err := extensionSCTs(ext.Value, sctSourceOCSP)
+					scts = append(scts, found...)
+					if err != nil {
+						errs = append(errs, err)
+					}
+				}
+			}
+		}
+	}
+	return scts, errs
+}
+
+// verify checks the SCT's signature with its log's key.  issuer is needed
+// for embedded SCTs, which are issued for the precertificate.
+func (s *sct) verify(logs ctLogList, leaf, issuer *x509.Certificate, now time.Time) {
+	s.log = logs[s.logID]
+	if s.log == nil {
+		s.err = errors.New("log is not in the log list")
+		return
+	}
+	if s.timestamp.After(now) {
+		s.err = errors.New("timestamp is in the future")
+		return
+	}
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(s.version)
+	b.AddUint8(0) // certificate_timestamp
+	b.AddUint64(s.rawTS)
+	if s.source == sctSourceEmbedded {
+		if issuer == nil {
+			s.err = errors.New("no issuer to verify an embedded SCT with")
+			return
+		}
+		tbs, err := precertTBS(leaf.RawTBSCertificate)
+		if err != nil {
+			s.err = err
+			return
+		}
+		keyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+		b.AddUint16(1) // precert_entry
+		b.AddBytes(keyHash[:])
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(tbs) })
+	} else {
+		b.AddUint16(0) // x509_entry
+		b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(leaf.Raw) })
+	}
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(s.extensions) })
+	signed, err := b.Bytes()
+	if err != nil {
+		s.err = err
+		return
+	}
+
+	const hashSHA256, sigRSA, sigECDSA = 4, 1, 3
+	if s.hashAlg != hashSHA256 {
+		s.err = fmt.Errorf("unsupported SCT hash algorithm %d", s.hashAlg)
+		return
+	}
+	digest := sha256.Sum256(signed)
+	switch key := s.log.key.(type) {
+	case *ecdsa.PublicKey:
+		if s.sigAlg != sigECDSA || !ecdsa.VerifyASN1(key, digest[:], s.signature) {
+			s.err = errors.New("bad signature")
+		}
+	case *rsa.PublicKey:
+		if s.sigAlg != sigRSA || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], s.signature) != nil {
+			s.err = errors.New("bad signature")
+		}
+	default:
+		s.err = fmt.Errorf("unsupported log key type %T", key)
+	}
+}
+
+// precertTBS rebuilds the TBSCertificate a precertificate SCT was issued
+// for, which is the leaf's without the embedded SCT list.
+func precertTBS(raw []byte) ([]byte, error) {
+	errMalformed := errors.New("malformed TBSCertificate")
+	in := cryptobyte.String(raw)
+	var tbs cryptobyte.String
+	if !in.ReadASN1(&tbs, casn1.SEQUENCE) {
+		return nil, errMalformed
+	}
+	extsTag := casn1.Tag(3).Constructed().ContextSpecific()
+	b := cryptobyte.NewBuilder(nil)
+	b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+		for !tbs.Empty() {
+			var elem cryptobyte.String
+			var tag casn1.Tag
+			if !tbs.ReadAnyASN1Element(&elem, &tag) {
+				b.SetError(errMalformed)
+				return
+			}
+			if tag != extsTag {
+				b.AddBytes(elem)
+				continue
+			}
+			var wrapped, exts cryptobyte.String
+			if !elem.ReadASN1(&wrapped, extsTag) || !wrapped.ReadASN1(&exts, casn1.SEQUENCE) {
+				b.SetError(errMalformed)
+				return
+			}
+			b.AddASN1(extsTag, func(b *cryptobyte.Builder) {
+				b.AddASN1(casn1.SEQUENCE, func(b *cryptobyte.Builder) {
+					for !exts.Empty() {
+						var ext, body cryptobyte.String
+						var oid asn1.ObjectIdentifier
+						if !exts.ReadASN1Element(&ext, casn1.SEQUENCE) {
+							b.SetError(errMalformed)
+							return
+						}
+						body = ext
+						if !body.ReadASN1(&body, casn1.SEQUENCE) || !body.ReadASN1ObjectIdentifier(&oid) {
+							b.SetError(errMalformed)
+							return
+						}
+						if !oid.Equal(oidSCTList) {
+							b.AddBytes(ext)
+						}
+					}
+				})
+			})
+		}
+	})
+	return b.Bytes()
+}
+
+// ctInfo is the CT picture for a leaf.
+type ctInfo struct {
+	scts      []*sct
+	parseErrs []error
+	compliant bool
+	// reason explains the policy verdict.
+	reason string
+}
+
+func (ci *ctInfo) String() string {
+	var b strings.Builder
+	verdict := "meets"
+	if !ci.compliant {
+		verdict = "does not meet"
+	}
+	fmt.Fprintf(&b, "ct: %d SCTs, %s the Chrome/Apple CT policy: %s", len(ci.scts), verdict, ci.reason)
+	for _, s := range ci.scts {
+		fmt.Fprintf(&b, "\n  %s", s)
+	}
+	for _, err := range ci.parseErrs {
+		fmt.Fprintf(&b, "\n  %s", err)
+	}
+	return b.String()
+}
+
+// checkCT verifies the SCTs for leaf and applies the CT policy.
+func checkCT(logs ctLogList, leaf, issuer *x509.Certificate, tlsSCTs [][]byte, stapled []byte, now time.Time) *ctInfo {
+	ci := &ctInfo{}
+	ci.scts, ci.parseErrs = collectSCTs(leaf, tlsSCTs, stapled)
+	for _, s := range ci.scts {
+		s.verify(logs, leaf, issuer, now)
+	}
+	ci.compliant, ci.reason = ctPolicy(leaf, ci.scts)
+	return ci
+}
+
+// ctPolicy applies the CT policy Chrome and Apple share, which a leaf meets
+// either with embedded SCTs or with SCTs delivered over TLS or OCSP.
+//
+// Embedded SCTs must come from logs that are or were approved when the SCT
+// was issued, one per log, two for certificates valid for 180 days or less
+// and three otherwise, with at least one from a log approved now.  SCTs
+// delivered over TLS or OCSP need two, from logs approved now.  Either way
+// the logs must belong to at least two operators.
+func ctPolicy(leaf *x509.Certificate, scts []*sct) (bool, string) {
+	lifetime := leaf.NotAfter.Sub(leaf.NotBefore)
+	need := 3
+	if lifetime <= 180*24*time.Hour {
+		need = 2
+	}
+
+	type tally struct {
+		logs      map[[sha256.Size]byte]bool
+		operators map[string]bool
+		approved  bool
+	}
+	count := func(embedded bool) *tally {
+		t := &tally{logs: make(map[[sha256.Size]byte]bool), operators: make(map[string]bool)}
+		for _, s := range scts {
+			if !s.valid() || (s.source == sctSourceEmbedded) != embedded {
+				continue
+			}
+			if embedded && !s.log.onceApproved(s.timestamp) || !embedded && !s.log.approved() {
+				continue
+			}
+			t.logs[s.logID] = true
+			t.operators[s.log.operator] = true
+			t.approved = t.approved || s.log.approved()
+		}
+		return t
+	}
+
+	emb := count(true)
+	if len(emb.logs) >= need && len(emb.operators) >= 2 && emb.approved {
+		return true, fmt.Sprintf("%d embedded SCTs from %d operators, %d needed for a %d day certificate",
+			len(emb.logs), len(emb.operators), need, int(lifetime.Hours()/24))
+	}
+	del := count(false)
+	if len(del.logs) >= 2 && len(del.operators) >= 2 {
+		return true, fmt.Sprintf("%d SCTs delivered over TLS or OCSP from %d operators",
+			len(del.logs), len(del.operators))
+	}
+	if len(emb.logs) == 0 && len(del.logs) == 0 {
+		return false, "no valid SCTs from approved logs"
+	}
+	return false, fmt.Sprintf("%d embedded SCTs from %d operators where %d from 2 operators are needed "+
+		"for a %d day certificate, and %d delivered over TLS or OCSP where 2 from 2 operators are needed",
+		len(emb.logs), len(emb.operators), need, int(lifetime.Hours()/24), len(del.logs))
+}
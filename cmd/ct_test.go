@@ -0,0 +1,342 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// testLog is a CT log for tests, able to issue SCTs.
+type testLog struct {
+	key crypto.Signer
+	log *ctLog
+	id  [sha256.Size]byte
+}
+
+func newTestLog(t *testing.T, name, operator string, key crypto.Signer) *testLog {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testLog{
+		key: key,
+		log: &ctLog{description: name, operator: operator, key: key.Public(), state: ctLogUsable},
+		id:  sha256.Sum256(der),
+	}
+}
+
+// issue returns a TLS encoded SCT for entry, which is either a DER
+// certificate for an x509_entry, or the TBSCertificate of a precertificate
+// when issuer is set.
+func (l *testLog) issue(t *testing.T, ts time.Time, entry []byte, issuer *x509.Certificate) []byte {
+	t.Helper()
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint8(0) // v1
+	b.AddUint8(0) // certificate_timestamp
+	b.AddUint64(uint64(ts.UnixMilli()))
+	if issuer != nil {
+		keyHash := sha256.Sum256(issuer.RawSubjectPublicKeyInfo)
+		b.AddUint16(1) // precert_entry
+		b.AddBytes(keyHash[:])
+	} else {
+		b.AddUint16(0) // x509_entry
+	}
+	b.AddUint24LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(entry) })
+	b.AddUint16(0) // no extensions
+	digest := sha256.Sum256(b.BytesOrPanic())
+	sig, err := l.key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sigAlg := uint8(3) // ecdsa
+	if _, ok := l.key.(*rsa.PrivateKey); ok {
+		sigAlg = 1
+	}
+	b = cryptobyte.NewBuilder(nil)
+	b.AddUint8(0)
+	b.AddBytes(l.id[:])
+	b.AddUint64(uint64(ts.UnixMilli()))
+	b.AddUint16(0)
+	b.AddUint8(4) // sha256
+	b.AddUint8(sigAlg)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(sig) })
+	return b.BytesOrPanic()
+}
+
+// sctListExtension wraps scts in the X.509 SCT list extension.
+func sctListExtension(t *testing.T, scts ...[]byte) pkix.Extension {
+	t.Helper()
+	b := cryptobyte.NewBuilder(nil)
+	b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) {
+		for _, s := range scts {
+			b.AddUint16LengthPrefixed(func(b *cryptobyte.Builder) { b.AddBytes(s) })
+		}
+	})
+	value, err := asn1.Marshal(b.BytesOrPanic())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pkix.Extension{Id: oidSCTList, Value: value}
+}
+
+// ctFixture is a leaf with SCTs embedded the way a CA would: each SCT is
+// issued for the precertificate, then the leaf is signed with them added.
+type ctFixture struct {
+	issuer  *testCA
+	precert *x509.Certificate
+	leaf    *x509.Certificate
+	logs    []*testLog
+}
+
+func newCTFixture(t *testing.T, logs ...*testLog) *ctFixture {
+	t.Helper()
+	issuer := newTestCA(t, "Test Issuing CA", nil)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1000),
+		Subject:      pkix.Name{CommonName: "www.example.com"},
+		DNSNames:     []string{"www.example.com"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.AddDate(0, 0, 90),
+	}
+	create := func() *x509.Certificate {
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer.cert, key.Public(), issuer.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	// the precertificate stands in for the real one, which would carry the
+	// poison extension instead, as both are stripped before signing
+	precert := create()
+	var scts [][]byte
+	for _, l := range logs {
+		scts = append(scts, l.issue(t, now.Add(-time.Minute), precert.RawTBSCertificate, issuer.cert))
+	}
+	tmpl.ExtraExtensions = []pkix.Extension{sctListExtension(t, scts...)}
+	return &ctFixture{issuer: issuer, precert: precert, leaf: create(), logs: logs}
+}
+
+func (f *ctFixture) logList() ctLogList {
+	logs := make(ctLogList)
+	for _, l := range f.logs {
+		logs[l.id] = l.log
+	}
+	return logs
+}
+
+func TestParseSCT(t *testing.T) {
+	// a v1 SCT from log 0x01 0x02 ... 0x20 at 2024-01-02T03:04:05.678Z,
+	// with no extensions and a 4 byte ecdsa signature
+	raw := []byte{0x00}
+	for i := 1; i <= sha256.Size; i++ {
+		raw = append(raw, byte(i))
+	}
+	raw = append(raw, 0x00, 0x00, 0x01, 0x8c, 0xc8, 0x20, 0xdb, 0x2e) // 1704164645678 ms
+	raw = append(raw, 0x00, 0x00)                                     // extensions
+	raw = append(raw, 0x04, 0x03)                                     // sha256, ecdsa
+	raw = append(raw, 0x00, 0x04, 0xde, 0xad, 0xbe, 0xef)             // signature
+	s, err := parseSCT(raw, sctSourceTLS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2024, 1, 2, 3, 4, 5, 678e6, time.UTC); !s.timestamp.Equal(want) {
+		t.Errorf("got timestamp %s, wanted %s", s.timestamp, want)
+	}
+	if s.logID[0] != 1 || s.logID[sha256.Size-1] != sha256.Size {
+		t.Errorf("got log id %x", s.logID)
+	}
+	if s.hashAlg != 4 || s.sigAlg != 3 || !bytes.Equal(s.signature, []byte{0xde, 0xad, 0xbe, 0xef}) {
+		t.Errorf("got hash %d, signature %d %x", s.hashAlg, s.sigAlg, s.signature)
+	}
+
+	if _, err = parseSCT(append(raw, 0x00), sctSourceTLS); err == nil {
+		t.Error("parseSCT accepted trailing data")
+	}
+	if _, err = parseSCT(raw[:len(raw)-1], sctSourceTLS); err == nil {
+		t.Error("parseSCT accepted a truncated SCT")
+	}
+	v2 := append([]byte{0x01}, raw[1:]...)
+	if _, err = parseSCT(v2, sctSourceTLS); err == nil {
+		t.Error("parseSCT accepted a v2 SCT")
+	}
+}
+
+func TestPrecertTBS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newCTFixture(t, newTestLog(t, "Test Log", "Test Operator", ecKey))
+	got, err := precertTBS(f.leaf.RawTBSCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, f.precert.RawTBSCertificate) {
+		t.Error("precertTBS didn't strip the leaf back to the precertificate's TBSCertificate")
+	}
+	// without an SCT list there's nothing to strip
+	got, err = precertTBS(f.precert.RawTBSCertificate)
+	if err != nil || !bytes.Equal(got, f.precert.RawTBSCertificate) {
+		t.Errorf("precertTBS changed a TBSCertificate without SCTs, err %v", err)
+	}
+	if _, err = precertTBS([]byte{0x30, 0x03, 0x02}); err == nil {
+		t.Error("precertTBS accepted a truncated TBSCertificate")
+	}
+}
+
+func TestVerifySCT(t *testing.T) {
+	now := time.Now()
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknownKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecLog := newTestLog(t, "EC Log", "Operator A", ecKey)
+	rsaLog := newTestLog(t, "RSA Log", "Operator B", rsaKey)
+	unknownLog := newTestLog(t, "Unknown Log", "Operator C", unknownKey)
+	f := newCTFixture(t, ecLog, rsaLog)
+	other := newTestCA(t, "Other CA", nil)
+
+	embedded, errs := collectSCTs(f.leaf, nil, nil)
+	if len(errs) > 0 || len(embedded) != 2 {
+		t.Fatalf("got %d embedded SCTs and errors %v, wanted 2 and none", len(embedded), errs)
+	}
+	parse := func(raw []byte, source string) *sct {
+		s, err := parseSCT(raw, source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	tampered := ecLog.issue(t, now.Add(-time.Minute), f.leaf.Raw, nil)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name   string
+		sct    *sct
+		issuer *x509.Certificate
+		// wantErr is empty when the SCT should verify, otherwise what the
+		// error should contain
+		wantErr string
+	}{
+		{
+			name:   "embedded, ecdsa log",
+			sct:    embedded[0],
+			issuer: f.issuer.cert,
+		},
+		{
+			name:   "embedded, rsa log",
+			sct:    embedded[1],
+			issuer: f.issuer.cert,
+		},
+		{
+			name:    "embedded, wrong issuer",
+			sct:     embedded[0],
+			issuer:  other.cert,
+			wantErr: "bad signature",
+		},
+		{
+			name:    "embedded, no issuer",
+			sct:     embedded[0],
+			wantErr: "no issuer",
+		},
+		{
+			name: "tls",
+			sct:  parse(ecLog.issue(t, now.Add(-time.Minute), f.leaf.Raw, nil), sctSourceTLS),
+		},
+		{
+			name: "tls, rsa log",
+			sct:  parse(rsaLog.issue(t, now.Add(-time.Minute), f.leaf.Raw, nil), sctSourceTLS),
+		},
+		{
+			name:    "tls, for another certificate",
+			sct:     parse(ecLog.issue(t, now.Add(-time.Minute), f.precert.Raw, nil), sctSourceTLS),
+			wantErr: "bad signature",
+		},
+		{
+			name:    "tls, tampered signature",
+			sct:     parse(tampered, sctSourceTLS),
+			wantErr: "bad signature",
+		},
+		{
+			name:    "future timestamp",
+			sct:     parse(ecLog.issue(t, now.Add(time.Hour), f.leaf.Raw, nil), sctSourceTLS),
+			wantErr: "timestamp is in the future",
+		},
+		{
+			name:    "unknown log",
+			sct:     parse(unknownLog.issue(t, now.Add(-time.Minute), f.leaf.Raw, nil), sctSourceTLS),
+			wantErr: "log is not in the log list",
+		},
+	}
+
+	logs := f.logList()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := *tt.sct
+			s.err = nil
+			s.verify(logs, f.leaf, tt.issuer, now)
+			if tt.wantErr == "" {
+				if s.err != nil {
+					t.Fatalf("unexpected error: %v", s.err)
+				}
+				return
+			}
+			if s.err == nil || !strings.Contains(s.err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, wanted one containing %q", s.err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCheckCT(t *testing.T) {
+	var logs []*testLog
+	for _, op := range []string{"Operator A", "Operator B"} {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, newTestLog(t, op+" Log", op, key))
+	}
+	f := newCTFixture(t, logs...)
+	ci := checkCT(f.logList(), f.leaf, f.issuer.cert, nil, nil, time.Now())
+	if !ci.compliant {
+		t.Errorf("two embedded SCTs from two operators for a 90 day certificate didn't comply: %s", ci)
+	}
+	// one operator isn't enough
+	f.logs[1].log.operator = "Operator A"
+	ci = checkCT(f.logList(), f.leaf, f.issuer.cert, nil, nil, time.Now())
+	if ci.compliant {
+		t.Errorf("SCTs from a single operator complied: %s", ci)
+	}
+}
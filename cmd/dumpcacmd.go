@@ -2,12 +2,14 @@ package cmd
 
 import (
 	"encoding/csv"
-	"os"
 )
 
 type DumpCACmd struct {
 	*BaseCmd
-	csv bool
+	csv    bool
+	format string
+	out    string
+	storeOptions
 }
 
 func NewDumpCACmd() *DumpCACmd {
@@ -15,7 +17,11 @@ func NewDumpCACmd() *DumpCACmd {
 		BaseCmd: &BaseCmd{},
 	}
 	dca.Init("dumpca")
-	dca.f.BoolVar(&dca.csv, "csv", false, "output metadata as csv")
+	dca.f.BoolVar(&dca.csv, "csv", false, "output metadata as csv.  same as -format csv")
+	dca.f.StringVar(&dca.format, "format", formatPEM, "output `format`, one of pem, der, p7b, p12, jks, csv, "+
+		"json or ndjson")
+	dca.f.StringVar(&dca.out, "out", "-", "write to `path`.  use - for stdout")
+	dca.storeOptions.register(dca.f)
 	return dca
 }
 
@@ -28,33 +34,87 @@ func (dc *DumpCACmd) Run(args []string) int {
 	if err != nil {
 		return RunResultHelp
 	}
+	if dc.csv {
+		dc.format = formatCSV
+	}
+	if err = validateFormat(dc.format, append(bundleFormats, formatCSV, formatJSON, formatNDJSON)...); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = dc.storeOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
 	certs, err := SystemCertPool()
 	if err != nil {
 		log.Printf("error fetching system cert pool: %s", err)
 		return 1
 	}
+	w, err := openOutput(dc.out)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer w.Close()
+	// pem is written bare, one certificate after another, as it always was
+	if isBundleFormat(dc.format) && dc.format != formatPEM {
+		if err = writeBundle(w, dc.format, certEntries(certs), &dc.storeOptions); err != nil {
+			log.Printf("error writing %s: %s", dc.format, err)
+			return 1
+		}
+		if err = w.Close(); err != nil {
+			log.Printf("error writing %s: %s", dc.format, err)
+			return 1
+		}
+		return 0
+	}
 	var csvWriter *csv.Writer
-	if dc.csv {
-		csvWriter = csv.NewWriter(os.Stdout)
+	var rw *recordWriter
+	switch dc.format {
+	case formatJSON, formatNDJSON:
+		rw = newRecordWriter(w, dc.format)
+	case formatCSV:
+		csvWriter = csv.NewWriter(w)
 		err = writeCertCSVHeader(csvWriter)
 		if err != nil {
 			log.Printf("error writing csv: %s", err)
 			return 1
 		}
-		defer csvWriter.Flush()
 	}
 	for _, cert := range certs {
-		switch dc.csv {
-		case true:
+		switch dc.format {
+		case formatJSON, formatNDJSON:
+			err = rw.write(&certificateRecord{
+				SchemaVersion: jsonSchemaVersion,
+				Type:          "certificate",
+				certJSON:      newCertJSON(cert, true),
+			})
+		case formatCSV:
 			err = writeCertCSV(csvWriter, cert)
 		default:
-			err = writeCert(os.Stdout, cert)
+			err = writeCert(w, cert)
 		}
 		if err != nil {
-			log.Printf("error writing csv: %s", err)
+			log.Printf("error writing %s: %s", dc.format, err)
 			return 1
 		}
 	}
-
+	if csvWriter != nil {
+		csvWriter.Flush()
+		if err = csvWriter.Error(); err != nil {
+			log.Printf("error writing %s: %s", dc.format, err)
+			return 1
+		}
+	}
+	if rw != nil {
+		if err = rw.close(); err != nil {
+			log.Printf("error writing %s: %s", dc.format, err)
+			return 1
+		}
+	}
+	if err = w.Close(); err != nil {
+		log.Printf("error writing %s: %s", dc.format, err)
+		return 1
+	}
 	return 0
 }
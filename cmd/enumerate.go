@@ -0,0 +1,212 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// enumVersions are the protocol versions -enumerate probes, oldest first.
+var enumVersions = []uint16{tls.VersionTLS10, tls.VersionTLS11, tls.VersionTLS12, tls.VersionTLS13}
+
+// versionInfo is what a server accepts for one protocol version.
+type versionInfo struct {
+	version  uint16
+	accepted bool
+	// suites are the accepted cipher suites in the server's order of
+	// preference.  TLS 1.3 suites can't be offered one at a time, so for TLS
+	// 1.3 this is only the suite negotiated.
+	suites []uint16
+	// err is the first failure other than the server turning a handshake
+	// down, such as a timeout or a reset connection.  Whatever was probed
+	// after it is unreliable.
+	err error
+}
+
+func (vi *versionInfo) String() string {
+	switch {
+	case !vi.accepted && vi.err != nil:
+		return fmt.Sprintf("%s: unknown, %s", tls.VersionName(vi.version), vi.err)
+	case !vi.accepted:
+		return fmt.Sprintf("%s: not accepted", tls.VersionName(vi.version))
+	}
+	names := make([]string, 0, len(vi.suites))
+	for _, id := range vi.suites {
+		names = append(names, tls.CipherSuiteName(id))
+	}
+	if vi.err != nil {
+		return fmt.Sprintf("%s: %s, maybe more: %s", tls.VersionName(vi.version), strings.Join(names, ", "), vi.err)
+	}
+	return fmt.Sprintf("%s: %s", tls.VersionName(vi.version), strings.Join(names, ", "))
+}
+
+// isRejection reports whether a handshake failed because the server sent an
+// alert, which is how it turns down a version or suite.  Anything else, a
+// timeout, a reset or a failure to connect at all, says nothing about what
+// the server accepts.
+func isRejection(err error) bool {
+	var oe *net.OpError
+	return errors.As(err, &oe) && oe.Op == "remote error"
+}
+
+// chainVariant is one of the chains a server serves, with the negotiations
+// it was served for.
+type chainVariant struct {
+	certs []*x509.Certificate
+	// negotiated lists the version and cipher suite of each handshake that
+	// got this chain.
+	negotiated []string
+}
+
+func (cv *chainVariant) String() string {
+	leaf := cv.certs[0]
+	return fmt.Sprintf("%s leaf %s (%s, %d certificates): %s", leaf.PublicKeyAlgorithm, leaf.Subject.CommonName,
+		thumb(leaf), len(cv.certs), strings.Join(cv.negotiated, ", "))
+}
+
+// enumInfo is the protocol versions and cipher suites a server accepts, and
+// the chains it serves for them.
+type enumInfo struct {
+	versions []*versionInfo
+	chains   []*chainVariant
+}
+
+func (ei *enumInfo) String() string {
+	var b strings.Builder
+	b.WriteString("tls enumeration:")
+	for _, vi := range ei.versions {
+		fmt.Fprintf(&b, "\n  %s", vi)
+	}
+	if len(ei.chains) > 1 {
+		b.WriteString("\n  the served chain depends on what's negotiated:")
+		for _, cv := range ei.chains {
+			fmt.Fprintf(&b, "\n    %s", cv)
+		}
+	}
+	return b.String()
+}
+
+// enumerate probes t for every protocol version and cipher suite Go
+// supports, giving each handshake up to timeout and stopping altogether once
+// ctx is done.
+//
+// Below TLS 1.3 each suite is offered on its own to find the accepted set,
+// then the accepted set is offered whole, less the suite picked each time,
+// to find the server's order of preference.  Go always sends its own order
+// of preference however the suites are configured, so a server that follows
+// the client's order will show Go's.
+func enumerate(ctx context.Context, t *hostTarget, timeout time.Duration) *enumInfo {
+	ei := &enumInfo{}
+	var vi *versionInfo
+	try := func(cfg *tls.Config) *tls.ConnectionState {
+		if err := ctx.Err(); err != nil {
+			if vi.err == nil {
+				vi.err = fmt.Errorf("gave up probing: %w", err)
+			}
+			return nil
+		}
+		hctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+		state, err := handshake(hctx, t, cfg)
+		if err != nil {
+			if !isRejection(err) && vi.err == nil {
+				vi.err = err
+			}
+			return nil
+		}
+		ei.served(state)
+		return state
+	}
+
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	for _, v := range enumVersions {
+		vi = &versionInfo{version: v}
+		ei.versions = append(ei.versions, vi)
+		if v == tls.VersionTLS13 {
+			if state := try(&tls.Config{MinVersion: v, MaxVersion: v}); state != nil {
+				vi.accepted = true
+				vi.suites = []uint16{state.CipherSuite}
+			}
+			continue
+		}
+		var accepted []uint16
+		for _, cs := range suites {
+			if !supportsVersion(cs, v) {
+				continue
+			}
+			cfg := &tls.Config{MinVersion: v, MaxVersion: v, CipherSuites: []uint16{cs.ID}}
+			if try(cfg) != nil {
+				accepted = append(accepted, cs.ID)
+			}
+		}
+		vi.accepted = len(accepted) > 0
+		for len(accepted) > 0 {
+			state := try(&tls.Config{MinVersion: v, MaxVersion: v, CipherSuites: accepted})
+			rest := accepted
+			if state != nil {
+				rest = removeSuite(accepted, state.CipherSuite)
+			}
+			if len(rest) == len(accepted) {
+				// the server changed its mind, so keep the rest as found
+				vi.suites = append(vi.suites, accepted...)
+				break
+			}
+			vi.suites = append(vi.suites, state.CipherSuite)
+			accepted = rest
+		}
+	}
+	return ei
+}
+
+// served records the chain served for a handshake.
+func (ei *enumInfo) served(state *tls.ConnectionState) {
+	what := fmt.Sprintf("%s %s", tls.VersionName(state.Version), tls.CipherSuiteName(state.CipherSuite))
+	for _, cv := range ei.chains {
+		if sameCerts(cv.certs, state.PeerCertificates) {
+			for _, n := range cv.negotiated {
+				if n == what {
+					return
+				}
+			}
+			cv.negotiated = append(cv.negotiated, what)
+			return
+		}
+	}
+	ei.chains = append(ei.chains, &chainVariant{certs: state.PeerCertificates, negotiated: []string{what}})
+}
+
+func supportsVersion(cs *tls.CipherSuite, v uint16) bool {
+	for _, sv := range cs.SupportedVersions {
+		if sv == v {
+			return true
+		}
+	}
+	return false
+}
+
+func removeSuite(suites []uint16, id uint16) []uint16 {
+	ret := make([]uint16, 0, len(suites))
+	for _, s := range suites {
+		if s != id {
+			ret = append(ret, s)
+		}
+	}
+	return ret
+}
+
+func sameCerts(a, b []*x509.Certificate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// listen serves each connection to a new listener with serve until the test
+// ends, and returns a target for it.
+func listen(t *testing.T, serve func(conn net.Conn)) *hostTarget {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+	addr := ln.Addr().String()
+	host, port, _ := net.SplitHostPort(addr)
+	return &hostTarget{addr: addr, host: host, port: port, dialAddr: addr, serverName: "localhost", name: "localhost"}
+}
+
+func TestEnumerate(t *testing.T) {
+	ca := newTestCA(t, "Test CA", nil)
+	leaf, key := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "localhost"}, DNSNames: []string{"localhost"}})
+	suites := []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256}
+	cfg := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{leaf.Raw, ca.cert.Raw}, PrivateKey: key}},
+		MinVersion:   tls.VersionTLS12,
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: suites,
+	}
+	tlsServer := listen(t, func(conn net.Conn) {
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		tls.Server(conn, cfg).Handshake()
+	})
+	// hangs up on every handshake without an alert
+	hangup := listen(t, func(conn net.Conn) {})
+
+	t.Run("tls 1.2 only", func(t *testing.T) {
+		ei := enumerate(context.Background(), tlsServer, 5*time.Second)
+		if len(ei.versions) != len(enumVersions) {
+			t.Fatalf("got %d versions, wanted %d", len(ei.versions), len(enumVersions))
+		}
+		for _, vi := range ei.versions {
+			if vi.err != nil {
+				t.Fatalf("%s: %v", tls.VersionName(vi.version), vi.err)
+			}
+			if vi.version != tls.VersionTLS12 {
+				if vi.accepted {
+					t.Fatalf("%s", vi)
+				}
+				continue
+			}
+			got := append([]uint16(nil), vi.suites...)
+			want := append([]uint16(nil), suites...)
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			sort.Slice(want, func(i, j int) bool { return want[i] < want[j] })
+			if !vi.accepted || len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+				t.Fatalf("%s, wanted the two ECDSA suites", vi)
+			}
+		}
+		if len(ei.chains) != 1 || len(ei.chains[0].certs) != 2 {
+			t.Fatalf("got %d chains, wanted the one", len(ei.chains))
+		}
+	})
+
+	t.Run("hung up", func(t *testing.T) {
+		ei := enumerate(context.Background(), hangup, 5*time.Second)
+		for _, vi := range ei.versions {
+			if vi.accepted || vi.err == nil {
+				t.Fatalf("%s, wanted it unknown", vi)
+			}
+			if !strings.Contains(vi.String(), "unknown") {
+				t.Fatalf("%s, wanted it unknown", vi)
+			}
+		}
+	})
+
+	t.Run("out of time", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		started := time.Now()
+		ei := enumerate(ctx, tlsServer, 5*time.Second)
+		if time.Since(started) > time.Second {
+			t.Fatalf("enumerate took %s after its context was done", time.Since(started))
+		}
+		for _, vi := range ei.versions {
+			if vi.accepted || vi.err == nil || !strings.Contains(vi.err.Error(), "gave up probing") {
+				t.Fatalf("%s, wanted it given up on", vi)
+			}
+		}
+	})
+}
+
+func TestIsRejection(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "alert", err: &net.OpError{Op: "remote error", Err: tls.AlertError(40)}, want: true},
+		{name: "reset", err: &net.OpError{Op: "read", Err: &net.AddrError{Err: "connection reset"}}},
+		{name: "dial", err: &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", Name: "nowhere"}}},
+		{name: "timeout", err: context.DeadlineExceeded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRejection(tt.err); got != tt.want {
+				t.Fatalf("isRejection(%v) = %v, wanted %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
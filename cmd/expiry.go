@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+const (
+	roleLeaf         = "leaf"
+	roleIntermediate = "intermediate"
+	roleRoot         = "root"
+)
+
+// Exit statuses for check when an expiry threshold is crossed.
+const (
+	ExitExpiryWarning  = 2
+	ExitExpiryCritical = 3
+)
+
+type expiryStatus int
+
+const (
+	expiryOK expiryStatus = iota
+	expiryWarning
+	expiryCritical
+)
+
+func (es expiryStatus) String() string {
+	switch es {
+	case expiryWarning:
+		return "WARNING"
+	case expiryCritical:
+		return "CRITICAL"
+	default:
+		return "OK"
+	}
+}
+
+// expiryInfo describes the certificate in a chain that expires soonest.
+type expiryInfo struct {
+	cert      *x509.Certificate
+	role      string
+	remaining time.Duration
+	status    expiryStatus
+}
+
+func (ei *expiryInfo) String() string {
+	return fmt.Sprintf("expiry %s: soonest to expire is the %s %s on %s (%d days)",
+		ei.status, ei.role, ei.cert.Subject.CommonName,
+		ei.cert.NotAfter.Format(time.DateOnly), int(ei.remaining.Hours()/24))
+}
+
+// chainRole returns the role of the certificate at position i of a chain
+// ordered from leaf to root.
+func chainRole(chain []*x509.Certificate, i int) string {
+	switch {
+	case i == 0:
+		return roleLeaf
+	case bytes.Equal(chain[i].RawIssuer, chain[i].RawSubject):
+		return roleRoot
+	default:
+		return roleIntermediate
+	}
+}
+
+// soonestExpiry finds the certificate across all chains that expires first,
+// and rates it against the warning and critical horizons.  A zero horizon
+// disables that threshold.
+func soonestExpiry(chains [][]*x509.Certificate, now time.Time, warn, crit time.Duration) *expiryInfo {
+	var ei *expiryInfo
+	for _, chain := range chains {
+		for i, cert := range chain {
+			if ei != nil && !cert.NotAfter.Before(ei.cert.NotAfter) {
+				continue
+			}
+			ei = &expiryInfo{
+				cert: cert,
+				role: chainRole(chain, i),
+			}
+		}
+	}
+	if ei == nil {
+		return nil
+	}
+	ei.remaining = ei.cert.NotAfter.Sub(now)
+	switch {
+	case crit > 0 && ei.remaining < crit:
+		ei.status = expiryCritical
+	case warn > 0 && ei.remaining < warn:
+		ei.status = expiryWarning
+	}
+	return ei
+}
@@ -17,6 +17,8 @@ type FetchCACmd struct {
 	outputFile string
 	verify     bool
 	csv        bool
+	format     string
+	storeOptions
 	BaseCmd
 }
 
@@ -27,7 +29,10 @@ func NewFetchCACmd() *FetchCACmd {
 	fca.f.StringVar(&fca.URL, "url", "https://curl.se/ca/cacert.pem", "url to remote CA bundle "+
 		"(required) - please do not abuse curl.se")
 	fca.f.BoolVar(&fca.verify, "verify", true, "verify downloaded certificate bundle")
-	fca.f.BoolVar(&fca.csv, "csv", false, "output metadata as csv")
+	fca.f.BoolVar(&fca.csv, "csv", false, "output metadata as csv.  same as -format csv")
+	fca.f.StringVar(&fca.format, "format", formatPEM, "output `format`, one of pem, der, p7b, p12, jks or csv.  "+
+		"pem is written as downloaded")
+	fca.storeOptions.register(fca.f)
 	return fca
 }
 
@@ -36,6 +41,17 @@ func (fca *FetchCACmd) Run(args []string) int {
 	if err != nil || len(fca.URL) == 0 || len(fca.outputFile) == 0 {
 		return RunResultHelp
 	}
+	if fca.csv {
+		fca.format = formatCSV
+	}
+	if err = validateFormat(fca.format, append(bundleFormats, formatCSV)...); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = fca.storeOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
 
 	err = fca.run()
 	if err != nil {
@@ -47,18 +63,11 @@ func (fca *FetchCACmd) Run(args []string) int {
 }
 
 func (fca *FetchCACmd) run() error {
-	var w io.Writer
-	switch fca.outputFile {
-	case "-":
-		w = os.Stdout
-	default:
-		f, err := os.OpenFile(fca.outputFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-		if err != nil {
-			return fmt.Errorf("unable to open file %s for writing: %w", fca.outputFile, err)
-		}
-		defer f.Close()
-		w = f
+	w, err := openOutput(fca.outputFile)
+	if err != nil {
+		return err
 	}
+	defer w.Close()
 	req, err := http.NewRequest(http.MethodGet, fca.URL, nil)
 	if err != nil {
 		return fmt.Errorf("error creating http request: %w", err)
@@ -93,7 +102,9 @@ func (fca *FetchCACmd) run() error {
 	}
 	var r io.Reader = resp.Body
 	var certs []*x509.Certificate
-	if fca.verify || fca.csv {
+	// everything but pem is written from the parsed certificates
+	parse := fca.format != formatPEM
+	if fca.verify || parse {
 		tf, err := ioutil.TempFile(os.TempDir(), "fetchca-")
 		if err != nil {
 			return fmt.Errorf("could not create temporary file: %w", err)
@@ -113,10 +124,12 @@ func (fca *FetchCACmd) run() error {
 		if err != nil {
 			return fmt.Errorf("failed validation of downloaded bundle: %w", err)
 		}
-		log.Printf("verified %d certificates in bundle downloaded from %s", len(certs), fca.URL)
+		if fca.verify {
+			log.Printf("verified %d certificates in bundle downloaded from %s", len(certs), fca.URL)
+		}
 
 		// reopen the temp file for reading for the copy below.
-		if !fca.csv {
+		if !parse {
 			f, err := os.Open(tf.Name())
 			if err != nil {
 				return fmt.Errorf("unable to reopen temp file: %w", err)
@@ -125,21 +138,24 @@ func (fca *FetchCACmd) run() error {
 			r = f
 		}
 	}
-	if fca.csv {
+	switch fca.format {
+	case formatCSV:
 		cWriter := csv.NewWriter(w)
 		writeCertCSVHeader(cWriter)
 		for _, cert := range certs {
 			writeCertCSV(cWriter, cert)
 		}
 		cWriter.Flush()
-
-	} else {
-		_, err = io.Copy(w, r)
-	}
-	if err != nil {
-		return fmt.Errorf("error copying payload: %w", err)
+	case formatPEM:
+		if _, err = io.Copy(w, r); err != nil {
+			return fmt.Errorf("error copying payload: %w", err)
+		}
+	default:
+		if err = writeBundle(w, fca.format, certEntries(certs), &fca.storeOptions); err != nil {
+			return fmt.Errorf("error writing bundle: %w", err)
+		}
 	}
-	return nil
+	return w.Close()
 }
 
 func (fca *FetchCACmd) Synopsis() string {
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// Labels for each certificate a server sends, relative to the verified path.
+const (
+	servedInPath          = "in-path"
+	servedMisordered      = "misordered"
+	servedDuplicate       = "duplicate"
+	servedSuperfluousRoot = "superfluous root"
+	servedUnrelated       = "unrelated"
+)
+
+// servedChainInfo compares the certificates as served with the verified path
+// they should have formed.  Strict clients, Java and many embedded stacks
+// among them, fail on chains that browsers put up with.
+type servedChainInfo struct {
+	served []*x509.Certificate
+	// labels holds one label for each of served.
+	labels []string
+	// suggested is the order the chain should be served in: the path from
+	// the leaf up to, but not including, the root.
+	suggested []*x509.Certificate
+}
+
+// ok is true when every served certificate is where it belongs.
+func (sc *servedChainInfo) ok() bool {
+	for _, l := range sc.labels {
+		if l != servedInPath {
+			return false
+		}
+	}
+	return true
+}
+
+func (sc *servedChainInfo) String() string {
+	var b strings.Builder
+	b.WriteString("served chain:")
+	for i, cert := range sc.served {
+		fmt.Fprintf(&b, "\n  %d %s: %s", i, sc.labels[i], cert.Subject.CommonName)
+	}
+	names := make([]string, 0, len(sc.suggested))
+	for _, cert := range sc.suggested {
+		names = append(names, cert.Subject.CommonName)
+	}
+	fmt.Fprintf(&b, "\nsuggested order: %s", strings.Join(names, ", "))
+	return b.String()
+}
+
+// checkServedChain labels each of served against the verified chain that
+// covers most of it.  It returns nil when nothing verified.
+func checkServedChain(served []*x509.Certificate, chains [][]*x509.Certificate) *servedChainInfo {
+	path := bestPath(served, chains)
+	if path == nil {
+		return nil
+	}
+	anchor := path[len(path)-1]
+	sc := &servedChainInfo{
+		served:    served,
+		labels:    make([]string, len(served)),
+		suggested: path[:len(path)-1],
+	}
+	if len(path) == 1 {
+		// the leaf is itself trusted
+		sc.suggested = path
+	}
+
+	// expected is the suggested order, less anything that wasn't served.
+	// Intermediates the server left out are reported as missing elsewhere.
+	var expected []*x509.Certificate
+	for _, cert := range sc.suggested {
+		if certIndex(served, cert) >= 0 {
+			expected = append(expected, cert)
+		}
+	}
+	next := 0
+	for i, cert := range served {
+		switch {
+		case certIndex(served[:i], cert) >= 0:
+			sc.labels[i] = servedDuplicate
+		case i > 0 && (cert.Equal(anchor) || isAnchor(cert, chains)):
+			sc.labels[i] = servedSuperfluousRoot
+		case certIndex(sc.suggested, cert) < 0:
+			sc.labels[i] = servedUnrelated
+		case next < len(expected) && cert.Equal(expected[next]):
+			sc.labels[i] = servedInPath
+			next++
+		default:
+			sc.labels[i] = servedMisordered
+		}
+	}
+	return sc
+}
+
+// bestPath picks the chain that the most served certificates belong to, so
+// that a server sending a cross-signed path is judged against that path.
+func bestPath(served []*x509.Certificate, chains [][]*x509.Certificate) []*x509.Certificate {
+	var best []*x509.Certificate
+	bestScore := -1
+	for _, chain := range chains {
+		score := 0
+		for _, cert := range chain {
+			if certIndex(served, cert) >= 0 {
+				score++
+			}
+		}
+		if score > bestScore {
+			best, bestScore = chain, score
+		}
+	}
+	return best
+}
+
+// isAnchor reports whether cert is self-signed and anchors one of chains.
+func isAnchor(cert *x509.Certificate, chains [][]*x509.Certificate) bool {
+	if !bytes.Equal(cert.RawSubject, cert.RawIssuer) {
+		return false
+	}
+	for _, chain := range chains {
+		if chain[len(chain)-1].Equal(cert) {
+			return true
+		}
+	}
+	return false
+}
+
+func certIndex(certs []*x509.Certificate, cert *x509.Certificate) int {
+	for i, c := range certs {
+		if c.Equal(cert) {
+			return i
+		}
+	}
+	return -1
+}
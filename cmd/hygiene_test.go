@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"strings"
+	"testing"
+)
+
+func TestCheckServedChain(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	upper := newTestCA(t, "Upper Intermediate", root)
+	lower := newTestCA(t, "Lower Intermediate", upper)
+	leaf, _ := lower.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+	other := newTestCA(t, "Other Intermediate", root)
+	chains := [][]*x509.Certificate{{leaf, lower.cert, upper.cert, root.cert}}
+
+	tests := []struct {
+		name   string
+		served []*x509.Certificate
+		labels []string
+	}{
+		{
+			name:   "in order",
+			served: []*x509.Certificate{leaf, lower.cert, upper.cert},
+			labels: []string{servedInPath, servedInPath, servedInPath},
+		},
+		{
+			name:   "out of order",
+			served: []*x509.Certificate{leaf, upper.cert, lower.cert},
+			labels: []string{servedInPath, servedMisordered, servedInPath},
+		},
+		{
+			name:   "leaf last",
+			served: []*x509.Certificate{lower.cert, upper.cert, leaf},
+			labels: []string{servedMisordered, servedMisordered, servedInPath},
+		},
+		{
+			// missing intermediates are reported by the AIA check, not here
+			name:   "missing intermediate",
+			served: []*x509.Certificate{leaf, upper.cert},
+			labels: []string{servedInPath, servedInPath},
+		},
+		{
+			name:   "leaf only",
+			served: []*x509.Certificate{leaf},
+			labels: []string{servedInPath},
+		},
+		{
+			name:   "with the root",
+			served: []*x509.Certificate{leaf, lower.cert, upper.cert, root.cert},
+			labels: []string{servedInPath, servedInPath, servedInPath, servedSuperfluousRoot},
+		},
+		{
+			name:   "unrelated intermediate",
+			served: []*x509.Certificate{leaf, other.cert, lower.cert, upper.cert},
+			labels: []string{servedInPath, servedUnrelated, servedInPath, servedInPath},
+		},
+		{
+			name:   "duplicate intermediate",
+			served: []*x509.Certificate{leaf, lower.cert, lower.cert, upper.cert},
+			labels: []string{servedInPath, servedInPath, servedDuplicate, servedInPath},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := checkServedChain(tt.served, chains)
+			if sc == nil {
+				t.Fatal("got nil for a chain that verified")
+			}
+			if strings.Join(sc.labels, ", ") != strings.Join(tt.labels, ", ") {
+				t.Fatalf("got %q, wanted %q", sc.labels, tt.labels)
+			}
+			wantOK := true
+			for _, l := range tt.labels {
+				wantOK = wantOK && l == servedInPath
+			}
+			if sc.ok() != wantOK {
+				t.Fatalf("ok() = %v, wanted %v", sc.ok(), wantOK)
+			}
+			// whatever was served, the suggestion is the whole path less the root
+			if got := certNamesList(sc.suggested); got != certNamesList(chains[0][:3]) {
+				t.Fatalf("suggested %s, wanted %s", got, certNamesList(chains[0][:3]))
+			}
+		})
+	}
+
+	if sc := checkServedChain([]*x509.Certificate{leaf}, nil); sc != nil {
+		t.Fatalf("got %s with nothing verified, wanted nil", sc)
+	}
+}
+
+func TestCheckServedChainCrossSigned(t *testing.T) {
+	oldRoot := newTestCA(t, "Old Root", nil)
+	newRoot := newTestCA(t, "New Root", nil)
+	intermediate := newTestCA(t, "Intermediate", newRoot)
+	leaf, _ := intermediate.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+	// the new root, cross-signed by the old one for clients that lack it
+	crossed := crossSign(t, newRoot, oldRoot)
+	chains := [][]*x509.Certificate{
+		{leaf, intermediate.cert, newRoot.cert},
+		{leaf, intermediate.cert, crossed, oldRoot.cert},
+	}
+
+	tests := []struct {
+		name      string
+		served    []*x509.Certificate
+		labels    []string
+		suggested []*x509.Certificate
+	}{
+		{
+			name:      "short path",
+			served:    []*x509.Certificate{leaf, intermediate.cert},
+			labels:    []string{servedInPath, servedInPath},
+			suggested: []*x509.Certificate{leaf, intermediate.cert},
+		},
+		{
+			name:      "cross-signed path",
+			served:    []*x509.Certificate{leaf, intermediate.cert, crossed},
+			labels:    []string{servedInPath, servedInPath, servedInPath},
+			suggested: []*x509.Certificate{leaf, intermediate.cert, crossed},
+		},
+		{
+			name:      "cross-signed path out of order",
+			served:    []*x509.Certificate{leaf, crossed, intermediate.cert},
+			labels:    []string{servedInPath, servedMisordered, servedInPath},
+			suggested: []*x509.Certificate{leaf, intermediate.cert, crossed},
+		},
+		{
+			name:      "short path with its root",
+			served:    []*x509.Certificate{leaf, intermediate.cert, newRoot.cert},
+			labels:    []string{servedInPath, servedInPath, servedSuperfluousRoot},
+			suggested: []*x509.Certificate{leaf, intermediate.cert},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := checkServedChain(tt.served, chains)
+			if strings.Join(sc.labels, ", ") != strings.Join(tt.labels, ", ") {
+				t.Fatalf("got %q, wanted %q", sc.labels, tt.labels)
+			}
+			if got := certNamesList(sc.suggested); got != certNamesList(tt.suggested) {
+				t.Fatalf("suggested %s, wanted %s", got, certNamesList(tt.suggested))
+			}
+		})
+	}
+}
@@ -0,0 +1,262 @@
+package cmd
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+// lintSeverity says whether a lint finding fails a check or only warns.
+type lintSeverity int
+
+const (
+	lintWarning lintSeverity = iota
+	lintError
+)
+
+func (ls lintSeverity) String() string {
+	if ls == lintError {
+		return "error"
+	}
+	return "warning"
+}
+
+// lintRule is a check for a problem that chain verification lets through,
+// mostly taken from the CA/Browser Forum baseline requirements.
+type lintRule struct {
+	id       string
+	severity lintSeverity
+	// roles are the chain roles the rule applies to, or all of them if nil.
+	roles []string
+	// check returns what's wrong with cert, or "" if nothing is.
+	check func(cert *x509.Certificate) string
+}
+
+func (lr *lintRule) appliesTo(role string) bool {
+	if lr.roles == nil {
+		return true
+	}
+	for _, r := range lr.roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+var oidBasicConstraints = asn1.ObjectIdentifier{2, 5, 29, 19}
+
+// maxLeafValidity is the longest a leaf may be valid for, inclusive of both
+// ends, under the baseline requirements.
+const maxLeafValidity = 398 * 24 * time.Hour
+
+// lintRules are every rule, in the order findings are reported.
+var lintRules = []*lintRule{
+	{
+		id:       "sha1-signature",
+		severity: lintError,
+		roles:    []string{roleLeaf, roleIntermediate},
+		check: func(cert *x509.Certificate) string {
+			switch cert.SignatureAlgorithm {
+			case x509.SHA1WithRSA, x509.ECDSAWithSHA1, x509.DSAWithSHA1:
+				return fmt.Sprintf("signed with %s", cert.SignatureAlgorithm)
+			}
+			return ""
+		},
+	},
+	{
+		id:       "rsa-key-size",
+		severity: lintError,
+		check: func(cert *x509.Certificate) string {
+			if key, ok := cert.PublicKey.(*rsa.PublicKey); ok && key.N.BitLen() < 2048 {
+				return fmt.Sprintf("%d bit RSA key, at least 2048 bits are needed", key.N.BitLen())
+			}
+			return ""
+		},
+	},
+	{
+		id:       "leaf-validity",
+		severity: lintError,
+		roles:    []string{roleLeaf},
+		check: func(cert *x509.Certificate) string {
+			if validity := cert.NotAfter.Sub(cert.NotBefore) + time.Second; validity > maxLeafValidity {
+				return fmt.Sprintf("valid for %d days, at most 398 are allowed", int(validity.Hours()/24))
+			}
+			return ""
+		},
+	},
+	{
+		id:       "missing-san",
+		severity: lintError,
+		roles:    []string{roleLeaf},
+		check: func(cert *x509.Certificate) string {
+			if len(certNames(cert)) == 0 {
+				return "no DNS or IP subject alternative names"
+			}
+			return ""
+		},
+	},
+	{
+		id:       "cn-not-in-san",
+		severity: lintError,
+		roles:    []string{roleLeaf},
+		check: func(cert *x509.Certificate) string {
+			cn := cert.Subject.CommonName
+			if cn == "" || len(certNames(cert)) == 0 {
+				return ""
+			}
+			ip := net.ParseIP(cn)
+			for _, name := range cert.DNSNames {
+				if ip == nil && strings.EqualFold(name, cn) {
+					return ""
+				}
+			}
+			for _, addr := range cert.IPAddresses {
+				if ip != nil && addr.Equal(ip) {
+					return ""
+				}
+			}
+			return fmt.Sprintf("common name %s is not among its subject alternative names", cn)
+		},
+	},
+	{
+		id:       "ca-basic-constraints-not-critical",
+		severity: lintError,
+		roles:    []string{roleIntermediate, roleRoot},
+		check: func(cert *x509.Certificate) string {
+			for _, ext := range cert.Extensions {
+				if ext.Id.Equal(oidBasicConstraints) && !ext.Critical {
+					return "basic constraints extension is not marked critical"
+				}
+			}
+			return ""
+		},
+	},
+	{
+		id:       "missing-aki",
+		severity: lintWarning,
+		roles:    []string{roleLeaf, roleIntermediate},
+		check: func(cert *x509.Certificate) string {
+			if len(cert.AuthorityKeyId) == 0 {
+				return "no authority key identifier"
+			}
+			return ""
+		},
+	},
+	{
+		id:       "missing-ski",
+		severity: lintWarning,
+		roles:    []string{roleIntermediate, roleRoot},
+		check: func(cert *x509.Certificate) string {
+			if len(cert.SubjectKeyId) == 0 {
+				return "no subject key identifier"
+			}
+			return ""
+		},
+	},
+}
+
+func lintRuleIDs() []string {
+	ids := make([]string, 0, len(lintRules))
+	for _, lr := range lintRules {
+		ids = append(ids, lr.id)
+	}
+	return ids
+}
+
+// lintOptions holds the flags that pick which rules run.
+type lintOptions struct {
+	enable  stringparams
+	disable stringparams
+}
+
+func (lo *lintOptions) register(f *flag.FlagSet) {
+	f.Var(&lo.enable, "lint-enable", "only run the lint rules with these comma separated `ids`. rules are: "+
+		strings.Join(lintRuleIDs(), ", "))
+	f.Var(&lo.disable, "lint-disable", "skip the lint rules with these comma separated `ids`")
+}
+
+func (lo *lintOptions) validate() error {
+	for _, id := range append(append([]string{}, lo.enable...), lo.disable...) {
+		if lintRuleByID(id) == nil {
+			return fmt.Errorf("unknown lint rule %q, must be one of: %s", id, strings.Join(lintRuleIDs(), ", "))
+		}
+	}
+	return nil
+}
+
+// rules returns the rules to run.
+func (lo *lintOptions) rules() []*lintRule {
+	var ret []*lintRule
+	for _, lr := range lintRules {
+		if (len(lo.enable) == 0 || containsString(lo.enable, lr.id)) && !containsString(lo.disable, lr.id) {
+			ret = append(ret, lr)
+		}
+	}
+	return ret
+}
+
+func lintRuleByID(id string) *lintRule {
+	for _, lr := range lintRules {
+		if lr.id == id {
+			return lr
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// lintFinding is a rule that a certificate broke.
+type lintFinding struct {
+	rule    *lintRule
+	role    string
+	cert    *x509.Certificate
+	message string
+}
+
+func (lf *lintFinding) String() string {
+	return fmt.Sprintf("lint %s %s: the %s %s: %s", lf.rule.severity, lf.rule.id, lf.role,
+		lf.cert.Subject.CommonName, lf.message)
+}
+
+// lintChain runs rules over each certificate in chain, which starts with the
+// leaf.
+func lintChain(chain []*x509.Certificate, rules []*lintRule) []*lintFinding {
+	var ret []*lintFinding
+	for i, cert := range chain {
+		role := chainRole(chain, i)
+		for _, lr := range rules {
+			if !lr.appliesTo(role) {
+				continue
+			}
+			if msg := lr.check(cert); msg != "" {
+				ret = append(ret, &lintFinding{rule: lr, role: role, cert: cert, message: msg})
+			}
+		}
+	}
+	return ret
+}
+
+// lintErrors counts the findings that are errors.
+func lintErrors(findings []*lintFinding) int {
+	n := 0
+	for _, lf := range findings {
+		if lf.rule.severity == lintError {
+			n++
+		}
+	}
+	return n
+}
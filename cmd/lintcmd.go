@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"context"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+type LintCmd struct {
+	hostports   stringparams
+	files       globparams
+	format      string
+	contOnError bool
+	concurrency int
+	lintOptions
+	dialOptions
+	*BaseCmd
+}
+
+func NewLintCmd() *LintCmd {
+	lc := &LintCmd{
+		BaseCmd: &BaseCmd{},
+	}
+	lc.BaseCmd.Init("lint")
+	lc.f.Var(&lc.hostports, "hp", "lint the chain served by `host:port`")
+	lc.f.Var(&lc.files, "p", "search `pathspec` for certificate files to lint")
+	lc.f.StringVar(&lc.format, "format", formatText, "output `format`, one of text, json or ndjson")
+	lc.f.BoolVar(&lc.contOnError, "continue", false, "continue past targets that can't be read or reached")
+	lc.f.IntVar(&lc.concurrency, "concurrency", 1, "lint up to `N` targets at once")
+	lc.lintOptions.register(lc.f)
+	lc.dialOptions.register(lc.f)
+	return lc
+}
+
+func (lc *LintCmd) Synopsis() string {
+	return "Lint the chain served by a site or in a pem file for problems verification lets through"
+}
+
+// Run lints every target, exiting with ExitLintErrors if any rule with error
+// severity was broken.  Warnings are reported but don't affect the status.
+func (lc *LintCmd) Run(args []string) int {
+	err := lc.f.Parse(args)
+	if err != nil || (len(lc.files) == 0 && len(lc.hostports) == 0) {
+		return RunResultHelp
+	}
+	if err = lc.dialOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validateFormat(lc.format, formatText, formatJSON, formatNDJSON); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = lc.lintOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+
+	var rw *recordWriter
+	if isJSONFormat(lc.format) {
+		rw = newRecordWriter(os.Stdout, lc.format)
+	}
+	rules := lc.lintOptions.rules()
+	specs := targetSpecs(lc.files, lc.hostports)
+	type outcome struct {
+		findings []*lintFinding
+		err      error
+	}
+	outcomes := make([]outcome, len(specs))
+	status := 0
+	var writeErr error
+	runOrdered(len(specs), lc.concurrency, func(i int) {
+		o := &outcomes[i]
+		var certs []*x509.Certificate
+		certs, o.err = lc.served(specs[i])
+		if o.err == nil {
+			o.findings = lintChain(certs, rules)
+		}
+	}, func(i int) bool {
+		o := outcomes[i]
+		if rw != nil {
+			writeErr = rw.write(&lintRecord{
+				SchemaVersion: jsonSchemaVersion,
+				Type:          "lint",
+				Target:        specs[i].target,
+				Kind:          specs[i].kind,
+				Findings:      lintsJSON(o.findings),
+				Error:         errString(o.err),
+			})
+			if writeErr != nil {
+				return false
+			}
+		}
+		if o.err != nil {
+			log.Println(o.err)
+			status = 1
+			return lc.contOnError
+		}
+		if lintErrors(o.findings) > 0 && status == 0 {
+			status = ExitLintErrors
+		}
+		if rw == nil {
+			log.Printf("%s: %d errors, %d warnings", specs[i].target,
+				lintErrors(o.findings), len(o.findings)-lintErrors(o.findings))
+			for _, lf := range o.findings {
+				log.Println(lf)
+			}
+		}
+		return true
+	})
+	if writeErr != nil {
+		log.Println(writeErr)
+		return 1
+	}
+	if rw != nil {
+		if err = rw.close(); err != nil {
+			log.Println(err)
+			return 1
+		}
+	}
+	return status
+}
+
+// served returns the certificates for a target as given: the contents of a
+// -p file, or the chain an -hp target serves.
+func (lc *LintCmd) served(spec targetSpec) ([]*x509.Certificate, error) {
+	if spec.kind == targetKindFile {
+		fbytes, err := os.ReadFile(spec.target)
+		if err != nil {
+			return nil, fmt.Errorf("error reading file %s: %w", spec.target, err)
+		}
+		certs, err := x509.ParseCertificates(decodePemsByType(fbytes, "CERTIFICATE"))
+		if err != nil {
+			return nil, fmt.Errorf("error parsing certificates for file %s: %w", spec.target, err)
+		}
+		if len(certs) == 0 {
+			return nil, fmt.Errorf("no certificates found in %s", spec.target)
+		}
+		return certs, nil
+	}
+	t, err := lc.target(spec.target)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), lc.timeout)
+	defer cancel()
+	certs, err := fetchPeerCertificates(ctx, t)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to host %s: %w", t, err)
+	}
+	return certs, nil
+}
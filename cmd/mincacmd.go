@@ -1,21 +1,33 @@
 package cmd
 
 import (
+	"context"
 	"crypto/sha1"
-	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"strings"
+	"time"
 )
 
 type MinCACmd struct {
 	hostports   stringparams
 	files       globparams
+	targetsFile string
 	cafile      string
 	contOnError bool
+	format      string
+	// out is where the bundle goes, - for stdout
+	out         string
+	concurrency int
+	// path picks among several verified chains
+	path    string
+	at      atparam
+	purpose string
+	storeOptions
+	dialOptions
+	cacheOptions
 	*BaseCmd
 }
 
@@ -27,16 +39,60 @@ func NewMinCACmd() *MinCACmd {
 	mca.f.SetOutput(mca.b)
 	mca.f.Var(&mca.hostports, "hp", "search `host:port` for ssl chains")
 	mca.f.Var(&mca.files, "p", "search `pathspec` for certificate files")
+	mca.f.StringVar(&mca.targetsFile, "targets", "", "read targets from `path`, one per line, or - for stdin")
 	mca.f.BoolVar(&mca.contOnError, "continue", false, "continue on error")
 	mca.f.StringVar(&mca.cafile, "ca", "", "path to a ca bundle.  defaults to the system bundle")
+	mca.f.StringVar(&mca.format, "format", formatPEM, "output `format`, one of pem, der, p7b, p12, jks, "+
+		"json or ndjson")
+	mca.f.StringVar(&mca.out, "out", "-", "write the bundle to `path`.  use - for stdout")
+	mca.f.IntVar(&mca.concurrency, "concurrency", 1, "process up to `N` targets at once")
+	mca.f.StringVar(&mca.path, "path", pathAll, "when more than one chain verifies, use the "+
+		"`selection` of all of them, the shortest or the newest-root")
+	mca.f.Var(&mca.at, "at", "verify as of `time`, either RFC3339 or an offset from now like +30d")
+	mca.f.StringVar(&mca.purpose, "purpose", purposeServerAuth, "verify certificates for `purpose`, one of "+
+		"serverAuth, clientAuth, codeSigning, emailProtection or any")
+	mca.storeOptions.register(mca.f)
+	mca.cacheOptions.register(mca.f)
+	mca.cacheOptions.registerOffline(mca.f)
+	mca.dialOptions.register(mca.f)
 	return mca
 }
 
 func (mca *MinCACmd) Run(args []string) int {
 	err := mca.f.Parse(args)
-	if err != nil || (len(mca.files) == 0 && len(mca.hostports) == 0) {
+	if err != nil || (len(mca.files) == 0 && len(mca.hostports) == 0 && mca.targetsFile == "") {
 		return RunResultHelp
 	}
+	if err = mca.dialOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = mca.cacheOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validateFormat(mca.format, append(bundleFormats, formatJSON, formatNDJSON)...); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validatePathSelection(mca.path); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validatePurpose(mca.purpose); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = mca.storeOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+
+	specs, err := loadTargetSpecs(mca.files, mca.hostports, mca.targetsFile)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
 
 	var ca *x509.CertPool
 	if mca.cafile != "" {
@@ -47,34 +103,102 @@ func (mca *MinCACmd) Run(args []string) int {
 		}
 	}
 
-	cm := make(map[string]*x509.Certificate)
-	for _, file := range mca.files {
-		certs, err := processFile(file, ca)
-		if err != nil {
-			log.Println(err)
+	w, err := openOutput(mca.out)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer w.Close()
+	var rw *recordWriter
+	if isJSONFormat(mca.format) {
+		rw = newRecordWriter(w, mca.format)
+	}
+	bundle := newMinBundle()
+	cv := newChainVerifier(ca, mca.timeout)
+	cv.now = mca.at.t
+	cv.keyUsages = purposeKeyUsages(mca.purpose)
+	cv.aia.cache = mca.cacheOptions.cache()
+	type outcome struct {
+		certs    []*x509.Certificate
+		err      error
+		started  time.Time
+		duration time.Duration
+	}
+	outcomes := make([]outcome, len(specs))
+	failed := false
+	var writeErr error
+	runOrdered(len(specs), mca.concurrency, func(i int) {
+		o := &outcomes[i]
+		o.started = time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), mca.timeout)
+		defer cancel()
+		switch specs[i].kind {
+		case targetKindFile:
+			o.certs, o.err = processFile(ctx, specs[i].target, cv, mca.path)
+		default:
+			var t *hostTarget
+			t, o.err = mca.specTarget(specs[i])
+			if o.err == nil {
+				o.certs, o.err = processAddr(ctx, t, cv, mca.path)
+			}
+		}
+		o.duration = time.Since(o.started)
+	}, func(i int) bool {
+		o := outcomes[i]
+		if rw != nil {
+			writeErr = rw.write(&minCARecord{
+				SchemaVersion: jsonSchemaVersion,
+				Type:          "minca",
+				Target:        specs[i].target,
+				Kind:          specs[i].kind,
+				Tags:          specs[i].tags,
+				Certificates:  certsJSON(o.certs, true),
+				Error:         errString(o.err),
+				StartedAt:     o.started.UTC(),
+				DurationMS:    o.duration.Milliseconds(),
+			})
+			if writeErr != nil {
+				return false
+			}
+		}
+		if o.err != nil {
+			log.Println(o.err)
 			if !mca.contOnError {
-				os.Exit(1)
+				failed = true
+				return false
 			}
 		}
-		for _, crt := range certs {
-			cm[thumb(crt)] = crt
+		bundle.add(specs[i].target, specs[i].tags, o.certs)
+		return true
+	})
+	if writeErr != nil {
+		log.Println(writeErr)
+		return 1
+	}
+	if failed {
+		if rw != nil {
+			if err = rw.close(); err != nil {
+				log.Println(err)
+			}
 		}
+		return 1
 	}
-
-	for _, hostport := range mca.hostports {
-		certs, err := processAddr(hostport, ca)
-		if err != nil {
+	if rw != nil {
+		if err = rw.write(newBundleRecord(bundle)); err != nil {
 			log.Println(err)
-			if !mca.contOnError {
-				os.Exit(1)
-			}
+			return 1
 		}
-		for _, crt := range certs {
-			cm[thumb(crt)] = crt
+		if err = rw.close(); err != nil {
+			log.Println(err)
+			return 1
 		}
+	} else if err = writeBundle(w, mca.format, bundle.sorted(), &mca.storeOptions); err != nil {
+		log.Println(err)
+		return 1
 	}
-	for _, cert := range cm {
-		writeCert(os.Stdout, cert)
+	if err = w.Close(); err != nil {
+		log.Println(err)
+		return 1
 	}
 	return 0
 }
@@ -83,54 +207,37 @@ func (mca *MinCACmd) Synopsis() string {
 	return "return minimum CA bundle for given input"
 }
 
-func processAddr(addr string, ca *x509.CertPool) ([]*x509.Certificate, error) {
-	hostport := strings.Split(addr, ":")
-	if len(hostport) != 2 {
-		return nil, fmt.Errorf("invalid host:port specification: %s", addr)
-	}
-	var PeerCertificates []*x509.Certificate
-	var VerifiedChains [][]*x509.Certificate
-	conn, err := tls.Dial("tcp", addr, &tls.Config{
-		ServerName:         hostport[0],
-		InsecureSkipVerify: true,
-		// Mamually verify certs, catch case where intermediates are missing
-		// and dowload them.
-		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
-			if len(rawCerts) == 0 {
-				return fmt.Errorf("no certificates returned from %s", addr)
-			}
-
-			PeerCertificates = make([]*x509.Certificate, 0, len(rawCerts))
-			for _, raw := range rawCerts {
-				cert, err := x509.ParseCertificate(raw)
-				if err != nil {
-					return fmt.Errorf("error parsing cert from %s: %s", addr, err)
-				}
-				PeerCertificates = append(PeerCertificates, cert)
-			}
-			var err error
-			VerifiedChains, _, err = verifyChains(PeerCertificates, ca)
-			if err != nil {
-				return err
-			}
-			return nil
-		},
-	})
+func processAddr(ctx context.Context, t *hostTarget, cv *chainVerifier, path string) ([]*x509.Certificate, error) {
+	served, chains, err := verifyAddr(ctx, t, cv)
 	if err != nil {
-		return nil, fmt.Errorf("error connecting to host %s: %s", addr, err)
+		return nil, err
 	}
-
-	conn.Close()
-	if len(VerifiedChains) != 1 {
-		return nil, fmt.Errorf("weird length of VerifiedChains: %d", len(VerifiedChains))
+	var ret []*x509.Certificate
+	for _, chain := range selectChains(chains, path) {
+		ret = append(ret, cullCerts(served, chain)...)
 	}
+	return ret, nil
 
-	return cullCerts(PeerCertificates, VerifiedChains[0]), nil
+}
 
+// verifyAddr returns the chain t serves and the chains it verifies to.
+func verifyAddr(ctx context.Context, t *hostTarget, cv *chainVerifier) ([]*x509.Certificate, [][]*x509.Certificate, error) {
+	PeerCertificates, err := fetchPeerCertificates(ctx, t)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error connecting to host %s: %s", t, err)
+	}
+	VerifiedChains, _, err := cv.verifyChains(ctx, PeerCertificates)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error verifying chain for host %s: %w", t, err)
+	}
+	return PeerCertificates, VerifiedChains, nil
 }
 
 func thumb(cert *x509.Certificate) string {
-	return base64.RawStdEncoding.EncodeToString(sha1.New().Sum(cert.Raw))
+	// Note sha1.New().Sum(cert.Raw) would append to cert.Raw, which shares
+	// its backing array with whatever the certificate was parsed from.
+	sum := sha1.Sum(cert.Raw)
+	return base64.RawStdEncoding.EncodeToString(sum[:])
 }
 
 func cullCerts(exclude []*x509.Certificate, haystack []*x509.Certificate) []*x509.Certificate {
@@ -153,37 +260,46 @@ func cullCerts(exclude []*x509.Certificate, haystack []*x509.Certificate) []*x50
 	return ret
 }
 
-func processFile(certfile string, ca *x509.CertPool) ([]*x509.Certificate, error) {
+func processFile(ctx context.Context, certfile string, cv *chainVerifier, path string) ([]*x509.Certificate, error) {
+	certs, chains, err := verifyFile(ctx, certfile, cv)
+	if err != nil {
+		return nil, err
+	}
+	var ret []*x509.Certificate
+	for _, chain := range selectChains(chains, path) {
+		ret = append(ret, cullCerts(certs, chain)...)
+	}
+	return ret, nil
+}
+
+// verifyFile returns the certificates in certfile and the chains they
+// verify to.
+func verifyFile(ctx context.Context, certfile string, cv *chainVerifier) ([]*x509.Certificate, [][]*x509.Certificate, error) {
 	fbytes, err := ioutil.ReadFile(certfile)
 	if err != nil {
-		return nil, fmt.Errorf("error reading file %s: %w", certfile, err)
+		return nil, nil, fmt.Errorf("error reading file %s: %w", certfile, err)
 	}
 	certders := decodePemsByType(fbytes, "CERTIFICATE")
 	if len(certders) == 0 {
-		return nil, fmt.Errorf("no certificates found in passed bundle %s", certfile)
+		return nil, nil, fmt.Errorf("no certificates found in passed bundle %s", certfile)
 	}
 	certs, err := x509.ParseCertificates(certders)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing certificates for file %s: %w", certfile, err)
+		return nil, nil, fmt.Errorf("error parsing certificates for file %s: %w", certfile, err)
 	}
 
 	if len(certs) == 0 {
-		fmt.Errorf("no proper ASN1 certificate data found in file %s", certfile)
+		return nil, nil, fmt.Errorf("no proper ASN1 certificate data found in file %s", certfile)
 	}
 
-	chains, _, err := verifyChains(certs, ca)
+	chains, _, err := cv.verifyChains(ctx, certs)
 
 	if err != nil {
-		return nil, fmt.Errorf("error on verification of file %s: %w", certfile, err)
+		return nil, nil, fmt.Errorf("error on verification of file %s: %w", certfile, err)
 	}
 
 	if len(chains) == 0 {
-		return nil, fmt.Errorf("Invalid length of chains for file %s: %d", certfile, len(chains))
+		return nil, nil, fmt.Errorf("Invalid length of chains for file %s: %d", certfile, len(chains))
 	}
-
-	var ret []*x509.Certificate
-	for _, chain := range chains {
-		ret = append(ret, cullCerts(certs, chain)...)
-	}
-	return ret, nil
+	return certs, chains, nil
 }
@@ -0,0 +1,661 @@
+package cmd
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// jsonSchemaVersion is carried in every JSON record.  It is bumped whenever
+// a field is removed or changes meaning; new fields may be added without a
+// bump, so consumers should ignore fields they don't know about.
+const jsonSchemaVersion = 1
+
+const (
+	formatText   = "text"
+	formatPEM    = "pem"
+	formatCSV    = "csv"
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+)
+
+func validateFormat(format string, allowed ...string) error {
+	for _, a := range allowed {
+		if format == a {
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported format %q, must be one of: %s", format, strings.Join(allowed, ", "))
+}
+
+func isJSONFormat(format string) bool {
+	return format == formatJSON || format == formatNDJSON
+}
+
+// recordWriter writes JSON records either as a single indented array (json)
+// or as one compact record per line (ndjson).
+type recordWriter struct {
+	w       io.Writer
+	format  string
+	records []interface{}
+}
+
+func newRecordWriter(w io.Writer, format string) *recordWriter {
+	return &recordWriter{
+		w:       w,
+		format:  format,
+		records: []interface{}{},
+	}
+}
+
+func (rw *recordWriter) write(rec interface{}) error {
+	if rw.format == formatNDJSON {
+		return json.NewEncoder(rw.w).Encode(rec)
+	}
+	rw.records = append(rw.records, rec)
+	return nil
+}
+
+// close flushes buffered records.  It is a no-op for ndjson.
+func (rw *recordWriter) close() error {
+	if rw.format == formatNDJSON {
+		return nil
+	}
+	enc := json.NewEncoder(rw.w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(rw.records)
+}
+
+type certJSON struct {
+	Subject            string    `json:"subject"`
+	CommonName         string    `json:"common_name"`
+	Issuer             string    `json:"issuer"`
+	Serial             string    `json:"serial"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	DNSNames           []string  `json:"dns_names,omitempty"`
+	IPAddresses        []string  `json:"ip_addresses,omitempty"`
+	IsCA               bool      `json:"is_ca"`
+	PublicKeyAlgorithm string    `json:"public_key_algorithm"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	SHA1               string    `json:"sha1"`
+	SHA256             string    `json:"sha256"`
+	PEM                string    `json:"pem,omitempty"`
+}
+
+func newCertJSON(cert *x509.Certificate, withPEM bool) *certJSON {
+	s1 := sha1.Sum(cert.Raw)
+	s256 := sha256.Sum256(cert.Raw)
+	cj := &certJSON{
+		Subject:            cert.Subject.String(),
+		CommonName:         cert.Subject.CommonName,
+		Issuer:             cert.Issuer.String(),
+		Serial:             serialHex(cert.SerialNumber),
+		NotBefore:          cert.NotBefore.UTC(),
+		NotAfter:           cert.NotAfter.UTC(),
+		DNSNames:           cert.DNSNames,
+		IsCA:               cert.IsCA,
+		PublicKeyAlgorithm: cert.PublicKeyAlgorithm.String(),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		SHA1:               hex.EncodeToString(s1[:]),
+		SHA256:             hex.EncodeToString(s256[:]),
+	}
+	for _, ip := range cert.IPAddresses {
+		cj.IPAddresses = append(cj.IPAddresses, ip.String())
+	}
+	if withPEM {
+		cj.PEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}))
+	}
+	return cj
+}
+
+// serialHex is a serial number in hex.  Serials should be positive, but some
+// old CAs issued negative ones, and those keep their sign.
+func serialHex(n *big.Int) string {
+	if n.Sign() < 0 {
+		return "-" + hex.EncodeToString(new(big.Int).Neg(n).Bytes())
+	}
+	return hex.EncodeToString(n.Bytes())
+}
+
+func certsJSON(certs []*x509.Certificate, withPEM bool) []*certJSON {
+	ret := make([]*certJSON, 0, len(certs))
+	for _, cert := range certs {
+		ret = append(ret, newCertJSON(cert, withPEM))
+	}
+	return ret
+}
+
+func chainsJSON(chains [][]*x509.Certificate) [][]*certJSON {
+	ret := make([][]*certJSON, 0, len(chains))
+	for _, chain := range chains {
+		ret = append(ret, certsJSON(chain, false))
+	}
+	return ret
+}
+
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+type nameJSON struct {
+	Expected string `json:"expected"`
+	Valid    bool   `json:"valid"`
+	Error    string `json:"error,omitempty"`
+}
+
+type expiryJSON struct {
+	Status        string    `json:"status"`
+	Role          string    `json:"role"`
+	Subject       string    `json:"subject"`
+	NotAfter      time.Time `json:"not_after"`
+	DaysRemaining int       `json:"days_remaining"`
+}
+
+type revocationJSON struct {
+	Subject    string     `json:"subject"`
+	Role       string     `json:"role"`
+	Method     string     `json:"method"`
+	Source     string     `json:"source,omitempty"`
+	Status     string     `json:"status"`
+	ThisUpdate *time.Time `json:"this_update,omitempty"`
+	NextUpdate *time.Time `json:"next_update,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	Reason     *int       `json:"reason,omitempty"`
+	Error      string     `json:"error,omitempty"`
+}
+
+func timePtr(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+func newRevocationJSON(rs *revocationStatus) *revocationJSON {
+	rj := &revocationJSON{
+		Subject:    rs.cert.Subject.String(),
+		Role:       rs.role,
+		Method:     rs.method,
+		Source:     rs.source,
+		Status:     rs.status,
+		ThisUpdate: timePtr(rs.thisUpdate),
+		NextUpdate: timePtr(rs.nextUpdate),
+		RevokedAt:  timePtr(rs.revokedAt),
+		Error:      errString(rs.err),
+	}
+	if rs.status == revocationRevoked {
+		reason := rs.reason
+		rj.Reason = &reason
+	}
+	return rj
+}
+
+type stapleJSON struct {
+	Present    bool            `json:"present"`
+	Fresh      bool            `json:"fresh"`
+	MustStaple bool            `json:"must_staple"`
+	Violation  bool            `json:"must_staple_violation"`
+	Response   *revocationJSON `json:"response,omitempty"`
+}
+
+func newStapleJSON(si *stapleInfo) *stapleJSON {
+	sj := &stapleJSON{
+		Present:    si.present,
+		Fresh:      si.fresh,
+		MustStaple: si.mustStaple,
+		Violation:  si.violatesMustStaple(),
+	}
+	if si.ocsp != nil {
+		sj.Response = newRevocationJSON(si.ocsp)
+	}
+	return sj
+}
+
+// pathJSON describes the verified chain at the same index.
+type pathJSON struct {
+	Length     int  `json:"length"`
+	Shortest   bool `json:"shortest"`
+	NewestRoot bool `json:"newest_root"`
+}
+
+type servedChainJSON struct {
+	OK bool `json:"ok"`
+	// Labels holds a label for each certificate in served_chain.
+	Labels         []string    `json:"labels"`
+	SuggestedOrder []*certJSON `json:"suggested_order"`
+}
+
+type keyJSON struct {
+	Source  string `json:"source"`
+	Type    string `json:"type,omitempty"`
+	Matches bool   `json:"matches"`
+	Error   string `json:"error,omitempty"`
+}
+
+type sweepJSON struct {
+	FailsAt time.Time `json:"fails_at"`
+	Error   string    `json:"error"`
+}
+
+type sctJSON struct {
+	Source    string    `json:"source"`
+	LogID     string    `json:"log_id"`
+	Log       string    `json:"log,omitempty"`
+	Operator  string    `json:"operator,omitempty"`
+	LogState  string    `json:"log_state,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Valid     bool      `json:"valid"`
+	Error     string    `json:"error,omitempty"`
+}
+
+type ctJSON struct {
+	Compliant bool       `json:"compliant"`
+	Reason    string     `json:"reason"`
+	SCTs      []*sctJSON `json:"scts"`
+	Errors    []string   `json:"errors,omitempty"`
+}
+
+func newCTJSON(ci *ctInfo) *ctJSON {
+	cj := &ctJSON{
+		Compliant: ci.compliant,
+		Reason:    ci.reason,
+		SCTs:      []*sctJSON{},
+	}
+	for _, s := range ci.scts {
+		sj := &sctJSON{
+			Source:    s.source,
+			LogID:     s.logIDString(),
+			Timestamp: s.timestamp,
+			Valid:     s.valid(),
+			Error:     errString(s.err),
+		}
+		if s.log != nil {
+			sj.Log, sj.Operator, sj.LogState = s.log.description, s.log.operator, s.log.state
+		}
+		cj.SCTs = append(cj.SCTs, sj)
+	}
+	for _, err := range ci.parseErrs {
+		cj.Errors = append(cj.Errors, err.Error())
+	}
+	return cj
+}
+
+type tlsVersionJSON struct {
+	Version  string `json:"version"`
+	Accepted bool   `json:"accepted"`
+	// CipherSuites are in the server's order of preference.
+	CipherSuites []string `json:"cipher_suites"`
+	// Error is set when probing failed for some other reason than the
+	// server turning a handshake down.
+	Error string `json:"error,omitempty"`
+}
+
+type chainVariantJSON struct {
+	Chain      []*certJSON `json:"chain"`
+	Negotiated []string    `json:"negotiated"`
+}
+
+type enumJSON struct {
+	Versions []*tlsVersionJSON   `json:"versions"`
+	Chains   []*chainVariantJSON `json:"chains"`
+}
+
+func newEnumJSON(ei *enumInfo) *enumJSON {
+	ej := &enumJSON{
+		Versions: []*tlsVersionJSON{},
+		Chains:   []*chainVariantJSON{},
+	}
+	for _, vi := range ei.versions {
+		vj := &tlsVersionJSON{
+			Version:      tls.VersionName(vi.version),
+			Accepted:     vi.accepted,
+			CipherSuites: []string{},
+			Error:        errString(vi.err),
+		}
+		for _, id := range vi.suites {
+			vj.CipherSuites = append(vj.CipherSuites, tls.CipherSuiteName(id))
+		}
+		ej.Versions = append(ej.Versions, vj)
+	}
+	for _, cv := range ei.chains {
+		ej.Chains = append(ej.Chains, &chainVariantJSON{
+			Chain:      certsJSON(cv.certs, false),
+			Negotiated: cv.negotiated,
+		})
+	}
+	return ej
+}
+
+type lintJSON struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Role     string `json:"role"`
+	Subject  string `json:"subject"`
+	Message  string `json:"message"`
+}
+
+func lintsJSON(findings []*lintFinding) []*lintJSON {
+	ret := make([]*lintJSON, 0, len(findings))
+	for _, lf := range findings {
+		ret = append(ret, &lintJSON{
+			Rule:     lf.rule.id,
+			Severity: lf.rule.severity.String(),
+			Role:     lf.role,
+			Subject:  lf.cert.Subject.String(),
+			Message:  lf.message,
+		})
+	}
+	return ret
+}
+
+// storeJSON is how a target fared against one -ca store.
+type storeJSON struct {
+	Name    string      `json:"name"`
+	OK      bool        `json:"ok"`
+	Missing []*certJSON `json:"missing"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// checkRecord is the JSON form of a checkResult.
+type checkRecord struct {
+	SchemaVersion    int               `json:"schema_version"`
+	Type             string            `json:"type"`
+	Target           string            `json:"target"`
+	Kind             string            `json:"kind"`
+	DialAddress      string            `json:"dial_address,omitempty"`
+	ServerName       string            `json:"server_name,omitempty"`
+	StartTLS         string            `json:"starttls,omitempty"`
+	Tags             []string          `json:"tags,omitempty"`
+	Status           string            `json:"status"`
+	OK               bool              `json:"ok"`
+	Leaf             *certJSON         `json:"leaf,omitempty"`
+	ServedChain      []*certJSON       `json:"served_chain"`
+	ServedChainCheck *servedChainJSON  `json:"served_chain_check,omitempty"`
+	AIAFetched       []*certJSON       `json:"aia_fetched"`
+	VerifiedChains   [][]*certJSON     `json:"verified_chains"`
+	Paths            []*pathJSON       `json:"paths"`
+	Missing          []*certJSON       `json:"missing"`
+	Name             *nameJSON         `json:"name,omitempty"`
+	Expiry           *expiryJSON       `json:"expiry,omitempty"`
+	Revocation       []*revocationJSON `json:"revocation,omitempty"`
+	OCSPStaple       *stapleJSON       `json:"ocsp_staple,omitempty"`
+	CT               *ctJSON           `json:"ct,omitempty"`
+	TLS              *enumJSON         `json:"tls,omitempty"`
+	Lint             []*lintJSON       `json:"lint,omitempty"`
+	Stores           []*storeJSON      `json:"stores,omitempty"`
+	Sweep            *sweepJSON        `json:"sweep,omitempty"`
+	PrivateKey       *keyJSON          `json:"private_key,omitempty"`
+	ChainError       string            `json:"chain_error,omitempty"`
+	Error            string            `json:"error,omitempty"`
+	StartedAt        time.Time         `json:"started_at"`
+	DurationMS       int64             `json:"duration_ms"`
+}
+
+func (res *checkResult) record() *checkRecord {
+	rec := &checkRecord{
+		SchemaVersion:  jsonSchemaVersion,
+		Type:           "check",
+		Target:         res.target,
+		Kind:           res.kind,
+		Tags:           res.tags,
+		Status:         res.status().key(),
+		OK:             res.ok && res.err == nil,
+		ServedChain:    []*certJSON{},
+		AIAFetched:     certsJSON(res.fetched, false),
+		VerifiedChains: chainsJSON(res.chains),
+		Paths:          []*pathJSON{},
+		Missing:        certsJSON(res.missing, false),
+		ChainError:     errString(res.chainErr),
+		Error:          errString(res.err),
+		StartedAt:      res.started.UTC(),
+		DurationMS:     res.duration.Milliseconds(),
+	}
+	if t := res.host; t != nil {
+		rec.DialAddress = t.dialAddr
+		rec.ServerName = t.serverName
+		rec.StartTLS = t.starttls
+	}
+	if res.leaf != nil {
+		rec.Leaf = newCertJSON(res.leaf, false)
+		rec.ServedChain = append(rec.ServedChain, rec.Leaf)
+		rec.ServedChain = append(rec.ServedChain, certsJSON(res.intermediates, false)...)
+	}
+	for _, cp := range rankChains(res.chains) {
+		rec.Paths = append(rec.Paths, &pathJSON{
+			Length:     len(cp.chain),
+			Shortest:   cp.shortest,
+			NewestRoot: cp.newestRoot,
+		})
+	}
+	if res.name != "" && res.err == nil {
+		rec.Name = &nameJSON{
+			Expected: res.name,
+			Valid:    res.nameErr == nil,
+			Error:    errString(res.nameErr),
+		}
+	}
+	if ei := res.expiry; ei != nil {
+		rec.Expiry = &expiryJSON{
+			Status:        strings.ToLower(ei.status.String()),
+			Role:          ei.role,
+			Subject:       ei.cert.Subject.String(),
+			NotAfter:      ei.cert.NotAfter.UTC(),
+			DaysRemaining: int(ei.remaining.Hours() / 24),
+		}
+	}
+	for _, rs := range res.revocation {
+		rec.Revocation = append(rec.Revocation, newRevocationJSON(rs))
+	}
+	if res.staple != nil {
+		rec.OCSPStaple = newStapleJSON(res.staple)
+	}
+	if res.ct != nil {
+		rec.CT = newCTJSON(res.ct)
+	}
+	if res.enum != nil {
+		rec.TLS = newEnumJSON(res.enum)
+	}
+	if res.lint != nil {
+		rec.Lint = lintsJSON(res.lint)
+	}
+	for _, sr := range res.stores {
+		rec.Stores = append(rec.Stores, &storeJSON{
+			Name:    sr.store.name,
+			OK:      sr.ok(),
+			Missing: certsJSON(sr.missing, false),
+			Error:   errString(sr.err),
+		})
+	}
+	if km := res.key; km != nil {
+		rec.PrivateKey = &keyJSON{
+			Source:  km.source,
+			Type:    km.keyType,
+			Matches: km.matches,
+			Error:   errString(km.err),
+		}
+	}
+	if sw := res.sweep; sw != nil {
+		rec.Sweep = &sweepJSON{
+			FailsAt: sw.failsAt.UTC(),
+			Error:   errString(sw.err),
+		}
+	}
+	if sc := res.servedChain; sc != nil {
+		rec.ServedChainCheck = &servedChainJSON{
+			OK:             sc.ok(),
+			Labels:         sc.labels,
+			SuggestedOrder: certsJSON(sc.suggested, false),
+		}
+	}
+	return rec
+}
+
+// summaryRecord counts check results by status.
+type summaryRecord struct {
+	SchemaVersion int            `json:"schema_version"`
+	Type          string         `json:"type"`
+	Counts        map[string]int `json:"counts"`
+	Worst         string         `json:"worst"`
+}
+
+// minCARecord is the JSON form of the certificates minca needs for a target.
+type minCARecord struct {
+	SchemaVersion int         `json:"schema_version"`
+	Type          string      `json:"type"`
+	Target        string      `json:"target"`
+	Kind          string      `json:"kind"`
+	Tags          []string    `json:"tags,omitempty"`
+	Certificates  []*certJSON `json:"certificates"`
+	Error         string      `json:"error,omitempty"`
+	StartedAt     time.Time   `json:"started_at"`
+	DurationMS    int64       `json:"duration_ms"`
+}
+
+// bundleCertJSON is a certificate in a minimum bundle, with the targets that
+// needed it and their tags.
+type bundleCertJSON struct {
+	*certJSON
+	NeededBy []string `json:"needed_by"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// bundleRecord is the deduplicated minimum bundle across all minca targets,
+// ordered by subject and then fingerprint.
+type bundleRecord struct {
+	SchemaVersion int               `json:"schema_version"`
+	Type          string            `json:"type"`
+	Certificates  []*bundleCertJSON `json:"certificates"`
+}
+
+func newBundleRecord(mb *minBundle) *bundleRecord {
+	rec := &bundleRecord{
+		SchemaVersion: jsonSchemaVersion,
+		Type:          "bundle",
+		Certificates:  []*bundleCertJSON{},
+	}
+	for _, be := range mb.sorted() {
+		rec.Certificates = append(rec.Certificates, &bundleCertJSON{
+			certJSON: newCertJSON(be.cert, true),
+			NeededBy: be.neededBy,
+			Tags:     be.tags,
+		})
+	}
+	return rec
+}
+
+// pruneRecord is the certificates in the bundle being pruned that a prune
+// target depends on.
+type pruneRecord struct {
+	SchemaVersion int         `json:"schema_version"`
+	Type          string      `json:"type"`
+	Target        string      `json:"target"`
+	Kind          string      `json:"kind"`
+	Tags          []string    `json:"tags,omitempty"`
+	DependsOn     []*certJSON `json:"depends_on"`
+	Error         string      `json:"error,omitempty"`
+	StartedAt     time.Time   `json:"started_at"`
+	DurationMS    int64       `json:"duration_ms"`
+}
+
+// caUsageJSON is a certificate in the bundle being pruned, with the targets
+// that depend on it.  Those no target depends on are pruned.
+type caUsageJSON struct {
+	*certJSON
+	Root     bool     `json:"root"`
+	Used     bool     `json:"used"`
+	NeededBy []string `json:"needed_by"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+// caUsageRecord is every certificate in the bundle being pruned, in bundle
+// order.
+type caUsageRecord struct {
+	SchemaVersion int            `json:"schema_version"`
+	Type          string         `json:"type"`
+	CA            string         `json:"ca"`
+	Certificates  []*caUsageJSON `json:"certificates"`
+}
+
+func newCAUsageRecord(ca string, usage []*caUsage) *caUsageRecord {
+	rec := &caUsageRecord{
+		SchemaVersion: jsonSchemaVersion,
+		Type:          "ca_usage",
+		CA:            ca,
+		Certificates:  []*caUsageJSON{},
+	}
+	for _, u := range usage {
+		neededBy := u.neededBy
+		if neededBy == nil {
+			neededBy = []string{}
+		}
+		rec.Certificates = append(rec.Certificates, &caUsageJSON{
+			certJSON: newCertJSON(u.cert, true),
+			Root:     u.root,
+			Used:     len(u.neededBy) > 0,
+			NeededBy: neededBy,
+			Tags:     u.tags,
+		})
+	}
+	return rec
+}
+
+// cachedCertRecord is a certificate in the AIA cache, as listed by cache
+// list.
+type cachedCertRecord struct {
+	SchemaVersion int    `json:"schema_version"`
+	Type          string `json:"type"`
+	*certJSON
+	URLs     []*urlEntry `json:"urls"`
+	StoredAt time.Time   `json:"stored_at"`
+	Stale    bool        `json:"stale"`
+	Error    string      `json:"error,omitempty"`
+}
+
+func newCachedCertRecord(ac *aiaCache, e *cachedCert) *cachedCertRecord {
+	rec := &cachedCertRecord{
+		SchemaVersion: jsonSchemaVersion,
+		Type:          "cached_certificate",
+		URLs:          e.urls,
+		StoredAt:      e.storedAt.UTC(),
+		Stale:         !ac.fresh(e.storedAt),
+		Error:         errString(e.err),
+	}
+	if rec.URLs == nil {
+		rec.URLs = []*urlEntry{}
+	}
+	if e.cert != nil {
+		rec.certJSON = newCertJSON(e.cert, false)
+	}
+	return rec
+}
+
+// lintRecord is the lint findings for a target, as written by lint.
+type lintRecord struct {
+	SchemaVersion int         `json:"schema_version"`
+	Type          string      `json:"type"`
+	Target        string      `json:"target"`
+	Kind          string      `json:"kind"`
+	Findings      []*lintJSON `json:"findings"`
+	Error         string      `json:"error,omitempty"`
+}
+
+// certificateRecord is a single certificate, as written by dumpca.
+type certificateRecord struct {
+	SchemaVersion int    `json:"schema_version"`
+	Type          string `json:"type"`
+	*certJSON
+}
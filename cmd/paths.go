@@ -0,0 +1,111 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// Ways minca can choose among several verified chains.
+const (
+	pathShortest   = "shortest"
+	pathNewestRoot = "newest-root"
+	pathAll        = "all"
+)
+
+func validatePathSelection(sel string) error {
+	switch sel {
+	case pathShortest, pathNewestRoot, pathAll:
+		return nil
+	default:
+		return fmt.Errorf("unsupported path selection %q, must be one of: %s, %s, %s",
+			sel, pathShortest, pathNewestRoot, pathAll)
+	}
+}
+
+// chainPath is one verified chain, from leaf to anchor.  With cross-signed
+// roots there are often several.
+type chainPath struct {
+	chain []*x509.Certificate
+	// shortest is set on every chain of the minimum length, and newestRoot
+	// on every chain ending in the most recently issued anchor.
+	shortest   bool
+	newestRoot bool
+}
+
+func (cp *chainPath) String() string {
+	var marks []string
+	if cp.shortest {
+		marks = append(marks, "shortest")
+	}
+	if cp.newestRoot {
+		marks = append(marks, "newest root")
+	}
+	names := make([]string, 0, len(cp.chain))
+	for _, cert := range cp.chain {
+		names = append(names, cert.Subject.CommonName)
+	}
+	s := strings.Join(names, " -> ")
+	if len(marks) > 0 {
+		s = fmt.Sprintf("%s (%s)", s, strings.Join(marks, ", "))
+	}
+	return s
+}
+
+// rankChains marks the shortest chains and those with the newest root.
+func rankChains(chains [][]*x509.Certificate) []*chainPath {
+	paths := make([]*chainPath, 0, len(chains))
+	for _, chain := range chains {
+		paths = append(paths, &chainPath{chain: chain})
+	}
+	if len(paths) == 0 {
+		return paths
+	}
+	shortest, newest := len(chains[0]), anchorOf(chains[0])
+	for _, chain := range chains[1:] {
+		if len(chain) < shortest {
+			shortest = len(chain)
+		}
+		if a := anchorOf(chain); a.NotBefore.After(newest.NotBefore) {
+			newest = a
+		}
+	}
+	for _, cp := range paths {
+		cp.shortest = len(cp.chain) == shortest
+		cp.newestRoot = anchorOf(cp.chain).NotBefore.Equal(newest.NotBefore)
+	}
+	return paths
+}
+
+func anchorOf(chain []*x509.Certificate) *x509.Certificate {
+	return chain[len(chain)-1]
+}
+
+// selectChains picks the chains sel asks for.  Ties are broken by the other
+// mark, then by the order Verify returned them in.
+func selectChains(chains [][]*x509.Certificate, sel string) [][]*x509.Certificate {
+	if sel == pathAll || len(chains) < 2 {
+		return chains
+	}
+	var best *chainPath
+	score := func(cp *chainPath) int {
+		s := 0
+		if cp.shortest {
+			s++
+		}
+		if cp.newestRoot {
+			s++
+		}
+		switch {
+		case sel == pathShortest && cp.shortest, sel == pathNewestRoot && cp.newestRoot:
+			s += 2
+		}
+		return s
+	}
+	for _, cp := range rankChains(chains) {
+		if best == nil || score(cp) > score(best) {
+			best = cp
+		}
+	}
+	return [][]*x509.Certificate{best.chain}
+}
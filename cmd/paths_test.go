@@ -0,0 +1,188 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestRootAt returns a self-signed CA issued at notBefore.
+func newTestRootAt(t *testing.T, cn string, notBefore time.Time) *testCA {
+	t.Helper()
+	cert, key := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		NotBefore:             notBefore,
+	}, nil)
+	return &testCA{cert: cert, key: key}
+}
+
+// crossSign issues another certificate for ca's name and key from parent.
+func crossSign(t *testing.T, ca, parent *testCA) *x509.Certificate {
+	t.Helper()
+	tmpl := *ca.cert
+	tmpl.SerialNumber = big.NewInt(atomic.AddInt64(&testSerial, 1))
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, parent.cert, ca.key.Public(), parent.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// chainNames describes a chain from leaf to anchor.
+func chainNames(chain []*x509.Certificate) string {
+	names := make([]string, 0, len(chain))
+	for _, cert := range chain {
+		names = append(names, cert.Subject.CommonName)
+	}
+	return strings.Join(names, " -> ")
+}
+
+func TestSelectChainsCrossSigned(t *testing.T) {
+	now := time.Now()
+	oldRoot := newTestRootAt(t, "Old Root", now.AddDate(-10, 0, 0))
+	newRoot := newTestRootAt(t, "New Root", now.AddDate(-1, 0, 0))
+	bridge := newTestCA(t, "Bridge", newRoot)
+	intermediate := newTestCA(t, "Intermediate", oldRoot)
+	// the intermediate again, under the new root by way of the bridge
+	crossed := crossSign(t, intermediate, bridge)
+	leaf, _ := intermediate.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+
+	roots, inters := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(oldRoot.cert)
+	roots.AddCert(newRoot.cert)
+	inters.AddCert(intermediate.cert)
+	inters.AddCert(crossed)
+	inters.AddCert(bridge.cert)
+	chains, err := leaf.Verify(x509.VerifyOptions{Roots: roots, Intermediates: inters})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 2 {
+		t.Fatalf("got %d chains, wanted 2", len(chains))
+	}
+	const (
+		short = "leaf -> Intermediate -> Old Root"
+		long  = "leaf -> Intermediate -> Bridge -> New Root"
+	)
+
+	marks := make(map[string]*chainPath)
+	for _, cp := range rankChains(chains) {
+		marks[chainNames(cp.chain)] = cp
+	}
+	if cp := marks[short]; cp == nil || !cp.shortest || cp.newestRoot {
+		t.Fatalf("%s is marked %v, wanted only shortest", short, cp)
+	}
+	if cp := marks[long]; cp == nil || cp.shortest || !cp.newestRoot {
+		t.Fatalf("%s is marked %v, wanted only newest root", long, cp)
+	}
+
+	tests := []struct {
+		sel  string
+		want []string
+	}{
+		{sel: pathShortest, want: []string{short}},
+		{sel: pathNewestRoot, want: []string{long}},
+		{sel: pathAll, want: []string{chainNames(chains[0]), chainNames(chains[1])}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sel, func(t *testing.T) {
+			var got []string
+			for _, chain := range selectChains(chains, tt.sel) {
+				got = append(got, chainNames(chain))
+			}
+			if strings.Join(got, "; ") != strings.Join(tt.want, "; ") {
+				t.Fatalf("got %q, wanted %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSelectChainsTies(t *testing.T) {
+	now := time.Now()
+	leaf := &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}}
+	cert := func(cn string, notBefore time.Time) *x509.Certificate {
+		return &x509.Certificate{Subject: pkix.Name{CommonName: cn}, NotBefore: notBefore}
+	}
+	oldRoot, newRoot := cert("Old Root", now.AddDate(-10, 0, 0)), cert("New Root", now.AddDate(-1, 0, 0))
+	a, b, c := cert("A", now), cert("B", now), cert("C", now)
+
+	tests := []struct {
+		name   string
+		chains [][]*x509.Certificate
+		sel    string
+		want   string
+	}{
+		{
+			name: "shortest tie broken by newest root",
+			chains: [][]*x509.Certificate{
+				{leaf, a, oldRoot},
+				{leaf, b, newRoot},
+			},
+			sel:  pathShortest,
+			want: "leaf -> B -> New Root",
+		},
+		{
+			name: "newest root tie broken by shortest",
+			chains: [][]*x509.Certificate{
+				{leaf, a, c, newRoot},
+				{leaf, b, newRoot},
+			},
+			sel:  pathNewestRoot,
+			want: "leaf -> B -> New Root",
+		},
+		{
+			// shortest is over all the chains, so neither newest root chain
+			// has it
+			name: "newest root tie with a shorter old root",
+			chains: [][]*x509.Certificate{
+				{leaf, a, c, newRoot},
+				{leaf, b, newRoot},
+				{leaf, oldRoot},
+			},
+			sel:  pathNewestRoot,
+			want: "leaf -> A -> C -> New Root",
+		},
+		{
+			name: "shortest wins over newest root",
+			chains: [][]*x509.Certificate{
+				{leaf, a, c, newRoot},
+				{leaf, b, oldRoot},
+			},
+			sel:  pathShortest,
+			want: "leaf -> B -> Old Root",
+		},
+		{
+			name: "full tie goes to the first",
+			chains: [][]*x509.Certificate{
+				{leaf, a, newRoot},
+				{leaf, b, newRoot},
+			},
+			sel:  pathNewestRoot,
+			want: "leaf -> A -> New Root",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := selectChains(tt.chains, tt.sel)
+			if len(got) != 1 || chainNames(got[0]) != tt.want {
+				var names []string
+				for _, chain := range got {
+					names = append(names, chainNames(chain))
+				}
+				t.Fatalf("got %q, wanted %q", names, tt.want)
+			}
+		})
+	}
+}
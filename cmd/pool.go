@@ -0,0 +1,48 @@
+package cmd
+
+import "sync"
+
+// runOrdered calls work for every index in [0, n) using up to workers
+// goroutines, and calls emit on the calling goroutine for each index in
+// order once its work is done.  If emit returns false no new work is
+// started, and runOrdered returns once the work in flight has finished.
+func runOrdered(n, workers int, work func(i int), emit func(i int) bool) {
+	if workers < 1 {
+		workers = 1
+	}
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	jobs := make(chan int)
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				work(i)
+				close(done[i])
+			}
+		}()
+	}
+	go func() {
+		defer close(jobs)
+		for i := 0; i < n; i++ {
+			select {
+			case jobs <- i:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	for i := 0; i < n; i++ {
+		<-done[i]
+		if !emit(i) {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
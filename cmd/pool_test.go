@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRunOrderedEmitsInOrder(t *testing.T) {
+	const n = 5
+	// each job waits its turn, and the last goes first
+	turn := make([]chan struct{}, n)
+	for i := range turn {
+		turn[i] = make(chan struct{})
+	}
+	close(turn[n-1])
+	var (
+		mu       sync.Mutex
+		finished []int
+		emitted  []int
+	)
+	runOrdered(n, n, func(i int) {
+		<-turn[i]
+		mu.Lock()
+		finished = append(finished, i)
+		mu.Unlock()
+		if i > 0 {
+			close(turn[i-1])
+		}
+	}, func(i int) bool {
+		emitted = append(emitted, i)
+		return true
+	})
+	for i := range emitted {
+		if emitted[i] != i {
+			t.Fatalf("emitted %v, wanted them in order", emitted)
+		}
+		if finished[i] != n-1-i {
+			t.Fatalf("finished %v, wanted them in reverse", finished)
+		}
+	}
+	if len(emitted) != n {
+		t.Fatalf("emitted %d, wanted %d", len(emitted), n)
+	}
+}
+
+func TestRunOrderedStopsEarly(t *testing.T) {
+	const n, workers, stopAt = 100, 4, 3
+	before := runtime.NumGoroutine()
+	var worked int32
+	var emitted []int
+	runOrdered(n, workers, func(i int) {
+		atomic.AddInt32(&worked, 1)
+		time.Sleep(time.Millisecond)
+	}, func(i int) bool {
+		emitted = append(emitted, i)
+		return i != stopAt
+	})
+	if len(emitted) != stopAt+1 || emitted[stopAt] != stopAt {
+		t.Fatalf("emitted %v, wanted 0 through %d", emitted, stopAt)
+	}
+	// the work already handed out finishes, but nothing more is started
+	if w := atomic.LoadInt32(&worked); w > stopAt+1+workers+1 {
+		t.Fatalf("%d jobs ran after emit stopped at %d", w, stopAt)
+	}
+
+	// the feeder may still be returning when runOrdered does
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left running", runtime.NumGoroutine()-before)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestRunOrderedEdges(t *testing.T) {
+	var emitted []int
+	runOrdered(0, 4, func(i int) { t.Fatalf("work called for %d", i) }, func(i int) bool {
+		t.Fatalf("emit called for %d", i)
+		return true
+	})
+	// fewer than one worker still gets the work done
+	runOrdered(3, 0, func(i int) {}, func(i int) bool {
+		emitted = append(emitted, i)
+		return true
+	})
+	if len(emitted) != 3 {
+		t.Fatalf("emitted %v with no workers asked for, wanted 3", emitted)
+	}
+}
@@ -0,0 +1,314 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"sync"
+
+	"github.com/bgentry/speakeasy"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Private key PEM block types: PKCS#1, SEC1, and plain and encrypted PKCS#8.
+const (
+	pemRSAPrivateKey       = "RSA PRIVATE KEY"
+	pemECPrivateKey        = "EC PRIVATE KEY"
+	pemPrivateKey          = "PRIVATE KEY"
+	pemEncryptedPrivateKey = "ENCRYPTED PRIVATE KEY"
+)
+
+var errIncorrectPassphrase = errors.New("incorrect passphrase")
+
+// maxPBKDF2Iterations bounds the iteration count an encrypted key can ask
+// for, well above what anything writes, so a crafted key can't hang us.
+const maxPBKDF2Iterations = 10000000
+
+// privateKeyBlocks returns the private key blocks in raw, in any of the
+// forms we can parse.
+func privateKeyBlocks(raw []byte) []*pem.Block {
+	var ret []*pem.Block
+	for {
+		var blck *pem.Block
+		blck, raw = pem.Decode(raw)
+		if blck == nil {
+			return ret
+		}
+		switch blck.Type {
+		case pemRSAPrivateKey, pemECPrivateKey, pemPrivateKey, pemEncryptedPrivateKey:
+			ret = append(ret, blck)
+		}
+	}
+}
+
+// passphraseSource supplies the passphrase for encrypted keys, from an
+// environment variable if it's set, otherwise by prompting once.
+type passphraseSource struct {
+	env  string
+	once sync.Once
+	pass []byte
+	err  error
+}
+
+func (ps *passphraseSource) passphrase(what string) ([]byte, error) {
+	ps.once.Do(func() {
+		if ps.env != "" {
+			if v, ok := os.LookupEnv(ps.env); ok {
+				ps.pass = []byte(v)
+				return
+			}
+		}
+		var v string
+		v, ps.err = speakeasy.FAsk(os.Stderr, fmt.Sprintf("passphrase for %s: ", what))
+		if ps.err != nil {
+			ps.err = fmt.Errorf("error reading passphrase: %w", ps.err)
+		}
+		ps.pass = []byte(v)
+	})
+	return ps.pass, ps.err
+}
+
+// parsePrivateKey parses a key block, decrypting it first if need be.
+func parsePrivateKey(blck *pem.Block, what string, ps *passphraseSource) (crypto.Signer, error) {
+	der := blck.Bytes
+	decrypted := false
+	// Legacy OpenSSL encryption is deprecated as insecure, but keys
+	// encrypted that way are still around.
+	if x509.IsEncryptedPEMBlock(blck) {
+		pass, err := ps.passphrase(what)
+		if err != nil {
+			return nil, err
+		}
+		if der, err = x509.DecryptPEMBlock(blck, pass); err != nil {
+			return nil, fmt.Errorf("error decrypting key in %s: %w", what, errIncorrectPassphrase)
+		}
+		decrypted = true
+	}
+	var (
+		key interface{}
+		err error
+	)
+	switch blck.Type {
+	case pemRSAPrivateKey:
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case pemECPrivateKey:
+		key, err = x509.ParseECPrivateKey(der)
+	case pemEncryptedPrivateKey:
+		pass, perr := ps.passphrase(what)
+		if perr != nil {
+			return nil, perr
+		}
+		if der, err = decryptPKCS8(der, pass); err != nil {
+			return nil, fmt.Errorf("error decrypting key in %s: %w", what, err)
+		}
+		decrypted = true
+		fallthrough
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	}
+	if err != nil && decrypted {
+		// the wrong passphrase can still leave padding that checks out, but
+		// not a key that parses
+		return nil, fmt.Errorf("error decrypting key in %s: %w", what, errIncorrectPassphrase)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error parsing key in %s: %w", what, err)
+	}
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case *ecdsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T in %s", key, what)
+	}
+}
+
+// keyType names the algorithm of key.
+func keyType(key crypto.Signer) string {
+	switch key.(type) {
+	case *rsa.PrivateKey:
+		return "RSA"
+	case *ecdsa.PrivateKey:
+		return "ECDSA"
+	case ed25519.PrivateKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("%T", key)
+	}
+}
+
+// keyMatch is the result of comparing a private key with the leaf.
+type keyMatch struct {
+	// source is where the key came from
+	source  string
+	keyType string
+	matches bool
+	err     error
+	leaf    *x509.Certificate
+}
+
+func (km *keyMatch) String() string {
+	switch {
+	case km.err != nil:
+		return fmt.Sprintf("private key: %s", km.err)
+	case km.matches:
+		return fmt.Sprintf("private key: %s key in %s matches %s", km.keyType, km.source, km.leaf.Subject.CommonName)
+	default:
+		return fmt.Sprintf("key mismatch: %s key in %s does not match %s", km.keyType, km.source, km.leaf.Subject.CommonName)
+	}
+}
+
+// matchKey loads the first private key in raw and compares its public half
+// with leaf's.
+func matchKey(raw []byte, source string, leaf *x509.Certificate, ps *passphraseSource) *keyMatch {
+	km := &keyMatch{source: source, leaf: leaf}
+	blocks := privateKeyBlocks(raw)
+	if len(blocks) == 0 {
+		km.err = fmt.Errorf("no private key found in %s", source)
+		return km
+	}
+	key, err := parsePrivateKey(blocks[0], source, ps)
+	if err != nil {
+		km.err = err
+		return km
+	}
+	km.keyType = keyType(key)
+	pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool })
+	km.matches = ok && pub.Equal(leaf.PublicKey)
+	return km
+}
+
+// OIDs for PKCS#5 v2 password based encryption, as used by encrypted PKCS#8.
+var (
+	oidPBES2         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACWithSHA1  = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACWithSHA2s = map[string]func() hash.Hash{
+		"1.2.840.113549.2.8":  sha256.New224,
+		"1.2.840.113549.2.9":  sha256.New,
+		"1.2.840.113549.2.10": sha512.New384,
+		"1.2.840.113549.2.11": sha512.New,
+	}
+	oidDESEDE3CBC = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAESCBC     = map[string]int{
+		"2.16.840.1.101.3.4.1.2":  16,
+		"2.16.840.1.101.3.4.1.22": 24,
+		"2.16.840.1.101.3.4.1.42": 32,
+	}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algo          pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts an EncryptedPrivateKeyInfo using PBES2 with PBKDF2,
+// which is what OpenSSL and most everything else writes these days, and
+// returns the PKCS#8 PrivateKeyInfo inside.
+func decryptPKCS8(der []byte, pass []byte) ([]byte, error) {
+	var info encryptedPrivateKeyInfo
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("error parsing encrypted private key: %w", err)
+	}
+	if !info.Algo.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("unsupported key encryption %s, only PBES2 is supported", info.Algo.Algorithm)
+	}
+	var params pbes2Params
+	if _, err := asn1.Unmarshal(info.Algo.Parameters.FullBytes, &params); err != nil {
+		return nil, fmt.Errorf("error parsing PBES2 parameters: %w", err)
+	}
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("unsupported key derivation %s, only PBKDF2 is supported",
+			params.KeyDerivationFunc.Algorithm)
+	}
+	var kdf pbkdf2Params
+	if _, err := asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); err != nil {
+		return nil, fmt.Errorf("error parsing PBKDF2 parameters: %w", err)
+	}
+	if kdf.IterationCount <= 0 || kdf.IterationCount > maxPBKDF2Iterations {
+		return nil, fmt.Errorf("unsupported PBKDF2 iteration count %d", kdf.IterationCount)
+	}
+	prf := sha1.New
+	if len(kdf.PRF.Algorithm) > 0 && !kdf.PRF.Algorithm.Equal(oidHMACWithSHA1) {
+		var ok bool
+		if prf, ok = oidHMACWithSHA2s[kdf.PRF.Algorithm.String()]; !ok {
+			return nil, fmt.Errorf("unsupported PBKDF2 PRF %s", kdf.PRF.Algorithm)
+		}
+	}
+
+	var (
+		keyLen   int
+		newBlock func([]byte) (cipher.Block, error)
+	)
+	scheme := params.EncryptionScheme.Algorithm
+	if n, ok := oidAESCBC[scheme.String()]; ok {
+		keyLen, newBlock = n, aes.NewCipher
+	} else if scheme.Equal(oidDESEDE3CBC) {
+		keyLen, newBlock = 24, des.NewTripleDESCipher
+	} else {
+		return nil, fmt.Errorf("unsupported key cipher %s", scheme)
+	}
+	if kdf.KeyLength != 0 && kdf.KeyLength != keyLen {
+		return nil, fmt.Errorf("PBKDF2 key length %d doesn't suit cipher %s", kdf.KeyLength, scheme)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("error parsing cipher IV: %w", err)
+	}
+
+	block, err := newBlock(pbkdf2.Key(pass, kdf.Salt, kdf.IterationCount, keyLen, prf))
+	if err != nil {
+		return nil, err
+	}
+	data := info.EncryptedData
+	if len(iv) != block.BlockSize() || len(data) == 0 || len(data)%block.BlockSize() != 0 {
+		return nil, errors.New("malformed encrypted private key")
+	}
+	out := make([]byte, len(data))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(out, data)
+	return unpad(out, block.BlockSize())
+}
+
+// unpad strips PKCS#7 padding.  Bad padding almost always means the wrong
+// passphrase was used.
+func unpad(b []byte, blockSize int) ([]byte, error) {
+	n := int(b[len(b)-1])
+	if n == 0 || n > blockSize || n > len(b) {
+		return nil, errIncorrectPassphrase
+	}
+	if !bytes.Equal(b[len(b)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, errIncorrectPassphrase
+	}
+	return b[:len(b)-n], nil
+}
@@ -0,0 +1,346 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const testPassphraseEnv = "WHICHCA_TEST_KEY_PASSPHRASE"
+
+var (
+	oidHMACWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidHMACWithSHA512 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 11}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+// pbes2Spec describes how to encrypt a PKCS#8 key.  Zero fields take the
+// PBES2 and PBKDF2 defaults; the rest let tests ask for what isn't supported.
+type pbes2Spec struct {
+	scheme asn1.ObjectIdentifier
+	kdf    asn1.ObjectIdentifier
+	// prf is left out of the parameters when nil, which means SHA-1
+	prf        asn1.ObjectIdentifier
+	cipher     asn1.ObjectIdentifier
+	iterations int
+}
+
+// encryptPKCS8 wraps a PKCS#8 PrivateKeyInfo in an EncryptedPrivateKeyInfo
+// the way OpenSSL's pkcs8 -topk8 -v2 does.
+func encryptPKCS8(t *testing.T, der, pass []byte, spec pbes2Spec) []byte {
+	t.Helper()
+	if spec.scheme == nil {
+		spec.scheme = oidPBES2
+	}
+	if spec.kdf == nil {
+		spec.kdf = oidPBKDF2
+	}
+	if spec.iterations == 0 {
+		spec.iterations = 2048
+	}
+	prf := sha1.New
+	kdf := pbkdf2Params{Salt: []byte("saltsalt"), IterationCount: spec.iterations}
+	if spec.prf != nil {
+		kdf.PRF = pkix.AlgorithmIdentifier{Algorithm: spec.prf, Parameters: asn1.NullRawValue}
+		if h, ok := oidHMACWithSHA2s[spec.prf.String()]; ok {
+			prf = h
+		}
+	}
+	keyLen, newBlock := 16, aes.NewCipher
+	if n, ok := oidAESCBC[spec.cipher.String()]; ok {
+		keyLen = n
+	} else if spec.cipher.Equal(oidDESEDE3CBC) {
+		keyLen, newBlock = 24, des.NewTripleDESCipher
+	}
+	iterations := spec.iterations
+	if iterations <= 0 || iterations > maxPBKDF2Iterations {
+		// rejected before the key is derived, so don't spend the time
+		iterations = 1
+	}
+	block, err := newBlock(pbkdf2.Key(pass, kdf.Salt, iterations, keyLen, prf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	iv := bytes.Repeat([]byte{7}, block.BlockSize())
+	n := block.BlockSize() - len(der)%block.BlockSize()
+	data := append(append([]byte(nil), der...), bytes.Repeat([]byte{byte(n)}, n)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	rawValue := func(v interface{}) asn1.RawValue {
+		b, err := asn1.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return asn1.RawValue{FullBytes: b}
+	}
+	params := pbes2Params{
+		KeyDerivationFunc: pkix.AlgorithmIdentifier{Algorithm: spec.kdf, Parameters: rawValue(kdf)},
+		EncryptionScheme:  pkix.AlgorithmIdentifier{Algorithm: spec.cipher, Parameters: rawValue(iv)},
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: pemEncryptedPrivateKey,
+		Bytes: rawValue(encryptedPrivateKeyInfo{
+			Algo:          pkix.AlgorithmIdentifier{Algorithm: spec.scheme, Parameters: rawValue(params)},
+			EncryptedData: data,
+		}).FullBytes,
+	})
+}
+
+// certFor issues a certificate for key's public half.
+func certFor(t *testing.T, ca *testCA, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: keyType(key) + " leaf"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestMatchKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestCA(t, "Test CA", nil)
+	other, _ := ca.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "other leaf"}})
+
+	pass := []byte("correct horse")
+	pemOf := func(typ string, der []byte) []byte {
+		return pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	}
+	pkcs8 := func(key crypto.Signer) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return der
+	}
+	ecDER, err := x509.MarshalECPrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// EncryptPEMBlock is deprecated, but keys it wrote are still around
+	legacy, err := x509.EncryptPEMBlock(rand.Reader, pemRSAPrivateKey, x509.MarshalPKCS1PrivateKey(rsaKey),
+		pass, x509.PEMCipherAES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		key       crypto.Signer
+		raw       []byte
+		encrypted bool
+	}{
+		{name: "RSA PKCS#1", key: rsaKey, raw: pemOf(pemRSAPrivateKey, x509.MarshalPKCS1PrivateKey(rsaKey))},
+		{name: "ECDSA SEC1", key: ecKey, raw: pemOf(pemECPrivateKey, ecDER)},
+		{name: "RSA PKCS#8", key: rsaKey, raw: pemOf(pemPrivateKey, pkcs8(rsaKey))},
+		{name: "ECDSA PKCS#8", key: ecKey, raw: pemOf(pemPrivateKey, pkcs8(ecKey))},
+		{name: "Ed25519 PKCS#8", key: edKey, raw: pemOf(pemPrivateKey, pkcs8(edKey))},
+		{name: "legacy encrypted RSA PKCS#1", key: rsaKey, raw: pem.EncodeToMemory(legacy), encrypted: true},
+		{
+			name:      "PBES2 SHA-1 AES-128",
+			key:       ecKey,
+			raw:       encryptPKCS8(t, pkcs8(ecKey), pass, pbes2Spec{cipher: oidAES128CBC}),
+			encrypted: true,
+		},
+		{
+			name:      "PBES2 SHA-256 AES-256",
+			key:       rsaKey,
+			raw:       encryptPKCS8(t, pkcs8(rsaKey), pass, pbes2Spec{prf: oidHMACWithSHA256, cipher: oidAES256CBC}),
+			encrypted: true,
+		},
+		{
+			name:      "PBES2 SHA-256 3DES",
+			key:       edKey,
+			raw:       encryptPKCS8(t, pkcs8(edKey), pass, pbes2Spec{prf: oidHMACWithSHA256, cipher: oidDESEDE3CBC}),
+			encrypted: true,
+		},
+		{
+			name:      "PBES2 SHA-512 AES-192",
+			key:       ecKey,
+			raw:       encryptPKCS8(t, pkcs8(ecKey), pass, pbes2Spec{prf: oidHMACWithSHA512, cipher: oidAES192CBC}),
+			encrypted: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(testPassphraseEnv, string(pass))
+			leaf := certFor(t, ca, tt.key)
+			km := matchKey(tt.raw, "key.pem", leaf, &passphraseSource{env: testPassphraseEnv})
+			if km.err != nil {
+				t.Fatal(km.err)
+			}
+			if !km.matches {
+				t.Fatalf("%s doesn't match its own leaf", tt.name)
+			}
+			if km.keyType != keyType(tt.key) {
+				t.Fatalf("got key type %s, wanted %s", km.keyType, keyType(tt.key))
+			}
+
+			km = matchKey(tt.raw, "key.pem", other, &passphraseSource{env: testPassphraseEnv})
+			if km.err != nil {
+				t.Fatal(km.err)
+			}
+			if km.matches {
+				t.Fatalf("%s matches another leaf", tt.name)
+			}
+
+			if !tt.encrypted {
+				return
+			}
+			t.Setenv(testPassphraseEnv, "wrong horse")
+			km = matchKey(tt.raw, "key.pem", leaf, &passphraseSource{env: testPassphraseEnv})
+			if !errors.Is(km.err, errIncorrectPassphrase) {
+				t.Fatalf("got %v with the wrong passphrase, wanted %v", km.err, errIncorrectPassphrase)
+			}
+		})
+	}
+}
+
+func TestMatchKeyUnsupported(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := newTestCA(t, "Test CA", nil)
+	leaf := certFor(t, ca, ecKey)
+	pass := []byte("correct horse")
+	t.Setenv(testPassphraseEnv, string(pass))
+
+	tests := []struct {
+		name string
+		raw  []byte
+		want string
+	}{
+		{
+			name: "PBES1",
+			raw: encryptPKCS8(t, der, pass, pbes2Spec{
+				scheme: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 1, 3},
+				cipher: oidAES128CBC,
+			}),
+			want: "unsupported key encryption",
+		},
+		{
+			name: "scrypt",
+			raw: encryptPKCS8(t, der, pass, pbes2Spec{
+				kdf:    asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11},
+				cipher: oidAES128CBC,
+			}),
+			want: "unsupported key derivation",
+		},
+		{
+			name: "HMAC-MD5",
+			raw: encryptPKCS8(t, der, pass, pbes2Spec{
+				prf:    asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 5},
+				cipher: oidAES128CBC,
+			}),
+			want: "unsupported PBKDF2 PRF",
+		},
+		{
+			name: "DES-CBC",
+			raw:  encryptPKCS8(t, der, pass, pbes2Spec{cipher: asn1.ObjectIdentifier{1, 3, 14, 3, 2, 7}}),
+			want: "unsupported key cipher",
+		},
+		{
+			name: "negative iterations",
+			raw:  encryptPKCS8(t, der, pass, pbes2Spec{cipher: oidAES128CBC, iterations: -1}),
+			want: "unsupported PBKDF2 iteration count",
+		},
+		{
+			name: "too many iterations",
+			raw:  encryptPKCS8(t, der, pass, pbes2Spec{cipher: oidAES128CBC, iterations: maxPBKDF2Iterations + 1}),
+			want: "unsupported PBKDF2 iteration count",
+		},
+		{
+			name: "no key",
+			raw:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}),
+			want: "no private key found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			km := matchKey(tt.raw, "key.pem", leaf, &passphraseSource{env: testPassphraseEnv})
+			if km.err == nil || !strings.Contains(km.err.Error(), tt.want) {
+				t.Fatalf("got %v, wanted an error containing %q", km.err, tt.want)
+			}
+			if errors.Is(km.err, errIncorrectPassphrase) {
+				t.Fatalf("%s was blamed on the passphrase", tt.name)
+			}
+		})
+	}
+}
+
+func TestUnpad(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []byte
+		want []byte
+	}{
+		{name: "one byte", in: []byte{1, 2, 3, 1}, want: []byte{1, 2, 3}},
+		{name: "whole block", in: []byte{4, 4, 4, 4}, want: []byte{}},
+		{name: "zero", in: []byte{1, 2, 3, 0}},
+		{name: "longer than a block", in: []byte{1, 2, 3, 5}},
+		{name: "inconsistent", in: []byte{1, 2, 3, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unpad(tt.in, 4)
+			if tt.want == nil {
+				if !errors.Is(err, errIncorrectPassphrase) {
+					t.Fatalf("got %v, wanted %v", err, errIncorrectPassphrase)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Fatalf("got %x, wanted %x", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type PruneCmd struct {
+	hostports   stringparams
+	files       globparams
+	targetsFile string
+	cafile      string
+	contOnError bool
+	format      string
+	// out is where the pruned bundle goes, - for stdout
+	out         string
+	concurrency int
+	path        string
+	at          atparam
+	purpose     string
+	storeOptions
+	dialOptions
+	cacheOptions
+	*BaseCmd
+}
+
+func NewPruneCmd() *PruneCmd {
+	pc := &PruneCmd{
+		BaseCmd: &BaseCmd{},
+	}
+	pc.BaseCmd.Init("prune")
+	pc.f.SetOutput(pc.b)
+	pc.f.StringVar(&pc.cafile, "ca", "", "`path` to the ca bundle to prune")
+	pc.f.Var(&pc.hostports, "hp", "keep what `host:port` needs")
+	pc.f.Var(&pc.files, "p", "keep what the certificate files in `pathspec` need")
+	pc.f.StringVar(&pc.targetsFile, "targets", "", "read targets from `path`, one per line, or - for stdin")
+	pc.f.BoolVar(&pc.contOnError, "continue", false, "continue past targets that fail.  anything only "+
+		"they need is pruned")
+	pc.f.StringVar(&pc.format, "format", formatPEM, "output `format`, one of pem, der, p7b, p12, jks, "+
+		"json or ndjson")
+	pc.f.StringVar(&pc.out, "out", "-", "write the pruned bundle to `path`.  use - for stdout")
+	pc.f.IntVar(&pc.concurrency, "concurrency", 1, "process up to `N` targets at once")
+	pc.f.StringVar(&pc.path, "path", pathAll, "when more than one chain verifies, keep the roots for "+
+		"the `selection` of all of them, the shortest or the newest-root")
+	pc.f.Var(&pc.at, "at", "verify as of `time`, either RFC3339 or an offset from now like +30d")
+	pc.f.StringVar(&pc.purpose, "purpose", purposeServerAuth, "verify certificates for `purpose`, one of "+
+		"serverAuth, clientAuth, codeSigning, emailProtection or any")
+	pc.storeOptions.register(pc.f)
+	pc.cacheOptions.register(pc.f)
+	pc.cacheOptions.registerOffline(pc.f)
+	pc.dialOptions.register(pc.f)
+	return pc
+}
+
+func (pc *PruneCmd) Synopsis() string {
+	return "report which certificates in a CA bundle the given targets depend on, and write the bundle " +
+		"without the rest"
+}
+
+// Run verifies every target against the -ca bundle, reports which targets
+// depend on each certificate in it, and writes the bundle cut down to the
+// certificates some target depends on.
+func (pc *PruneCmd) Run(args []string) int {
+	err := pc.f.Parse(args)
+	if err != nil || pc.cafile == "" ||
+		(len(pc.files) == 0 && len(pc.hostports) == 0 && pc.targetsFile == "") {
+		return RunResultHelp
+	}
+	if err = pc.dialOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = pc.cacheOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validateFormat(pc.format, append(bundleFormats, formatJSON, formatNDJSON)...); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validatePathSelection(pc.path); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = validatePurpose(pc.purpose); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	if err = pc.storeOptions.validate(); err != nil {
+		log.Println(err)
+		return RunResultHelp
+	}
+	specs, err := loadTargetSpecs(pc.files, pc.hostports, pc.targetsFile)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	cas, pool, err := loadCABundle(pc.cafile)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	w, err := openOutput(pc.out)
+	if err != nil {
+		log.Println(err)
+		return 1
+	}
+	defer w.Close()
+	var rw *recordWriter
+	if isJSONFormat(pc.format) {
+		rw = newRecordWriter(w, pc.format)
+	}
+	kept := newMinBundle()
+	cv := newChainVerifier(pool, pc.timeout)
+	cv.now = pc.at.t
+	cv.keyUsages = purposeKeyUsages(pc.purpose)
+	cv.aia.cache = pc.cacheOptions.cache()
+	type outcome struct {
+		certs    []*x509.Certificate
+		err      error
+		started  time.Time
+		duration time.Duration
+	}
+	outcomes := make([]outcome, len(specs))
+	failed := 0
+	var writeErr error
+	runOrdered(len(specs), pc.concurrency, func(i int) {
+		o := &outcomes[i]
+		o.started = time.Now()
+		ctx, cancel := context.WithTimeout(context.Background(), pc.timeout)
+		defer cancel()
+		var (
+			served []*x509.Certificate
+			chains [][]*x509.Certificate
+		)
+		switch specs[i].kind {
+		case targetKindFile:
+			served, chains, o.err = verifyFile(ctx, specs[i].target, cv)
+		default:
+			var t *hostTarget
+			t, o.err = pc.specTarget(specs[i])
+			if o.err == nil {
+				served, chains, o.err = verifyAddr(ctx, t, cv)
+			}
+		}
+		if o.err == nil {
+			o.certs = bundleDependencies(served, selectChains(chains, pc.path), cas)
+		}
+		o.duration = time.Since(o.started)
+	}, func(i int) bool {
+		o := outcomes[i]
+		if rw != nil {
+			writeErr = rw.write(&pruneRecord{
+				SchemaVersion: jsonSchemaVersion,
+				Type:          "prune",
+				Target:        specs[i].target,
+				Kind:          specs[i].kind,
+				Tags:          specs[i].tags,
+				DependsOn:     certsJSON(o.certs, false),
+				Error:         errString(o.err),
+				StartedAt:     o.started.UTC(),
+				DurationMS:    o.duration.Milliseconds(),
+			})
+			if writeErr != nil {
+				return false
+			}
+		}
+		if o.err != nil {
+			log.Println(o.err)
+			failed++
+			return pc.contOnError
+		}
+		kept.add(specs[i].target, specs[i].tags, o.certs)
+		return true
+	})
+	if writeErr != nil {
+		log.Println(writeErr)
+		return 1
+	}
+	if failed > 0 && !pc.contOnError {
+		if rw != nil {
+			if err = rw.close(); err != nil {
+				log.Println(err)
+			}
+		}
+		return 1
+	}
+
+	usage := bundleUsage(cas, kept)
+	if rw != nil {
+		if err = rw.write(newCAUsageRecord(pc.cafile, usage)); err != nil {
+			log.Println(err)
+			return 1
+		}
+		if err = rw.close(); err != nil {
+			log.Println(err)
+			return 1
+		}
+		return 0
+	}
+	unusedRoots, unused := 0, 0
+	for _, u := range usage {
+		log.Println(u)
+		if len(u.neededBy) == 0 {
+			unused++
+			if u.root {
+				unusedRoots++
+			}
+		}
+	}
+	log.Printf("kept %d of %d certificates, pruned %d unused roots and %d other unused certificates",
+		len(usage)-unused, len(usage), unusedRoots, unused-unusedRoots)
+	if failed > 0 {
+		log.Printf("%d targets failed, so anything only they need was pruned too", failed)
+	}
+	if err = writeBundle(w, pc.format, kept.sorted(), &pc.storeOptions); err != nil {
+		log.Println(err)
+		return 1
+	}
+	if err = w.Close(); err != nil {
+		log.Println(err)
+		return 1
+	}
+	return 0
+}
+
+// bundleDependencies returns the certificates from cas that chains rely
+// on.  That's every anchor, and any other certificate in a chain that wasn't
+// served and so could only have come from cas.  Go stops a chain at the first
+// certificate it trusts, but other clients want a self-signed root, so an
+// anchor that isn't one brings along its issuers from cas too.
+func bundleDependencies(served []*x509.Certificate, chains [][]*x509.Certificate,
+	cas []*x509.Certificate) []*x509.Certificate {
+	inBundle := make(map[string]bool)
+	for _, cert := range cas {
+		inBundle[thumb(cert)] = true
+	}
+	wasServed := make(map[string]bool)
+	for _, cert := range served {
+		wasServed[thumb(cert)] = true
+	}
+	var ret []*x509.Certificate
+	seen := make(map[string]bool)
+	keep := func(cert *x509.Certificate) bool {
+		if seen[thumb(cert)] {
+			return false
+		}
+		seen[thumb(cert)] = true
+		ret = append(ret, cert)
+		return true
+	}
+	for _, chain := range chains {
+		for i, cert := range chain {
+			anchor := i == len(chain)-1
+			if inBundle[thumb(cert)] && (anchor || !wasServed[thumb(cert)]) {
+				keep(cert)
+			}
+		}
+		// todo is a copy, as appending to a subslice of chain would write
+		// over whatever shares its backing array
+		for todo := append([]*x509.Certificate(nil), chain[len(chain)-1:]...); len(todo) > 0; todo = todo[1:] {
+			cert := todo[0]
+			if bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+				continue
+			}
+			for _, issuer := range cas {
+				if bytes.Equal(issuer.RawSubject, cert.RawIssuer) && cert.CheckSignatureFrom(issuer) == nil &&
+					keep(issuer) {
+					todo = append(todo, issuer)
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// caUsage is a certificate in the bundle being pruned, with the targets
+// that depend on it.
+type caUsage struct {
+	*bundleEntry
+	root bool
+}
+
+func (u *caUsage) String() string {
+	if len(u.neededBy) > 0 {
+		return fmt.Sprintf("%s (%s): needed by %s", u.cert.Subject.CommonName, thumb(u.cert),
+			strings.Join(u.neededBy, ", "))
+	}
+	what := "unused"
+	if u.root {
+		what = "unused root"
+	}
+	return fmt.Sprintf("%s (%s): %s", u.cert.Subject.CommonName, thumb(u.cert), what)
+}
+
+// bundleUsage lists each certificate in cas once, in bundle order, with
+// what kept says depends on it.
+func bundleUsage(cas []*x509.Certificate, kept *minBundle) []*caUsage {
+	var ret []*caUsage
+	seen := make(map[string]bool)
+	for _, cert := range cas {
+		if seen[thumb(cert)] {
+			continue
+		}
+		seen[thumb(cert)] = true
+		be, ok := kept.entries[thumb(cert)]
+		if !ok {
+			be = &bundleEntry{cert: cert}
+		}
+		ret = append(ret, &caUsage{bundleEntry: be, root: bytes.Equal(cert.RawIssuer, cert.RawSubject)})
+	}
+	return ret
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"sort"
+	"testing"
+)
+
+func TestBundleDependencies(t *testing.T) {
+	root := newTestCA(t, "Test Root", nil)
+	intermediate := newTestCA(t, "Test Intermediate", root)
+	other := newTestCA(t, "Other Root", nil)
+	leaf, _ := intermediate.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+	cas := []*x509.Certificate{root.cert, intermediate.cert, other.cert}
+
+	names := func(certs []*x509.Certificate) []string {
+		var ret []string
+		for _, cert := range certs {
+			ret = append(ret, cert.Subject.CommonName)
+		}
+		sort.Strings(ret)
+		return ret
+	}
+	tests := []struct {
+		name   string
+		served []*x509.Certificate
+		chains [][]*x509.Certificate
+		want   []string
+	}{
+		{
+			name:   "intermediate from the bundle",
+			served: []*x509.Certificate{leaf},
+			chains: [][]*x509.Certificate{{leaf, intermediate.cert, root.cert}},
+			want:   []string{"Test Intermediate", "Test Root"},
+		},
+		{
+			name:   "intermediate served",
+			served: []*x509.Certificate{leaf, intermediate.cert},
+			chains: [][]*x509.Certificate{{leaf, intermediate.cert, root.cert}},
+			want:   []string{"Test Root"},
+		},
+		{
+			name:   "intermediate anchor keeps its root",
+			served: []*x509.Certificate{leaf},
+			chains: [][]*x509.Certificate{{leaf, intermediate.cert}},
+			want:   []string{"Test Intermediate", "Test Root"},
+		},
+		{
+			name:   "every chain counts",
+			served: []*x509.Certificate{leaf, intermediate.cert},
+			chains: [][]*x509.Certificate{{leaf, intermediate.cert, root.cert}, {leaf, intermediate.cert}},
+			want:   []string{"Test Intermediate", "Test Root"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := names(bundleDependencies(tt.served, tt.chains, cas))
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, wanted %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Fatalf("got %v, wanted %v", got, tt.want)
+				}
+			}
+		})
+	}
+
+	t.Run("leaves chains alone", func(t *testing.T) {
+		// a chain with room to grow in its backing array, as Verify can
+		// return
+		backing := []*x509.Certificate{leaf, intermediate.cert, other.cert}
+		chain := backing[:2]
+		bundleDependencies([]*x509.Certificate{leaf}, [][]*x509.Certificate{chain}, cas)
+		if backing[2] != other.cert {
+			t.Fatalf("bundleDependencies overwrote a chain's backing array with %s",
+				backing[2].Subject.CommonName)
+		}
+	})
+}
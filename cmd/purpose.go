@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const purposeServerAuth = "serverAuth"
+
+// purposes maps -purpose names to the extended key usage they verify for.
+var purposes = map[string]x509.ExtKeyUsage{
+	purposeServerAuth: x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"any":             x509.ExtKeyUsageAny,
+}
+
+func validatePurpose(purpose string) error {
+	if _, ok := purposes[purpose]; ok {
+		return nil
+	}
+	names := make([]string, 0, len(purposes))
+	for name := range purposes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Errorf("unsupported purpose %q, must be one of: %s", purpose, strings.Join(names, ", "))
+}
+
+func purposeKeyUsages(purpose string) []x509.ExtKeyUsage {
+	if eku, ok := purposes[purpose]; ok {
+		return []x509.ExtKeyUsage{eku}
+	}
+	return nil
+}
+
+var ekuNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "serverAuth",
+	x509.ExtKeyUsageClientAuth:      "clientAuth",
+	x509.ExtKeyUsageCodeSigning:     "codeSigning",
+	x509.ExtKeyUsageEmailProtection: "emailProtection",
+	x509.ExtKeyUsageTimeStamping:    "timeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+// ekuString lists the extended key usages in cert.
+func ekuString(cert *x509.Certificate) string {
+	var names []string
+	for _, eku := range cert.ExtKeyUsage {
+		if name, ok := ekuNames[eku]; ok {
+			names = append(names, name)
+		} else {
+			names = append(names, fmt.Sprintf("eku(%d)", int(eku)))
+		}
+	}
+	for _, oid := range cert.UnknownExtKeyUsage {
+		names = append(names, oid.String())
+	}
+	return strings.Join(names, ", ")
+}
+
+// allowsUsage reports whether cert's extended key usages, if it has any,
+// permit usage.
+func allowsUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	if len(cert.ExtKeyUsage) == 0 && len(cert.UnknownExtKeyUsage) == 0 {
+		return true
+	}
+	if usage == x509.ExtKeyUsageAny {
+		return true
+	}
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageAny || eku == usage {
+			return true
+		}
+	}
+	return false
+}
+
+// explainUsage adds to an incompatible usage error from verifying cert with
+// opts which certificate's extended key usages got in the way.  Any other
+// error is returned as is.
+func explainUsage(err error, cert *x509.Certificate, opts x509.VerifyOptions) error {
+	var cie x509.CertificateInvalidError
+	if !errors.As(err, &cie) || cie.Reason != x509.IncompatibleUsage || len(opts.KeyUsages) == 0 {
+		return err
+	}
+	usage := opts.KeyUsages[0]
+	opts.KeyUsages = []x509.ExtKeyUsage{x509.ExtKeyUsageAny}
+	chains, verr := cert.Verify(opts)
+	if verr != nil {
+		return err
+	}
+	for _, chain := range chains {
+		for i, c := range chain {
+			if !allowsUsage(c, usage) {
+				return fmt.Errorf("%w: the %s %s does not allow %s, only %s",
+					err, chainRole(chain, i), c.Subject.CommonName, ekuNames[usage], ekuString(c))
+			}
+		}
+	}
+	return err
+}
+
+func isIncompatibleUsage(err error) bool {
+	var cie x509.CertificateInvalidError
+	return errors.As(err, &cie) && cie.Reason == x509.IncompatibleUsage
+}
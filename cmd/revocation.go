@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	revocationOCSP = "ocsp"
+	revocationCRL  = "crl"
+)
+
+const (
+	revocationGood    = "good"
+	revocationRevoked = "revoked"
+	revocationUnknown = "unknown"
+)
+
+// revocationparams is a comma separated list of revocation methods.
+type revocationparams []string
+
+func (rp *revocationparams) Set(v string) error {
+	for _, m := range strings.Split(v, ",") {
+		switch m {
+		case revocationOCSP, revocationCRL:
+			*rp = append(*rp, m)
+		default:
+			return fmt.Errorf("unsupported revocation method %q, must be %s or %s",
+				m, revocationOCSP, revocationCRL)
+		}
+	}
+	return nil
+}
+
+func (rp *revocationparams) String() string {
+	return strings.Join(*rp, ",")
+}
+
+// revocationStatus is the revocation status of a single certificate in a
+// chain, as reported by one method.
+type revocationStatus struct {
+	cert   *x509.Certificate
+	role   string
+	method string
+	// source is where the status came from, such as the OCSP responder URL.
+	source     string
+	status     string
+	thisUpdate time.Time
+	nextUpdate time.Time
+	revokedAt  time.Time
+	reason     int
+	// err is set when no trustworthy answer could be had, in which case
+	// status is unknown.
+	err error
+}
+
+func (rs *revocationStatus) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "revocation (%s) for %s %s: %s", rs.method, rs.role, rs.cert.Subject.CommonName, rs.status)
+	if rs.err != nil {
+		fmt.Fprintf(&b, ": %s", rs.err)
+		return b.String()
+	}
+	if rs.status == revocationRevoked {
+		fmt.Fprintf(&b, " at %s, reason %d", rs.revokedAt.Format(time.RFC3339), rs.reason)
+	}
+	fmt.Fprintf(&b, " (this update %s", rs.thisUpdate.Format(time.RFC3339))
+	if !rs.nextUpdate.IsZero() {
+		fmt.Fprintf(&b, ", next update %s", rs.nextUpdate.Format(time.RFC3339))
+	}
+	b.WriteString(")")
+	return b.String()
+}
+
+// checkRevocation checks every certificate in chain but the root against
+// each of methods.
+func (cv *chainVerifier) checkRevocation(ctx context.Context, chain []*x509.Certificate, methods []string) []*revocationStatus {
+	var ret []*revocationStatus
+	for i := 0; i < len(chain)-1; i++ {
+		for _, method := range methods {
+			var rs *revocationStatus
+			switch method {
+			case revocationOCSP:
+				rs = cv.checkOCSP(ctx, chain[i], chain[i+1])
+			case revocationCRL:
+				rs = cv.checkCRL(ctx, chain[i], chain[i+1])
+			default:
+				continue
+			}
+			rs.role = chainRole(chain, i)
+			ret = append(ret, rs)
+		}
+	}
+	return ret
+}
+
+var errNoOCSPServer = errors.New("no OCSP responder URL")
+
+func (cv *chainVerifier) checkOCSP(ctx context.Context, cert, issuer *x509.Certificate) *revocationStatus {
+	rs := &revocationStatus{
+		cert:   cert,
+		method: revocationOCSP,
+		status: revocationUnknown,
+	}
+	if len(cert.OCSPServer) == 0 {
+		rs.err = errNoOCSPServer
+		return rs
+	}
+	rs.source = cert.OCSPServer[0]
+	raw, err := cv.queryOCSP(ctx, rs.source, cert, issuer)
+	if err != nil {
+		rs.err = err
+		return rs
+	}
+	resp, err := parseOCSPResponse(raw, cert, issuer, cv.time())
+	if err != nil {
+		rs.err = err
+		return rs
+	}
+	rs.setOCSP(resp)
+	return rs
+}
+
+func (rs *revocationStatus) setOCSP(resp *ocsp.Response) {
+	rs.thisUpdate = resp.ThisUpdate
+	rs.nextUpdate = resp.NextUpdate
+	switch resp.Status {
+	case ocsp.Good:
+		rs.status = revocationGood
+	case ocsp.Revoked:
+		rs.status = revocationRevoked
+		rs.revokedAt = resp.RevokedAt
+		rs.reason = resp.RevocationReason
+	default:
+		rs.status = revocationUnknown
+	}
+}
+
+func (cv *chainVerifier) queryOCSP(ctx context.Context, url string, cert, issuer *x509.Certificate) ([]byte, error) {
+	ocspReq, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating OCSP request: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(ocspReq))
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for url %s: %w", url, err)
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+	req.Header.Set("Accept", "application/ocsp-response")
+	resp, err := cv.aia.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error querying OCSP responder %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OCSP responder %s returned %s", url, resp.Status)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("error reading response from OCSP responder %s: %w", url, err)
+	}
+	return raw, nil
+}
+
+// ocspSkew is how far we'll tolerate the responder's clock being ahead.
+const ocspSkew = 5 * time.Minute
+
+// parseOCSPResponse parses an OCSP response for cert, and checks it was
+// signed by issuer or by a responder issuer has authorized, and that it's
+// current as of now.
+func parseOCSPResponse(raw []byte, cert, issuer *x509.Certificate, now time.Time) (*ocsp.Response, error) {
+	resp, err := verifyOCSPResponse(raw, cert, issuer, now)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkOCSPFreshness(resp, now); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// verifyOCSPResponse is parseOCSPResponse without the check that the
+// response is current.
+func verifyOCSPResponse(raw []byte, cert, issuer *x509.Certificate, now time.Time) (*ocsp.Response, error) {
+	// Signature checks are done here rather than by passing issuer along,
+	// as the ocsp package would insist that a response signed by the issuer
+	// and carrying the issuer's certificate be self-signed.
+	resp, err := ocsp.ParseResponseForCert(raw, cert, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing OCSP response: %w", err)
+	}
+	if resp.Certificate == nil || bytes.Equal(resp.Certificate.Raw, issuer.Raw) {
+		if err = resp.CheckSignatureFrom(issuer); err != nil {
+			return nil, fmt.Errorf("bad OCSP response signature: %w", err)
+		}
+	} else {
+		responder := resp.Certificate
+		if err = responder.CheckSignatureFrom(issuer); err != nil {
+			return nil, fmt.Errorf("OCSP responder %s was not issued by %s: %w",
+				responder.Subject.CommonName, issuer.Subject.CommonName, err)
+		}
+		authorized := false
+		for _, eku := range responder.ExtKeyUsage {
+			if eku == x509.ExtKeyUsageOCSPSigning {
+				authorized = true
+				break
+			}
+		}
+		if !authorized {
+			return nil, fmt.Errorf("OCSP responder %s is not authorized for OCSP signing",
+				responder.Subject.CommonName)
+		}
+		if now.Before(responder.NotBefore) || now.After(responder.NotAfter) {
+			return nil, fmt.Errorf("OCSP responder certificate %s is not valid at %s",
+				responder.Subject.CommonName, now.Format(time.RFC3339))
+		}
+	}
+	return resp, nil
+}
+
+func checkOCSPFreshness(resp *ocsp.Response, now time.Time) error {
+	if resp.ThisUpdate.After(now.Add(ocspSkew)) {
+		return fmt.Errorf("OCSP response is not valid until %s", resp.ThisUpdate.Format(time.RFC3339))
+	}
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now) {
+		return fmt.Errorf("OCSP response is stale, next update was %s", resp.NextUpdate.Format(time.RFC3339))
+	}
+	return nil
+}
+
+var errNoCRLDistributionPoint = errors.New("no usable CRL distribution point")
+
+// checkCRL looks cert up in the CRL from the first of its distribution
+// points that can be fetched and was signed by issuer.  A CRL that can't be
+// fetched, or that comes from the wrong issuer or has a bad signature, moves
+// on to the next distribution point, and the last such error is reported if
+// none work.
+func (cv *chainVerifier) checkCRL(ctx context.Context, cert, issuer *x509.Certificate) *revocationStatus {
+	rs := &revocationStatus{
+		cert:   cert,
+		method: revocationCRL,
+		status: revocationUnknown,
+		err:    errNoCRLDistributionPoint,
+	}
+	now := cv.time()
+	for _, dp := range cert.CRLDistributionPoints {
+		if !strings.HasPrefix(dp, "http://") && !strings.HasPrefix(dp, "https://") &&
+			!strings.HasPrefix(dp, "file://") {
+			continue
+		}
+		rs.source = dp
+		// the cached copy is refreshed by the clock, not -at, as a fresher
+		// one can't be had for another time
+		crl, err := cv.crls.fetch(ctx, dp, time.Now())
+		if err != nil {
+			rs.err = err
+			continue
+		}
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+			rs.err = fmt.Errorf("CRL from %s was issued by %s, not %s", dp, crl.Issuer, issuer.Subject)
+			continue
+		}
+		if err = crl.CheckSignatureFrom(issuer); err != nil {
+			rs.err = fmt.Errorf("bad signature on CRL from %s: %w", dp, err)
+			continue
+		}
+		rs.err = nil
+		rs.thisUpdate = crl.ThisUpdate
+		rs.nextUpdate = crl.NextUpdate
+		for _, rc := range crl.RevokedCertificateEntries {
+			if rc.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+				rs.status = revocationRevoked
+				rs.revokedAt = rc.RevocationTime
+				rs.reason = rc.ReasonCode
+				return rs
+			}
+		}
+		if !crl.NextUpdate.IsZero() && crl.NextUpdate.Before(now) {
+			rs.err = fmt.Errorf("CRL from %s is stale, next update was %s", dp, crl.NextUpdate.Format(time.RFC3339))
+			return rs
+		}
+		rs.status = revocationGood
+		return rs
+	}
+	return rs
+}
+
+// crlCache holds downloaded CRLs until their next update, so targets that
+// share an issuer only download its CRL once.
+type crlCache struct {
+	client  *http.Client
+	mu      sync.Mutex
+	entries map[string]*crlEntry
+}
+
+type crlEntry struct {
+	done chan struct{}
+	crl  *x509.RevocationList
+	err  error
+}
+
+func newCRLCache(client *http.Client) *crlCache {
+	return &crlCache{
+		client:  client,
+		entries: make(map[string]*crlEntry),
+	}
+}
+
+func (cc *crlCache) fetch(ctx context.Context, url string, now time.Time) (*x509.RevocationList, error) {
+	cc.mu.Lock()
+	e, ok := cc.entries[url]
+	if ok {
+		select {
+		case <-e.done:
+			if e.crl != nil && !e.crl.NextUpdate.IsZero() && e.crl.NextUpdate.Before(now) {
+				// past its next update, so try for a fresh one
+				ok = false
+			}
+		default:
+		}
+	}
+	if !ok {
+		e = &crlEntry{done: make(chan struct{})}
+		cc.entries[url] = e
+	}
+	cc.mu.Unlock()
+	if ok {
+		select {
+		case <-e.done:
+			return e.crl, e.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	e.crl, e.err = cc.download(ctx, url)
+	if e.err != nil && ctx.Err() != nil {
+		cc.mu.Lock()
+		delete(cc.entries, url)
+		cc.mu.Unlock()
+	}
+	close(e.done)
+	return e.crl, e.err
+}
+
+func (cc *crlCache) download(ctx context.Context, url string) (*x509.RevocationList, error) {
+	var raw []byte
+	if strings.HasPrefix(url, "file://") {
+		var err error
+		raw, err = ioutil.ReadFile(strings.TrimPrefix(url, "file://"))
+		if err != nil {
+			return nil, fmt.Errorf("error reading CRL %s: %w", url, err)
+		}
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("error creating request for url %s: %w", url, err)
+		}
+		resp, err := cc.client.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching CRL %s: %w", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("error fetching CRL %s: %s", url, resp.Status)
+		}
+		raw, err = ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CRL %s: %w", url, err)
+		}
+	}
+	if der := decodePemsByType(raw, "X509 CRL"); len(der) > 0 {
+		raw = der
+	}
+	crl, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing CRL %s: %w", url, err)
+	}
+	return crl, nil
+}
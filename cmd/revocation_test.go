@@ -0,0 +1,301 @@
+package cmd
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+func TestParseOCSPResponse(t *testing.T) {
+	now := time.Now()
+	root := newTestCA(t, "Test Root", nil)
+	issuer := newTestCA(t, "Test Issuing CA", root)
+	other := newTestCA(t, "Other CA", nil)
+	leaf, _ := issuer.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+	responder := func(ca *testCA, tmpl *x509.Certificate) *testCA {
+		if tmpl.Subject.CommonName == "" {
+			tmpl.Subject.CommonName = "Test OCSP Responder"
+		}
+		cert, key := ca.issue(t, tmpl)
+		return &testCA{cert: cert, key: key}
+	}
+	delegated := responder(issuer, &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}})
+	noEKU := responder(issuer, &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}})
+	foreign := responder(other, &x509.Certificate{ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}})
+	expired := responder(issuer, &x509.Certificate{
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning},
+		NotBefore:   now.Add(-48 * time.Hour),
+		NotAfter:    now.Add(-24 * time.Hour),
+	})
+
+	// respond signs a response about leaf with signer, embedding signer's
+	// certificate when embed is set.
+	respond := func(signer *testCA, embed bool, tmpl ocsp.Response) []byte {
+		if tmpl.SerialNumber == nil {
+			tmpl.SerialNumber = leaf.SerialNumber
+		}
+		if tmpl.ThisUpdate.IsZero() {
+			tmpl.ThisUpdate = now.Add(-time.Hour)
+		}
+		if tmpl.NextUpdate.IsZero() {
+			tmpl.NextUpdate = now.Add(time.Hour)
+		}
+		if embed {
+			tmpl.Certificate = signer.cert
+		}
+		raw, err := ocsp.CreateResponse(issuer.cert, signer.cert, tmpl, signer.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	tests := []struct {
+		name       string
+		raw        []byte
+		wantStatus int
+		// wantErr is empty when the response should be accepted, otherwise
+		// what the error should contain
+		wantErr string
+	}{
+		{
+			name:       "signed by the issuer",
+			raw:        respond(issuer, false, ocsp.Response{Status: ocsp.Good}),
+			wantStatus: ocsp.Good,
+		},
+		{
+			name:       "signed by the issuer, with its certificate",
+			raw:        respond(issuer, true, ocsp.Response{Status: ocsp.Good}),
+			wantStatus: ocsp.Good,
+		},
+		{
+			name: "revoked",
+			raw: respond(issuer, false, ocsp.Response{
+				Status:           ocsp.Revoked,
+				RevokedAt:        now.Add(-2 * time.Hour),
+				RevocationReason: ocsp.KeyCompromise,
+			}),
+			wantStatus: ocsp.Revoked,
+		},
+		{
+			name:       "delegated responder",
+			raw:        respond(delegated, true, ocsp.Response{Status: ocsp.Good}),
+			wantStatus: ocsp.Good,
+		},
+		{
+			name:    "delegated responder without the OCSP signing eku",
+			raw:     respond(noEKU, true, ocsp.Response{Status: ocsp.Good}),
+			wantErr: "is not authorized for OCSP signing",
+		},
+		{
+			name:    "delegated responder from another ca",
+			raw:     respond(foreign, true, ocsp.Response{Status: ocsp.Good}),
+			wantErr: "was not issued by Test Issuing CA",
+		},
+		{
+			name:    "expired delegated responder",
+			raw:     respond(expired, true, ocsp.Response{Status: ocsp.Good}),
+			wantErr: "is not valid at",
+		},
+		{
+			name:    "signed by another ca",
+			raw:     respond(other, false, ocsp.Response{Status: ocsp.Good}),
+			wantErr: "bad OCSP response signature",
+		},
+		{
+			name: "stale",
+			raw: respond(issuer, false, ocsp.Response{
+				Status:     ocsp.Good,
+				ThisUpdate: now.Add(-48 * time.Hour),
+				NextUpdate: now.Add(-24 * time.Hour),
+			}),
+			wantErr: "OCSP response is stale",
+		},
+		{
+			name: "not yet valid",
+			raw: respond(issuer, false, ocsp.Response{
+				Status:     ocsp.Good,
+				ThisUpdate: now.Add(time.Hour),
+				NextUpdate: now.Add(2 * time.Hour),
+			}),
+			wantErr: "OCSP response is not valid until",
+		},
+		{
+			name: "within the clock skew",
+			raw: respond(issuer, false, ocsp.Response{
+				Status:     ocsp.Good,
+				ThisUpdate: now.Add(ocspSkew / 2),
+			}),
+			wantStatus: ocsp.Good,
+		},
+		{
+			name:    "for another certificate",
+			raw:     respond(issuer, false, ocsp.Response{Status: ocsp.Good, SerialNumber: big.NewInt(-1)}),
+			wantErr: "error parsing OCSP response",
+		},
+		{
+			name:    "garbage",
+			raw:     []byte("not an OCSP response"),
+			wantErr: "error parsing OCSP response",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := parseOCSPResponse(tt.raw, leaf, issuer.cert, now)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, wanted one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if resp.Status != tt.wantStatus {
+				t.Fatalf("got status %d, wanted %d", resp.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCheckCRL(t *testing.T) {
+	now := time.Now()
+	dir := t.TempDir()
+	root := newTestCA(t, "Test Root", nil)
+	issuer := newTestCA(t, "Test Issuing CA", root)
+	// impostor has the same name as issuer, but not its key
+	impostor := newTestCA(t, "Test Issuing CA", root)
+	other := newTestCA(t, "Other CA", nil)
+	leaf, _ := issuer.issue(t, &x509.Certificate{Subject: pkix.Name{CommonName: "leaf"}})
+
+	n := 0
+	// writeCRL writes a CRL signed by signer, revoking revoked, and returns
+	// its file:// URL.
+	writeCRL := func(signer *testCA, nextUpdate time.Time, revoked ...*big.Int) string {
+		n++
+		tmpl := &x509.RevocationList{
+			Number:     big.NewInt(int64(n)),
+			ThisUpdate: now.Add(-time.Hour),
+			NextUpdate: nextUpdate,
+		}
+		for _, serial := range revoked {
+			tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+				x509.RevocationListEntry{SerialNumber: serial, RevocationTime: now.Add(-2 * time.Hour)})
+		}
+		der, err := x509.CreateRevocationList(rand.Reader, tmpl, signer.cert, signer.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, fmt.Sprintf("%d.crl", n))
+		if err = os.WriteFile(path, der, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return "file://" + path
+	}
+	fresh := now.Add(24 * time.Hour)
+	good := writeCRL(issuer, fresh, big.NewInt(-1))
+	revoked := writeCRL(issuer, fresh, leaf.SerialNumber)
+	stale := writeCRL(issuer, now.Add(-time.Minute))
+	wrongIssuer := writeCRL(other, fresh, leaf.SerialNumber)
+	badSignature := writeCRL(impostor, fresh, leaf.SerialNumber)
+	missing := "file://" + filepath.Join(dir, "missing.crl")
+
+	tests := []struct {
+		name       string
+		dps        []string
+		wantStatus string
+		// wantErr is empty when the status should be trustworthy, otherwise
+		// what the error should contain
+		wantErr string
+	}{
+		{
+			name:       "good",
+			dps:        []string{good},
+			wantStatus: revocationGood,
+		},
+		{
+			name:       "revoked",
+			dps:        []string{revoked},
+			wantStatus: revocationRevoked,
+		},
+		{
+			name:       "stale",
+			dps:        []string{stale},
+			wantStatus: revocationUnknown,
+			wantErr:    "is stale",
+		},
+		{
+			name:       "no distribution points",
+			wantStatus: revocationUnknown,
+			wantErr:    errNoCRLDistributionPoint.Error(),
+		},
+		{
+			name:       "unsupported scheme",
+			dps:        []string{"ldap://ldap.example.com/cn=Test%20Issuing%20CA"},
+			wantStatus: revocationUnknown,
+			wantErr:    errNoCRLDistributionPoint.Error(),
+		},
+		{
+			name:       "wrong issuer",
+			dps:        []string{wrongIssuer},
+			wantStatus: revocationUnknown,
+			wantErr:    "was issued by CN=Other CA",
+		},
+		{
+			name:       "bad signature",
+			dps:        []string{badSignature},
+			wantStatus: revocationUnknown,
+			wantErr:    "bad signature on CRL",
+		},
+		{
+			name:       "falls through a fetch failure",
+			dps:        []string{missing, revoked},
+			wantStatus: revocationRevoked,
+		},
+		{
+			name:       "falls through the wrong issuer",
+			dps:        []string{wrongIssuer, good},
+			wantStatus: revocationGood,
+		},
+		{
+			name:       "falls through a bad signature",
+			dps:        []string{badSignature, good},
+			wantStatus: revocationGood,
+		},
+		{
+			name:       "reports the last failure",
+			dps:        []string{missing, badSignature},
+			wantStatus: revocationUnknown,
+			wantErr:    "bad signature on CRL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert := *leaf
+			cert.CRLDistributionPoints = tt.dps
+			cv := newChainVerifier(nil, time.Second)
+			rs := cv.checkCRL(context.Background(), &cert, issuer.cert)
+			if rs.status != tt.wantStatus {
+				t.Errorf("got status %s, wanted %s", rs.status, tt.wantStatus)
+			}
+			if tt.wantErr == "" {
+				if rs.err != nil {
+					t.Fatalf("unexpected error: %v", rs.err)
+				}
+				return
+			}
+			if rs.err == nil || !strings.Contains(rs.err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, wanted one containing %q", rs.err, tt.wantErr)
+			}
+		})
+	}
+}
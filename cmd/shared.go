@@ -1,8 +1,10 @@
 package cmd
 
 import (
+	"context"
 	"crypto/ecdsa"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/csv"
 	"encoding/pem"
@@ -11,9 +13,11 @@ import (
 	"io"
 	"io/ioutil"
 	golog "log"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -52,6 +56,16 @@ func writeCert(w io.Writer, cert *x509.Certificate) error {
 	})
 }
 
+// certNames returns the DNS and IP subject alternative names in cert.
+func certNames(cert *x509.Certificate) []string {
+	names := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses))
+	names = append(names, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
 func writeCertCSVHeader(w *csv.Writer) error {
 	var rec = []string{
 		"CN",
@@ -91,7 +105,103 @@ func writeCertCSV(w *csv.Writer, cert *x509.Certificate) error {
 	return w.Write(rec)
 }
 
-func verifyChains(certs []*x509.Certificate, ca *x509.CertPool) (chains [][]*x509.Certificate, dledIntermediates []*x509.Certificate, err error) {
+// fetchPeerCertificates connects to the target, negotiating STARTTLS first if
+// requested, and returns the certificates presented by the server during the
+// handshake.  No verification is done here.
+func fetchPeerCertificates(ctx context.Context, t *hostTarget) ([]*x509.Certificate, error) {
+	state, err := fetchConnectionState(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	return state.PeerCertificates, nil
+}
+
+// fetchConnectionState completes a handshake with t, and returns the state
+// of the connection, which always has at least one peer certificate.
+func fetchConnectionState(ctx context.Context, t *hostTarget) (*tls.ConnectionState, error) {
+	return handshake(ctx, t, &tls.Config{})
+}
+
+// handshake is fetchConnectionState with the client's protocol versions and
+// cipher suites taken from cfg.
+func handshake(ctx context.Context, t *hostTarget, cfg *tls.Config) (*tls.ConnectionState, error) {
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", t.dialAddr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if t.starttls != "" {
+		upgrade, ok := starttlsProtos[t.starttls]
+		if !ok {
+			return nil, validateStarttls(t.starttls)
+		}
+		if err = upgrade(conn, t.serverName); err != nil {
+			return nil, fmt.Errorf("%s starttls negotiation failed: %w", t.starttls, err)
+		}
+	}
+	cfg = cfg.Clone()
+	cfg.ServerName = t.serverName
+	// Manually verify certs, catch case where intermediates are missing
+	// and download them.
+	cfg.InsecureSkipVerify = true
+	tconn := tls.Client(conn, cfg)
+	if err = tconn.Handshake(); err != nil {
+		return nil, err
+	}
+	state := tconn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, fmt.Errorf("no certificates returned from %s", t)
+	}
+	return &state, nil
+}
+
+// chainVerifier builds and verifies chains against a set of roots, chasing
+// AIA issuer URLs for any intermediates the chain is missing.
+type chainVerifier struct {
+	roots *x509.CertPool
+	aia   *aiaFetcher
+	crls  *crlCache
+	// now is the time to verify as of, zero for the current time.
+	now time.Time
+	// keyUsages is the purpose to verify for, nil for server auth.
+	keyUsages []x509.ExtKeyUsage
+}
+
+func newChainVerifier(roots *x509.CertPool, timeout time.Duration) *chainVerifier {
+	aia := newAIAFetcher(timeout)
+	return &chainVerifier{
+		roots: roots,
+		aia:   aia,
+		crls:  newCRLCache(aia.client),
+	}
+}
+
+// withRoots returns a verifier for roots that shares cv's downloads.
+func (cv *chainVerifier) withRoots(roots *x509.CertPool) *chainVerifier {
+	return &chainVerifier{
+		roots:     roots,
+		aia:       cv.aia,
+		crls:      cv.crls,
+		now:       cv.now,
+		keyUsages: cv.keyUsages,
+	}
+}
+
+// verifyOptions returns the options cv verifies with, as of its time and for
+// its key usages.
+func (cv *chainVerifier) verifyOptions(intermediates *x509.CertPool) x509.VerifyOptions {
+	return x509.VerifyOptions{
+		Intermediates: intermediates,
+		Roots:         cv.roots,
+		CurrentTime:   cv.now,
+		KeyUsages:     cv.keyUsages,
+	}
+}
+
+func (cv *chainVerifier) verifyChains(ctx context.Context, certs []*x509.Certificate) (chains [][]*x509.Certificate, dledIntermediates []*x509.Certificate, err error) {
 
 	cp := x509.NewCertPool()
 	if len(certs) > 1 {
@@ -99,24 +209,24 @@ func verifyChains(certs []*x509.Certificate, ca *x509.CertPool) (chains [][]*x50
 			cp.AddCert(cert)
 		}
 	}
-	chains, err = certs[0].Verify(x509.VerifyOptions{
-		Intermediates: cp,
-		Roots:         ca,
-	})
+	opts := cv.verifyOptions(cp)
+	chains, err = certs[0].Verify(opts)
+	if isIncompatibleUsage(err) {
+		// the chain is there, fetching more won't help
+		return nil, nil, explainUsage(err, certs[0], opts)
+	}
 	if err != nil {
-		dledIntermediates, err = fetchIntermediates(certs[len(certs)-1], ca)
+		dledIntermediates, err = cv.fetchIntermediates(ctx, certs[len(certs)-1])
 		if err != nil {
 			return nil, nil, fmt.Errorf("failed to find chain: %w", err)
 		}
 		for _, cert := range dledIntermediates {
 			cp.AddCert(cert)
 		}
-		chains, err = certs[0].Verify(x509.VerifyOptions{
-			Intermediates: cp,
-			Roots:         ca,
-		})
+		chains, err = certs[0].Verify(opts)
 		if err != nil {
-			return nil, nil, fmt.Errorf("chain failed verification after fetch: %w", err)
+			return nil, nil, fmt.Errorf("chain failed verification after fetch: %w",
+				explainUsage(err, certs[0], opts))
 		}
 	}
 	return
@@ -124,50 +234,154 @@ func verifyChains(certs []*x509.Certificate, ca *x509.CertPool) (chains [][]*x50
 
 var ErrNoIssuingCertURL = errors.New("no issuing certificate URL")
 
-func fetchIntermediates(cert *x509.Certificate, ca *x509.CertPool) ([]*x509.Certificate, error) {
+// maxAIADepth bounds how many issuers we'll chase, in case of AIA loops.
+const maxAIADepth = 10
+
+func (cv *chainVerifier) fetchIntermediates(ctx context.Context, cert *x509.Certificate) ([]*x509.Certificate, error) {
 	origCert := cert
 	var retval []*x509.Certificate
 	for {
-		_, err := cert.Verify(x509.VerifyOptions{
-			Roots: ca,
-		})
+		opts := cv.verifyOptions(nil)
+		_, err := cert.Verify(opts)
 		if err == nil {
 			break
 		}
-		if len(cert.IssuingCertificateURL) == 0 {
-			return nil, fmt.Errorf("%s: %w",
-				origCert.Subject.CommonName, ErrNoIssuingCertURL)
+		if isIncompatibleUsage(err) {
+			return nil, explainUsage(err, cert, opts)
 		}
-		cert, err = fetchCert(cert.IssuingCertificateURL[0])
-		if err != nil {
-			return nil, fmt.Errorf("error fetching intermediate %s for %s: %w",
-				cert.Issuer.CommonName,
-				origCert.Subject.CommonName,
-				err,
-			)
+		if len(retval) >= maxAIADepth {
+			return nil, fmt.Errorf("gave up chasing issuers for %s after %d intermediates",
+				origCert.Subject.CommonName, len(retval))
+		}
+		var issuer *x509.Certificate
+		if cv.aia.cache != nil {
+			issuer = cv.aia.cache.issuer(cert)
 		}
+		if issuer == nil {
+			if len(cert.IssuingCertificateURL) == 0 {
+				return nil, fmt.Errorf("%s: %w",
+					origCert.Subject.CommonName, ErrNoIssuingCertURL)
+			}
+			url := cert.IssuingCertificateURL[0]
+			fetched, err := cv.aia.fetchCerts(ctx, url)
+			if err != nil {
+				return nil, fmt.Errorf("error fetching intermediate %s for %s: %w",
+					cert.Issuer.CommonName,
+					origCert.Subject.CommonName,
+					err,
+				)
+			}
+			if issuer = issuerOf(cert, fetched); issuer == nil {
+				return nil, fmt.Errorf("error fetching intermediate %s for %s: %s served %s, none of which "+
+					"signed %s", cert.Issuer.CommonName, origCert.Subject.CommonName, url,
+					certNamesList(fetched), cert.Subject.CommonName)
+			}
+		}
+		cert = issuer
 		retval = append(retval, cert)
 
 	}
 	return retval, nil
 }
 
-func fetchCert(url string) (*x509.Certificate, error) {
-	c := http.Client{}
-	resp, err := c.Get(url)
+// aiaFetcher downloads issuer certificates from AIA URLs, remembering what
+// it's fetched so targets sharing an intermediate only download it once.  A
+// URL can serve more than one certificate, in a PKCS#7 or PEM bundle.
+type aiaFetcher struct {
+	client  *http.Client
+	mu      sync.Mutex
+	entries map[string]*aiaEntry
+	// cache, when set, keeps downloads between runs.
+	cache *aiaCache
+}
+
+type aiaEntry struct {
+	done  chan struct{}
+	certs []*x509.Certificate
+	err   error
+}
+
+func newAIAFetcher(timeout time.Duration) *aiaFetcher {
+	return &aiaFetcher{
+		client:  &http.Client{Timeout: timeout},
+		entries: make(map[string]*aiaEntry),
+	}
+}
+
+// fetchCerts returns the certificates at url, downloading them unless
+// they've already been fetched or are being fetched by another caller.
+func (af *aiaFetcher) fetchCerts(ctx context.Context, url string) ([]*x509.Certificate, error) {
+	af.mu.Lock()
+	e, ok := af.entries[url]
+	if !ok {
+		e = &aiaEntry{done: make(chan struct{})}
+		af.entries[url] = e
+	}
+	af.mu.Unlock()
+	if ok {
+		select {
+		case <-e.done:
+			return e.certs, e.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	e.certs, e.err = af.download(ctx, url)
+	if e.err != nil && ctx.Err() != nil {
+		// our own deadline passed, so let the next caller try again
+		af.mu.Lock()
+		delete(af.entries, url)
+		af.mu.Unlock()
+	}
+	close(e.done)
+	return e.certs, e.err
+}
+
+// download returns the certificates at url from the cache, or failing that
+// from url itself, caching what it gets.
+func (af *aiaFetcher) download(ctx context.Context, url string) ([]*x509.Certificate, error) {
+	if af.cache != nil {
+		if certs := af.cache.byURL(url); len(certs) > 0 {
+			return certs, nil
+		}
+		if af.cache.offline {
+			return nil, fmt.Errorf("%s: %w", url, ErrNotCached)
+		}
+	}
+	certs, err := af.get(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	if af.cache != nil {
+		if err = af.cache.store(url, certs...); err != nil {
+			log.Printf("unable to cache %s: %s", url, err)
+		}
+	}
+	return certs, nil
+}
+
+func (af *aiaFetcher) get(ctx context.Context, url string) ([]*x509.Certificate, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error creating request for url %s: %w", url, err)
+	}
+	resp, err := af.client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error fetching url %s: %w", url, err)
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching url %s: %s", url, resp.Status)
+	}
 	raw, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, fmt.Errorf("error reading respse body for url %s: %w", url, err)
 	}
-	cert, err := x509.ParseCertificate(raw)
+	certs, err := parseAIAResponse(resp.Header.Get("Content-Type"), raw)
 	if err != nil {
 		return nil, fmt.Errorf("error parsing certificate for url %s: %w", url, err)
 	}
-	return cert, nil
+	return certs, nil
 }
 
 // Return all decoded pem blocks of a specified type.
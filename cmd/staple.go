@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// oidTLSFeature is the TLS Feature extension from RFC 7633.  A leaf that
+// lists status_request in it is said to be must-staple.
+var oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+// tlsFeatureStatusRequest is the status_request TLS extension number.
+const tlsFeatureStatusRequest = 5
+
+// isMustStaple reports whether cert requires a stapled OCSP response.
+func isMustStaple(cert *x509.Certificate) bool {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidTLSFeature) {
+			continue
+		}
+		var features []int
+		if _, err := asn1.Unmarshal(ext.Value, &features); err != nil {
+			return false
+		}
+		for _, f := range features {
+			if f == tlsFeatureStatusRequest {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// stapleInfo describes the OCSP response a server stapled to its handshake.
+type stapleInfo struct {
+	mustStaple bool
+	present    bool
+	// fresh is set when the response verified and is current.
+	fresh bool
+	// ocsp is the status the response gave for the leaf.  It is nil when
+	// nothing was stapled.
+	ocsp *revocationStatus
+}
+
+// usable reports whether a client would accept the staple.
+func (si *stapleInfo) usable() bool {
+	return si.present && si.fresh && si.ocsp.err == nil
+}
+
+// violatesMustStaple is true when the leaf is must-staple but the server
+// didn't staple a usable response, which clients that enforce must-staple
+// treat as a hard failure.
+func (si *stapleInfo) violatesMustStaple() bool {
+	return si.mustStaple && !si.usable()
+}
+
+func (si *stapleInfo) String() string {
+	var b strings.Builder
+	b.WriteString("ocsp staple: ")
+	switch {
+	case !si.present:
+		b.WriteString("none")
+	case si.ocsp.status == revocationUnknown && si.ocsp.err != nil:
+		fmt.Fprintf(&b, "unusable: %s", si.ocsp.err)
+	default:
+		b.WriteString(si.ocsp.status)
+		if si.ocsp.status == revocationRevoked {
+			fmt.Fprintf(&b, " at %s, reason %d", si.ocsp.revokedAt.Format(time.RFC3339), si.ocsp.reason)
+		}
+		fmt.Fprintf(&b, " (this update %s", si.ocsp.thisUpdate.Format(time.RFC3339))
+		if !si.ocsp.nextUpdate.IsZero() {
+			fmt.Fprintf(&b, ", next update %s", si.ocsp.nextUpdate.Format(time.RFC3339))
+		}
+		b.WriteString(")")
+		if si.ocsp.err != nil {
+			fmt.Fprintf(&b, ": %s", si.ocsp.err)
+		}
+	}
+	if si.violatesMustStaple() {
+		b.WriteString(", but the leaf is must-staple")
+	}
+	return b.String()
+}
+
+// checkStaple validates the OCSP response stapled for leaf, if any, against
+// its issuer.  issuer may be nil when no issuer could be found, in which case
+// a stapled response can't be trusted.
+func checkStaple(raw []byte, leaf, issuer *x509.Certificate, now time.Time) *stapleInfo {
+	si := &stapleInfo{
+		mustStaple: isMustStaple(leaf),
+		present:    len(raw) > 0,
+	}
+	if !si.present {
+		return si
+	}
+	si.ocsp = &revocationStatus{
+		cert:   leaf,
+		role:   roleLeaf,
+		method: revocationOCSP,
+		source: "stapled",
+		status: revocationUnknown,
+	}
+	if issuer == nil {
+		si.ocsp.err = fmt.Errorf("no issuer found for %s to verify the staple against", leaf.Subject.CommonName)
+		return si
+	}
+	resp, err := verifyOCSPResponse(raw, leaf, issuer, now)
+	if err != nil {
+		si.ocsp.err = err
+		return si
+	}
+	si.ocsp.setOCSP(resp)
+	if si.ocsp.err = checkOCSPFreshness(resp, now); si.ocsp.err == nil {
+		si.fresh = true
+	}
+	return si
+}
+
+// leafIssuer returns the issuer of res.leaf, preferring the first verified
+// chain and falling back to whatever was served or fetched.
+func (res *checkResult) leafIssuer() *x509.Certificate {
+	if len(res.chains) > 0 && len(res.chains[0]) > 1 {
+		return res.chains[0][1]
+	}
+	candidates := append(append([]*x509.Certificate{}, res.intermediates...), res.fetched...)
+	for _, c := range candidates {
+		if bytes.Equal(c.RawSubject, res.leaf.RawIssuer) && res.leaf.CheckSignatureFrom(c) == nil {
+			return c
+		}
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// starttlsFunc performs the plaintext portion of a protocol exchange needed
+// to get the server to the point where it expects a TLS ClientHello.
+type starttlsFunc func(conn net.Conn, host string) error
+
+var starttlsProtos = map[string]starttlsFunc{
+	"smtp":     starttlsSMTP,
+	"imap":     starttlsIMAP,
+	"pop3":     starttlsPOP3,
+	"ldap":     starttlsLDAP,
+	"xmpp":     starttlsXMPP,
+	"postgres": starttlsPostgres,
+	"mysql":    starttlsMySQL,
+}
+
+// starttlsNames returns the supported STARTTLS protocols in sorted order.
+func starttlsNames() []string {
+	names := make([]string, 0, len(starttlsProtos))
+	for name := range starttlsProtos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func validateStarttls(proto string) error {
+	if proto == "" {
+		return nil
+	}
+	if _, ok := starttlsProtos[proto]; !ok {
+		return fmt.Errorf("unsupported starttls protocol %q, must be one of: %s",
+			proto, strings.Join(starttlsNames(), ", "))
+	}
+	return nil
+}
+
+func starttlsSMTP(conn net.Conn, _ string) error {
+	tp := textproto.NewConn(conn)
+	if _, _, err := tp.ReadResponse(220); err != nil {
+		return fmt.Errorf("bad smtp greeting: %w", err)
+	}
+	id, err := tp.Cmd("EHLO whichca")
+	if err != nil {
+		return err
+	}
+	tp.StartResponse(id)
+	_, msg, err := tp.ReadResponse(250)
+	tp.EndResponse(id)
+	if err != nil {
+		return fmt.Errorf("EHLO rejected: %w", err)
+	}
+	found := false
+	for _, ext := range strings.Split(msg, "\n") {
+		if strings.EqualFold(strings.TrimSpace(ext), "STARTTLS") {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("server does not advertise STARTTLS")
+	}
+	id, err = tp.Cmd("STARTTLS")
+	if err != nil {
+		return err
+	}
+	tp.StartResponse(id)
+	defer tp.EndResponse(id)
+	if _, _, err = tp.ReadResponse(220); err != nil {
+		return fmt.Errorf("STARTTLS rejected: %w", err)
+	}
+	return nil
+}
+
+func starttlsIMAP(conn net.Conn, _ string) error {
+	tp := textproto.NewConn(conn)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("bad imap greeting: %s", line)
+	}
+	if err = tp.PrintfLine("a001 STARTTLS"); err != nil {
+		return err
+	}
+	for {
+		line, err = tp.ReadLine()
+		if err != nil {
+			return err
+		}
+		// skip any untagged responses
+		if strings.HasPrefix(line, "a001 ") {
+			break
+		}
+	}
+	if !strings.HasPrefix(line, "a001 OK") {
+		return fmt.Errorf("STARTTLS rejected: %s", line)
+	}
+	return nil
+}
+
+func starttlsPOP3(conn net.Conn, _ string) error {
+	tp := textproto.NewConn(conn)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("bad pop3 greeting: %s", line)
+	}
+	if err = tp.PrintfLine("STLS"); err != nil {
+		return err
+	}
+	line, err = tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "+OK") {
+		return fmt.Errorf("STLS rejected: %s", line)
+	}
+	return nil
+}
+
+const ldapStartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+func starttlsLDAP(conn net.Conn, _ string) error {
+	// ExtendedRequest ::= [APPLICATION 23] SEQUENCE {
+	//     requestName [0] LDAPOID }
+	req, err := asn1.Marshal(struct {
+		ID int
+		Op asn1.RawValue
+	}{
+		ID: 1,
+		Op: asn1.RawValue{
+			Class:      asn1.ClassApplication,
+			Tag:        23,
+			IsCompound: true,
+			Bytes: append([]byte{0x80, byte(len(ldapStartTLSOID))},
+				ldapStartTLSOID...),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err = conn.Write(req); err != nil {
+		return err
+	}
+	raw, err := readBER(bufio.NewReader(conn))
+	if err != nil {
+		return fmt.Errorf("error reading ldap response: %w", err)
+	}
+	var resp struct {
+		ID int
+		Op asn1.RawValue
+	}
+	if _, err = asn1.Unmarshal(raw, &resp); err != nil {
+		return fmt.Errorf("error parsing ldap response: %w", err)
+	}
+	if resp.Op.Class != asn1.ClassApplication || resp.Op.Tag != 24 {
+		return fmt.Errorf("unexpected ldap response tag %d", resp.Op.Tag)
+	}
+	var code asn1.Enumerated
+	rest, err := asn1.Unmarshal(resp.Op.Bytes, &code)
+	if err != nil {
+		return fmt.Errorf("error parsing ldap result code: %w", err)
+	}
+	if code != 0 {
+		// matchedDN and diagnosticMessage are both LDAPString, a plain
+		// OCTET STRING
+		var matched, diag []byte
+		if rest, err = asn1.Unmarshal(rest, &matched); err == nil {
+			_, err = asn1.Unmarshal(rest, &diag)
+		}
+		if err != nil {
+			return fmt.Errorf("StartTLS rejected with result code %d, and its diagnostic message "+
+				"couldn't be parsed: %w", code, err)
+		}
+		return fmt.Errorf("StartTLS rejected with result code %d: %s", code, diag)
+	}
+	return nil
+}
+
+// maxBERLength bounds the length of a BER element we'll read, far more than
+// an LDAP StartTLS response needs, so a server can't have us allocate
+// whatever it claims.
+const maxBERLength = 64 << 10
+
+// readBER reads a single definite-length BER element from r.
+func readBER(r *bufio.Reader) ([]byte, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	length := int(hdr[1])
+	if hdr[1]&0x80 != 0 {
+		n := int(hdr[1] & 0x7f)
+		if n == 0 || n > 4 {
+			return nil, fmt.Errorf("unsupported BER length encoding 0x%02x", hdr[1])
+		}
+		lb := make([]byte, n)
+		if _, err := io.ReadFull(r, lb); err != nil {
+			return nil, err
+		}
+		hdr = append(hdr, lb...)
+		length = 0
+		for _, b := range lb {
+			length = length<<8 | int(b)
+		}
+	}
+	if length > maxBERLength {
+		return nil, fmt.Errorf("BER element of %d bytes is too long", length)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return append(hdr, body...), nil
+}
+
+const xmppTLSNS = "urn:ietf:params:xml:ns:xmpp-tls"
+
+func starttlsXMPP(conn net.Conn, host string) error {
+	var to strings.Builder
+	if err := xml.EscapeText(&to, []byte(host)); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream to='%s' "+
+		"xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>",
+		to.String())
+	if err != nil {
+		return err
+	}
+	dec := xml.NewDecoder(conn)
+	found := false
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("error reading xmpp stream features: %w", err)
+		}
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "starttls" && se.Name.Space == xmppTLSNS {
+			found = true
+		}
+		if ee, ok := tok.(xml.EndElement); ok && ee.Name.Local == "features" {
+			break
+		}
+	}
+	if !found {
+		return errors.New("server does not advertise starttls")
+	}
+	if _, err = fmt.Fprintf(conn, "<starttls xmlns='%s'/>", xmppTLSNS); err != nil {
+		return err
+	}
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("error reading xmpp starttls response: %w", err)
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			if se.Name.Local == "proceed" {
+				return nil
+			}
+			return fmt.Errorf("starttls rejected: <%s>", se.Name.Local)
+		}
+	}
+}
+
+func starttlsPostgres(conn net.Conn, _ string) error {
+	// SSLRequest: length followed by the magic request code 80877103
+	req := make([]byte, 8)
+	binary.BigEndian.PutUint32(req[0:], 8)
+	binary.BigEndian.PutUint32(req[4:], 80877103)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	resp := make([]byte, 1)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	switch resp[0] {
+	case 'S':
+		return nil
+	case 'N':
+		return errors.New("server does not support SSL")
+	default:
+		return fmt.Errorf("unexpected response to SSLRequest: %q", resp[0])
+	}
+}
+
+const (
+	mysqlClientProtocol41     = 0x00000200
+	mysqlClientSSL            = 0x00000800
+	mysqlClientSecureConn     = 0x00008000
+	mysqlHandshakeV10         = 10
+	mysqlSSLRequestPayloadLen = 32
+)
+
+func starttlsMySQL(conn net.Conn, _ string) error {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return err
+	}
+	payload := make([]byte, int(hdr[0])|int(hdr[1])<<8|int(hdr[2])<<16)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		return err
+	}
+	if len(payload) == 0 || payload[0] != mysqlHandshakeV10 {
+		return errors.New("unexpected mysql handshake packet")
+	}
+	// protocol version, null terminated server version, connection id (4),
+	// auth plugin data part 1 (8), filler (1), then the lower capability flags.
+	nul := strings.IndexByte(string(payload[1:]), 0)
+	if nul < 0 {
+		return errors.New("malformed mysql handshake packet")
+	}
+	off := 1 + nul + 1 + 4 + 8 + 1
+	if len(payload) < off+2 {
+		return errors.New("short mysql handshake packet")
+	}
+	caps := uint32(binary.LittleEndian.Uint16(payload[off:]))
+	if caps&mysqlClientSSL == 0 {
+		return errors.New("server does not support SSL")
+	}
+	// SSLRequest packet: capability flags, max packet size, character set
+	// and 23 bytes of filler, sent with sequence id 1.
+	req := make([]byte, 4+mysqlSSLRequestPayloadLen)
+	req[0] = mysqlSSLRequestPayloadLen
+	req[3] = hdr[3] + 1
+	binary.LittleEndian.PutUint32(req[4:], mysqlClientProtocol41|mysqlClientSSL|mysqlClientSecureConn)
+	binary.LittleEndian.PutUint32(req[8:], 1<<24)
+	req[12] = 45 // utf8mb4_general_ci
+	_, err := conn.Write(req)
+	return err
+}
@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+// fakeServer is the server end of a STARTTLS exchange.  It gets the server
+// side of a pipe and returns an error if the client misbehaves.
+type fakeServer func(conn net.Conn) error
+
+// lineServer greets with greeting, then answers each expected command line
+// with the matching reply.
+func lineServer(greeting string, exchanges ...[2]string) fakeServer {
+	return func(conn net.Conn) error {
+		tp := textproto.NewConn(conn)
+		if err := tp.PrintfLine("%s", greeting); err != nil {
+			return err
+		}
+		for _, ex := range exchanges {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return err
+			}
+			if line != ex[0] {
+				return fmt.Errorf("got command %q, wanted %q", line, ex[0])
+			}
+			if _, err = io.WriteString(conn, ex[1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func ldapServer(code int, diag string) fakeServer {
+	return func(conn net.Conn) error {
+		raw, err := readBER(bufio.NewReader(conn))
+		if err != nil {
+			return err
+		}
+		var req struct {
+			ID int
+			Op asn1.RawValue
+		}
+		if _, err = asn1.Unmarshal(raw, &req); err != nil {
+			return err
+		}
+		if req.Op.Class != asn1.ClassApplication || req.Op.Tag != 23 {
+			return fmt.Errorf("got ldap op tag %d, wanted 23", req.Op.Tag)
+		}
+		if !strings.Contains(string(req.Op.Bytes), ldapStartTLSOID) {
+			return fmt.Errorf("ldap request is missing the StartTLS OID")
+		}
+		// ExtendedResponse ::= [APPLICATION 24] SEQUENCE {
+		//     resultCode ENUMERATED, matchedDN LDAPDN, diagnosticMessage LDAPString }
+		var body []byte
+		for _, v := range []interface{}{asn1.Enumerated(code), []byte(""), []byte(diag)} {
+			b, err := asn1.Marshal(v)
+			if err != nil {
+				return err
+			}
+			body = append(body, b...)
+		}
+		resp, err := asn1.Marshal(struct {
+			ID int
+			Op asn1.RawValue
+		}{
+			ID: req.ID,
+			Op: asn1.RawValue{Class: asn1.ClassApplication, Tag: 24, IsCompound: true, Bytes: body},
+		})
+		if err != nil {
+			return err
+		}
+		_, err = conn.Write(resp)
+		return err
+	}
+}
+
+func xmppServer(features, reply string) fakeServer {
+	return func(conn net.Conn) error {
+		r := bufio.NewReader(conn)
+		if err := readThrough(r, "version='1.0'>"); err != nil {
+			return err
+		}
+		_, err := fmt.Fprintf(conn, "<?xml version='1.0'?><stream:stream xmlns='jabber:client' "+
+			"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>"+
+			"<stream:features>%s</stream:features>", features)
+		if err != nil || reply == "" {
+			return err
+		}
+		if err = readThrough(r, "<starttls xmlns='"+xmppTLSNS+"'/>"); err != nil {
+			return err
+		}
+		_, err = io.WriteString(conn, reply)
+		return err
+	}
+}
+
+// readThrough reads from r up to and including want.
+func readThrough(r *bufio.Reader, want string) error {
+	var got []byte
+	for !strings.HasSuffix(string(got), want) {
+		b, err := r.ReadByte()
+		if err != nil {
+			return fmt.Errorf("reading for %q: %w", want, err)
+		}
+		got = append(got, b)
+	}
+	return nil
+}
+
+func postgresServer(reply byte) fakeServer {
+	return func(conn net.Conn) error {
+		req := make([]byte, 8)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return err
+		}
+		if binary.BigEndian.Uint32(req) != 8 || binary.BigEndian.Uint32(req[4:]) != 80877103 {
+			return fmt.Errorf("bad SSLRequest % x", req)
+		}
+		_, err := conn.Write([]byte{reply})
+		return err
+	}
+}
+
+func mysqlServer(caps uint16) fakeServer {
+	return func(conn net.Conn) error {
+		payload := []byte{mysqlHandshakeV10}
+		payload = append(payload, "8.0.36\x00"...)
+		payload = append(payload, 1, 0, 0, 0)        // connection id
+		payload = append(payload, "abcdefgh\x00"...) // auth plugin data part 1 and filler
+		payload = binary.LittleEndian.AppendUint16(payload, caps)
+		pkt := append([]byte{byte(len(payload)), 0, 0, 0}, payload...)
+		if _, err := conn.Write(pkt); err != nil {
+			return err
+		}
+		if caps&mysqlClientSSL == 0 {
+			return nil
+		}
+		req := make([]byte, 4+mysqlSSLRequestPayloadLen)
+		if _, err := io.ReadFull(conn, req); err != nil {
+			return err
+		}
+		if req[0] != mysqlSSLRequestPayloadLen || req[3] != 1 {
+			return fmt.Errorf("bad SSLRequest header % x", req[:4])
+		}
+		if binary.LittleEndian.Uint32(req[4:])&mysqlClientSSL == 0 {
+			return fmt.Errorf("SSLRequest doesn't ask for SSL")
+		}
+		return nil
+	}
+}
+
+func TestStarttls(t *testing.T) {
+	tests := []struct {
+		name    string
+		proto   string
+		server  fakeServer
+		wantErr string
+	}{
+		{
+			name:  "smtp",
+			proto: "smtp",
+			server: lineServer("220 mx.example.com ESMTP",
+				[2]string{"EHLO whichca", "250-mx.example.com\r\n250-PIPELINING\r\n250 STARTTLS\r\n"},
+				[2]string{"STARTTLS", "220 2.0.0 Ready to start TLS\r\n"}),
+		},
+		{
+			name:  "smtp without starttls",
+			proto: "smtp",
+			server: lineServer("220 mx.example.com ESMTP",
+				[2]string{"EHLO whichca", "250-mx.example.com\r\n250 PIPELINING\r\n"}),
+			wantErr: "server does not advertise STARTTLS",
+		},
+		{
+			name:  "smtp starttls refused",
+			proto: "smtp",
+			server: lineServer("220 mx.example.com ESMTP",
+				[2]string{"EHLO whichca", "250 STARTTLS\r\n"},
+				[2]string{"STARTTLS", "454 4.7.0 TLS not available\r\n"}),
+			wantErr: "STARTTLS rejected",
+		},
+		{
+			name:    "smtp bad greeting",
+			proto:   "smtp",
+			server:  lineServer("554 go away"),
+			wantErr: "bad smtp greeting",
+		},
+		{
+			name:  "imap",
+			proto: "imap",
+			server: lineServer("* OK IMAP4rev1 ready",
+				[2]string{"a001 STARTTLS", "* CAPABILITY IMAP4rev1\r\na001 OK Begin TLS negotiation now\r\n"}),
+		},
+		{
+			name:  "imap refused",
+			proto: "imap",
+			server: lineServer("* OK IMAP4rev1 ready",
+				[2]string{"a001 STARTTLS", "a001 BAD not now\r\n"}),
+			wantErr: "STARTTLS rejected: a001 BAD not now",
+		},
+		{
+			name:    "imap bad greeting",
+			proto:   "imap",
+			server:  lineServer("* BYE"),
+			wantErr: "bad imap greeting",
+		},
+		{
+			name:   "pop3",
+			proto:  "pop3",
+			server: lineServer("+OK POP3 ready", [2]string{"STLS", "+OK Begin TLS negotiation\r\n"}),
+		},
+		{
+			name:    "pop3 refused",
+			proto:   "pop3",
+			server:  lineServer("+OK POP3 ready", [2]string{"STLS", "-ERR command not recognized\r\n"}),
+			wantErr: "STLS rejected: -ERR command not recognized",
+		},
+		{
+			name:   "ldap",
+			proto:  "ldap",
+			server: ldapServer(0, ""),
+		},
+		{
+			name:    "ldap refused",
+			proto:   "ldap",
+			server:  ldapServer(53, "TLS already started"),
+			wantErr: "StartTLS rejected with result code 53: TLS already started",
+		},
+		{
+			name:  "xmpp",
+			proto: "xmpp",
+			server: xmppServer("<starttls xmlns='"+xmppTLSNS+"'><required/></starttls>",
+				"<proceed xmlns='"+xmppTLSNS+"'/>"),
+		},
+		{
+			name:    "xmpp without starttls",
+			proto:   "xmpp",
+			server:  xmppServer("<mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>", ""),
+			wantErr: "server does not advertise starttls",
+		},
+		{
+			name:    "xmpp refused",
+			proto:   "xmpp",
+			server:  xmppServer("<starttls xmlns='"+xmppTLSNS+"'/>", "<failure xmlns='"+xmppTLSNS+"'/>"),
+			wantErr: "starttls rejected: <failure>",
+		},
+		{
+			name:   "postgres",
+			proto:  "postgres",
+			server: postgresServer('S'),
+		},
+		{
+			name:    "postgres without ssl",
+			proto:   "postgres",
+			server:  postgresServer('N'),
+			wantErr: "server does not support SSL",
+		},
+		{
+			name:   "mysql",
+			proto:  "mysql",
+			server: mysqlServer(mysqlClientProtocol41 | mysqlClientSSL | mysqlClientSecureConn),
+		},
+		{
+			name:    "mysql without ssl",
+			proto:   "mysql",
+			server:  mysqlServer(mysqlClientProtocol41 | mysqlClientSecureConn),
+			wantErr: "server does not support SSL",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			done := make(chan error, 1)
+			go func() {
+				done <- tt.server(server)
+				server.Close()
+			}()
+			err := starttlsProtos[tt.proto](client, "example.com")
+			client.Close()
+			srvErr := <-done
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if srvErr != nil {
+					t.Fatalf("server: %v", srvErr)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Fatalf("got error %v, wanted one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReadBER(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      []byte
+		want    int
+		wantErr string
+	}{
+		{name: "short form", in: []byte{0x04, 0x02, 'h', 'i'}, want: 4},
+		{name: "long form", in: append([]byte{0x04, 0x81, 0x80}, make([]byte, 0x80)...), want: 0x83},
+		{name: "at the limit", in: append([]byte{0x04, 0x83, 0x01, 0x00, 0x00}, make([]byte, maxBERLength)...),
+			want: maxBERLength + 5},
+		{name: "over the limit", in: []byte{0x04, 0x84, 0xff, 0xff, 0xff, 0xff}, wantErr: "too long"},
+		{name: "indefinite", in: []byte{0x30, 0x80}, wantErr: "unsupported BER length"},
+		{name: "truncated", in: []byte{0x04, 0x05, 'h', 'i'}, wantErr: "unexpected EOF"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readBER(bufio.NewReader(strings.NewReader(string(tt.in))))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, wanted one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != tt.want {
+				t.Fatalf("got %d bytes, wanted %d", len(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestStarttlsXMPPEscapesHost(t *testing.T) {
+	host := `example.com'/><evil a="&"/>`
+	client, server := net.Pipe()
+	go func() {
+		starttlsXMPP(client, host)
+		client.Close()
+	}()
+	r := bufio.NewReader(server)
+	var header strings.Builder
+	for !strings.HasSuffix(header.String(), "version='1.0'>") {
+		b, err := r.ReadByte()
+		if err != nil {
+			t.Fatalf("reading stream header: %v", err)
+		}
+		header.WriteByte(b)
+	}
+	server.Close()
+
+	dec := xml.NewDecoder(strings.NewReader(header.String()))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			t.Fatalf("parsing %s: %v", header.String(), err)
+		}
+		se, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local != "stream" {
+			t.Fatalf("got element %s, wanted stream", se.Name.Local)
+		}
+		for _, attr := range se.Attr {
+			if attr.Name.Local == "to" && attr.Value != host {
+				t.Fatalf("stream is to %q, wanted %q", attr.Value, host)
+			}
+		}
+		return
+	}
+}
+
+func TestValidateStarttls(t *testing.T) {
+	for _, proto := range append(starttlsNames(), "") {
+		if err := validateStarttls(proto); err != nil {
+			t.Errorf("validateStarttls(%q): %v", proto, err)
+		}
+	}
+	if err := validateStarttls("ftp"); err == nil {
+		t.Error("validateStarttls(\"ftp\") succeeded")
+	}
+}
@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkStatus summarizes a checkResult.  Statuses are ordered from best to
+// worst, so the worst of a run is simply the largest.
+type checkStatus int
+
+const (
+	statusGood checkStatus = iota
+	statusExpiryWarning
+	statusExpiryCritical
+	statusServedChain
+	statusMissingIntermediates
+	statusLintErrors
+	statusCTNonCompliant
+	statusNameMismatch
+	statusMustStaple
+	statusKeyMismatch
+	statusUntrusted
+	statusRevoked
+	statusUnreachable
+)
+
+// Exit statuses for check -continue, for the worst result across all
+// targets.  Expiry warnings and criticals use ExitExpiryWarning and
+// ExitExpiryCritical.
+const (
+	ExitMissingIntermediates = 4
+	ExitNameMismatch         = 5
+	ExitUntrusted            = 6
+	ExitUnreachable          = 7
+	ExitRevoked              = 8
+	ExitMustStaple           = 9
+	ExitServedChain          = 10
+	ExitKeyMismatch          = 11
+	ExitCTNonCompliant       = 12
+	ExitLintErrors           = 13
+)
+
+var allStatuses = []checkStatus{
+	statusGood,
+	statusExpiryWarning,
+	statusExpiryCritical,
+	statusServedChain,
+	statusMissingIntermediates,
+	statusLintErrors,
+	statusCTNonCompliant,
+	statusNameMismatch,
+	statusMustStaple,
+	statusKeyMismatch,
+	statusUntrusted,
+	statusRevoked,
+	statusUnreachable,
+}
+
+func (cs checkStatus) String() string {
+	switch cs {
+	case statusGood:
+		return "good"
+	case statusExpiryWarning:
+		return "expiry warning"
+	case statusExpiryCritical:
+		return "expiry critical"
+	case statusServedChain:
+		return "served chain problems"
+	case statusMissingIntermediates:
+		return "missing intermediates"
+	case statusLintErrors:
+		return "lint errors"
+	case statusCTNonCompliant:
+		return "ct non-compliant"
+	case statusNameMismatch:
+		return "name mismatch"
+	case statusMustStaple:
+		return "must-staple violation"
+	case statusKeyMismatch:
+		return "key mismatch"
+	case statusUntrusted:
+		return "untrusted"
+	case statusRevoked:
+		return "revoked"
+	case statusUnreachable:
+		return "unreachable"
+	default:
+		return fmt.Sprintf("status(%d)", int(cs))
+	}
+}
+
+// key is the status as used in JSON output.
+func (cs checkStatus) key() string {
+	return strings.ReplaceAll(cs.String(), " ", "_")
+}
+
+func (cs checkStatus) exitStatus() int {
+	switch cs {
+	case statusGood:
+		return 0
+	case statusExpiryWarning:
+		return ExitExpiryWarning
+	case statusExpiryCritical:
+		return ExitExpiryCritical
+	case statusServedChain:
+		return ExitServedChain
+	case statusMissingIntermediates:
+		return ExitMissingIntermediates
+	case statusLintErrors:
+		return ExitLintErrors
+	case statusCTNonCompliant:
+		return ExitCTNonCompliant
+	case statusNameMismatch:
+		return ExitNameMismatch
+	case statusMustStaple:
+		return ExitMustStaple
+	case statusKeyMismatch:
+		return ExitKeyMismatch
+	case statusUntrusted:
+		return ExitUntrusted
+	case statusRevoked:
+		return ExitRevoked
+	default:
+		return ExitUnreachable
+	}
+}
+
+// status classifies the result by the worst problem found.
+func (res *checkResult) status() checkStatus {
+	switch {
+	case res.err != nil:
+		return statusUnreachable
+	case res.revoked():
+		return statusRevoked
+	case res.chainErr != nil:
+		return statusUntrusted
+	case res.nameErr != nil:
+		return statusNameMismatch
+	case res.staple != nil && res.staple.violatesMustStaple():
+		return statusMustStaple
+	case res.key != nil && !res.key.matches:
+		return statusKeyMismatch
+	case res.ct != nil && !res.ct.compliant:
+		return statusCTNonCompliant
+	case lintErrors(res.lint) > 0:
+		return statusLintErrors
+	case !res.ok:
+		return statusMissingIntermediates
+	case res.servedChain != nil && !res.servedChain.ok():
+		return statusServedChain
+	case res.expiry != nil && res.expiry.status == expiryCritical:
+		return statusExpiryCritical
+	case res.expiry != nil && res.expiry.status == expiryWarning:
+		return statusExpiryWarning
+	default:
+		return statusGood
+	}
+}
+
+func (res *checkResult) revoked() bool {
+	for _, rs := range res.revocation {
+		if rs.status == revocationRevoked {
+			return true
+		}
+	}
+	// a server stapling its own revocation is unusual, but it happens
+	return res.staple != nil && res.staple.present && res.staple.ocsp.status == revocationRevoked
+}
+
+// checkSummary tallies results by status.
+type checkSummary struct {
+	counts map[checkStatus]int
+	worst  checkStatus
+}
+
+func newCheckSummary() *checkSummary {
+	return &checkSummary{counts: make(map[checkStatus]int)}
+}
+
+func (cs *checkSummary) add(status checkStatus) {
+	cs.counts[status]++
+	if status > cs.worst {
+		cs.worst = status
+	}
+}
+
+// String lists the count for every status.  The less common ones are left
+// out when there's nothing to report.
+func (cs *checkSummary) String() string {
+	var parts []string
+	for _, status := range allStatuses {
+		n := cs.counts[status]
+		switch status {
+		case statusGood, statusMissingIntermediates, statusUntrusted, statusUnreachable:
+		default:
+			if n == 0 {
+				continue
+			}
+		}
+		parts = append(parts, fmt.Sprintf("%d %s", n, status))
+	}
+	return "summary: " + strings.Join(parts, ", ")
+}
+
+func (cs *checkSummary) record() *summaryRecord {
+	rec := &summaryRecord{
+		SchemaVersion: jsonSchemaVersion,
+		Type:          "summary",
+		Counts:        make(map[string]int),
+		Worst:         cs.worst.key(),
+	}
+	for _, status := range allStatuses {
+		rec.Counts[status.key()] = cs.counts[status]
+	}
+	return rec
+}
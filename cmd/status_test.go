@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestCheckSummaryExitStatus(t *testing.T) {
+	good := func() *checkResult { return &checkResult{ok: true} }
+	tests := []struct {
+		name    string
+		results []*checkResult
+		want    int
+	}{
+		{
+			name:    "all good",
+			results: []*checkResult{good(), good()},
+			want:    0,
+		},
+		{
+			name: "expiry warning",
+			results: []*checkResult{good(),
+				{ok: true, expiry: &expiryInfo{status: expiryWarning}}},
+			want: ExitExpiryWarning,
+		},
+		{
+			name: "name mismatch outranks expiry",
+			results: []*checkResult{
+				{ok: true, expiry: &expiryInfo{status: expiryCritical}},
+				{ok: true, nameErr: errors.New("name mismatch")}},
+			want: ExitNameMismatch,
+		},
+		{
+			name:    "missing intermediates",
+			results: []*checkResult{good(), {}},
+			want:    ExitMissingIntermediates,
+		},
+		{
+			name: "lint errors",
+			results: []*checkResult{
+				{ok: true, lint: []*lintFinding{{rule: &lintRule{severity: lintError}}}}},
+			want: ExitLintErrors,
+		},
+		{
+			name:    "unreachable is worst",
+			results: []*checkResult{{chainErr: errors.New("untrusted")}, {err: errors.New("refused")}},
+			want:    ExitUnreachable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			summary := newCheckSummary()
+			for _, res := range tt.results {
+				summary.add(res.status())
+			}
+			if got := summary.worst.exitStatus(); got != tt.want {
+				t.Fatalf("got exit status %d, wanted %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package cmd
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// hostTarget describes a -hp target: the address as given on the command line,
+// the address actually dialed, the server name sent in the handshake, and the
+// name the leaf certificate is expected to be valid for.
+type hostTarget struct {
+	addr       string
+	host       string
+	port       string
+	dialAddr   string
+	serverName string
+	name       string
+	starttls   string
+}
+
+const (
+	targetKindHost = "host"
+	targetKindFile = "file"
+)
+
+// targetSpec is a single -hp or -p target, before it's been parsed.
+type targetSpec struct {
+	kind   string
+	target string
+	// The rest are only set for targets read from -targets, where each line
+	// can carry its own options.  sni, starttls and name override the flags
+	// of the same name.
+	sni      string
+	starttls string
+	name     string
+	tags     []string
+}
+
+// targetSpecs lists file targets followed by host targets.
+func targetSpecs(files, hostports []string) []targetSpec {
+	specs := make([]targetSpec, 0, len(files)+len(hostports))
+	for _, f := range files {
+		specs = append(specs, targetSpec{kind: targetKindFile, target: f})
+	}
+	for _, hp := range hostports {
+		specs = append(specs, targetSpec{kind: targetKindHost, target: hp})
+	}
+	return specs
+}
+
+// loadTargetSpecs lists file targets, then host targets, then those read
+// from targetsFile if it's set.
+func loadTargetSpecs(files, hostports []string, targetsFile string) ([]targetSpec, error) {
+	specs := targetSpecs(files, hostports)
+	if targetsFile == "" {
+		return specs, nil
+	}
+	var (
+		r   io.Reader = os.Stdin
+		err error
+	)
+	if targetsFile != "-" {
+		f, err := os.Open(targetsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading targets: %w", err)
+		}
+		defer f.Close()
+		r = f
+	}
+	read, err := readTargets(r)
+	if err != nil {
+		return nil, fmt.Errorf("error reading targets from %s: %w", targetsFile, err)
+	}
+	return append(specs, read...), nil
+}
+
+// readTargets reads one target per line: a host:port, an https URL or a
+// certificate file, followed by any of sni=name, starttls=proto, name=host
+// and tags=tag1,tag2.  Anything from a # on is a comment, and blank lines are
+// skipped.
+func readTargets(r io.Reader) ([]targetSpec, error) {
+	var specs []targetSpec
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		spec, err := parseTargetLine(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		specs = append(specs, spec)
+	}
+	return specs, sc.Err()
+}
+
+func parseTargetLine(fields []string) (targetSpec, error) {
+	spec := targetSpec{kind: targetKindHost, target: fields[0]}
+	if strings.Contains(spec.target, "://") {
+		u, err := url.Parse(spec.target)
+		if err != nil {
+			return spec, fmt.Errorf("invalid target %s: %w", spec.target, err)
+		}
+		if u.Scheme != "https" || u.Hostname() == "" {
+			return spec, fmt.Errorf("invalid target %s, only https URLs are supported", spec.target)
+		}
+		port := u.Port()
+		if port == "" {
+			port = "443"
+		}
+		spec.target = net.JoinHostPort(u.Hostname(), port)
+	} else if _, err := os.Stat(spec.target); err == nil {
+		spec.kind = targetKindFile
+	} else if _, _, err := net.SplitHostPort(spec.target); err != nil {
+		return spec, fmt.Errorf("%s is neither a host:port, an https URL nor a file", spec.target)
+	}
+	for _, opt := range fields[1:] {
+		i := strings.Index(opt, "=")
+		if i < 0 {
+			return spec, fmt.Errorf("invalid option %q, expected key=value", opt)
+		}
+		key, v := opt[:i], opt[i+1:]
+		switch key {
+		case "sni":
+			spec.sni = v
+		case "starttls":
+			if err := validateStarttls(v); err != nil {
+				return spec, err
+			}
+			spec.starttls = v
+		case "name":
+			spec.name = v
+		case "tags":
+			for _, tag := range strings.Split(v, ",") {
+				if tag != "" {
+					spec.tags = append(spec.tags, tag)
+				}
+			}
+		default:
+			return spec, fmt.Errorf("unknown option %q, must be one of sni, starttls, name or tags", key)
+		}
+	}
+	if spec.kind == targetKindFile && (spec.sni != "" || spec.starttls != "") {
+		return spec, fmt.Errorf("sni and starttls don't apply to file %s", spec.target)
+	}
+	return spec, nil
+}
+
+// connectRule maps connections for host:port to toHost:toPort, in the
+// spirit of curl's --connect-to.  Empty fields match anything or, for the
+// destination, leave that part of the address unchanged.
+type connectRule struct {
+	host, port     string
+	toHost, toPort string
+}
+
+func (cr connectRule) matches(host, port string) bool {
+	return (cr.host == "" || strings.EqualFold(cr.host, host)) &&
+		(cr.port == "" || cr.port == port)
+}
+
+type connectparams []connectRule
+
+func (cp *connectparams) String() string {
+	return ""
+}
+
+// resolveparams is a connectparams that accepts curl's --resolve syntax,
+// name:port:addr.
+type resolveparams struct {
+	*connectparams
+}
+
+func (rp resolveparams) Set(v string) error {
+	for _, spec := range strings.Split(v, ",") {
+		fields, err := splitColonFields(spec)
+		if err != nil {
+			return err
+		}
+		if len(fields) != 3 || fields[0] == "" || fields[1] == "" || fields[2] == "" {
+			return fmt.Errorf("invalid resolve specification %q, expected name:port:addr", spec)
+		}
+		*rp.connectparams = append(*rp.connectparams, connectRule{
+			host:   fields[0],
+			port:   fields[1],
+			toHost: fields[2],
+		})
+	}
+	return nil
+}
+
+// connecttoparams is a connectparams that accepts curl's --connect-to syntax,
+// host1:port1:host2:port2.
+type connecttoparams struct {
+	*connectparams
+}
+
+func (cp connecttoparams) Set(v string) error {
+	for _, spec := range strings.Split(v, ",") {
+		fields, err := splitColonFields(spec)
+		if err != nil {
+			return err
+		}
+		if len(fields) != 4 {
+			return fmt.Errorf("invalid connect-to specification %q, expected host1:port1:host2:port2", spec)
+		}
+		*cp.connectparams = append(*cp.connectparams, connectRule{
+			host:   fields[0],
+			port:   fields[1],
+			toHost: fields[2],
+			toPort: fields[3],
+		})
+	}
+	return nil
+}
+
+// splitColonFields splits s on colons, treating bracketed IPv6 literals as a
+// single field and stripping their brackets.
+func splitColonFields(s string) ([]string, error) {
+	var fields []string
+	for {
+		var field string
+		if strings.HasPrefix(s, "[") {
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("missing ']' in %q", s)
+			}
+			field, s = s[1:end], s[end+1:]
+			if s != "" && s[0] != ':' {
+				return nil, fmt.Errorf("unexpected characters after ']' in %q", s)
+			}
+		} else {
+			i := strings.IndexByte(s, ':')
+			if i < 0 {
+				i = len(s)
+			}
+			field, s = s[:i], s[i:]
+		}
+		fields = append(fields, field)
+		if s == "" {
+			return fields, nil
+		}
+		s = s[1:]
+	}
+}
+
+// dialOptions holds the flags shared by every command that connects to
+// -hp targets.
+type dialOptions struct {
+	starttls  string
+	sni       string
+	connectTo connectparams
+	// timeout bounds all the work for a single target, including fetching
+	// intermediates.
+	timeout time.Duration
+}
+
+func (do *dialOptions) register(f *flag.FlagSet) {
+	f.StringVar(&do.starttls, "starttls", "", "negotiate TLS on -hp targets with STARTTLS using `proto` ("+
+		strings.Join(starttlsNames(), ", ")+")")
+	f.StringVar(&do.sni, "sni", "", "send `name` as the TLS server name instead of the -hp host")
+	f.Var(resolveparams{&do.connectTo}, "resolve", "connect to `name:port:addr` instead of "+
+		"resolving name, for -hp targets matching name:port")
+	f.Var(connecttoparams{&do.connectTo}, "connect-to", "connect to `host2:port2` instead of "+
+		"host1:port1, given as host1:port1:host2:port2.  empty fields match any host or port")
+	f.DurationVar(&do.timeout, "timeout", 30*time.Second, "give up on a target after `duration`")
+}
+
+func (do *dialOptions) validate() error {
+	if do.timeout <= 0 {
+		return fmt.Errorf("invalid timeout %s", do.timeout)
+	}
+	return validateStarttls(do.starttls)
+}
+
+// target parses addr as host:port and applies any -sni and -resolve /
+// -connect-to mappings to it.
+func (do *dialOptions) target(addr string) (*hostTarget, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host:port specification %s: %w", addr, err)
+	}
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("invalid host:port specification: %s", addr)
+	}
+	t := &hostTarget{
+		addr:       addr,
+		host:       host,
+		port:       port,
+		dialAddr:   addr,
+		serverName: host,
+		name:       host,
+		starttls:   do.starttls,
+	}
+	if do.sni != "" {
+		t.serverName = do.sni
+	}
+	for _, cr := range do.connectTo {
+		if !cr.matches(host, port) {
+			continue
+		}
+		toHost, toPort := host, port
+		if cr.toHost != "" {
+			toHost = cr.toHost
+		}
+		if cr.toPort != "" {
+			toPort = cr.toPort
+		}
+		t.dialAddr = net.JoinHostPort(toHost, toPort)
+		break
+	}
+	return t, nil
+}
+
+// specTarget is target, with spec's own options applied over the flags.
+func (do *dialOptions) specTarget(spec targetSpec) (*hostTarget, error) {
+	t, err := do.target(spec.target)
+	if err != nil {
+		return nil, err
+	}
+	if spec.sni != "" {
+		t.serverName = spec.sni
+	}
+	if spec.starttls != "" {
+		t.starttls = spec.starttls
+	}
+	if spec.name != "" {
+		t.name = spec.name
+	}
+	return t, nil
+}
+
+// String describes the target, noting the dialed address when it differs.
+func (t *hostTarget) String() string {
+	if t.dialAddr != t.addr {
+		return fmt.Sprintf("%s (via %s)", t.addr, t.dialAddr)
+	}
+	return t.addr
+}
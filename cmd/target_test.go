@@ -0,0 +1,269 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitColonFields(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr string
+	}{
+		{in: "example.com:443:192.0.2.1", want: []string{"example.com", "443", "192.0.2.1"}},
+		{in: "example.com:443:[::1]", want: []string{"example.com", "443", "::1"}},
+		{in: "[2001:db8::1]:443::8443", want: []string{"2001:db8::1", "443", "", "8443"}},
+		{in: "::other:8443", want: []string{"", "", "other", "8443"}},
+		{in: "", want: []string{""}},
+		{in: "example.com:443:[::1", wantErr: "missing ']'"},
+		{in: "[::1]x:443", wantErr: "unexpected characters after ']'"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := splitColonFields(tt.in)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, wanted one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, wanted %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectParams(t *testing.T) {
+	tests := []struct {
+		name      string
+		resolve   string
+		connectTo string
+		want      []connectRule
+		wantErr   bool
+	}{
+		{
+			name:    "resolve",
+			resolve: "example.com:443:192.0.2.1",
+			want:    []connectRule{{host: "example.com", port: "443", toHost: "192.0.2.1"}},
+		},
+		{
+			name:    "resolve to IPv6",
+			resolve: "example.com:443:[::1]",
+			want:    []connectRule{{host: "example.com", port: "443", toHost: "::1"}},
+		},
+		{
+			name:    "resolve several",
+			resolve: "a.example:443:192.0.2.1,b.example:8443:192.0.2.2",
+			want: []connectRule{
+				{host: "a.example", port: "443", toHost: "192.0.2.1"},
+				{host: "b.example", port: "8443", toHost: "192.0.2.2"},
+			},
+		},
+		{name: "resolve without a port", resolve: "example.com::192.0.2.1", wantErr: true},
+		{name: "resolve without an address", resolve: "example.com:443:", wantErr: true},
+		{name: "resolve to unbracketed IPv6", resolve: "example.com:443:::1", wantErr: true},
+		{name: "resolve missing a field", resolve: "example.com:443", wantErr: true},
+		{
+			name:      "connect-to",
+			connectTo: "example.com:443:other.example:8443",
+			want:      []connectRule{{host: "example.com", port: "443", toHost: "other.example", toPort: "8443"}},
+		},
+		{
+			name:      "connect-to any host and port",
+			connectTo: "::other:8443",
+			want:      []connectRule{{toHost: "other", toPort: "8443"}},
+		},
+		{
+			name:      "connect-to from IPv6",
+			connectTo: "[2001:db8::1]:443:[::1]:",
+			want:      []connectRule{{host: "2001:db8::1", port: "443", toHost: "::1"}},
+		},
+		{name: "connect-to missing a field", connectTo: "example.com:443:other", wantErr: true},
+		{name: "connect-to with a bad bracket", connectTo: "[::1:443:other:8443", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cp connectparams
+			var err error
+			if tt.resolve != "" {
+				err = resolveparams{&cp}.Set(tt.resolve)
+			} else {
+				err = connecttoparams{&cp}.Set(tt.connectTo)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, wanted an error", cp)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual([]connectRule(cp), tt.want) {
+				t.Fatalf("got %+v, wanted %+v", cp, tt.want)
+			}
+		})
+	}
+}
+
+func TestDialOptionsTarget(t *testing.T) {
+	tests := []struct {
+		name      string
+		addr      string
+		sni       string
+		resolve   string
+		connectTo string
+		// want is the host, port, dial address and server name
+		want    [4]string
+		wantErr bool
+	}{
+		{name: "plain", addr: "example.com:443", want: [4]string{"example.com", "443", "example.com:443", "example.com"}},
+		{name: "IPv6", addr: "[2001:db8::1]:443", want: [4]string{"2001:db8::1", "443", "[2001:db8::1]:443", "2001:db8::1"}},
+		{
+			name: "sni",
+			addr: "192.0.2.1:443",
+			sni:  "example.com",
+			want: [4]string{"192.0.2.1", "443", "192.0.2.1:443", "example.com"},
+		},
+		{
+			name:    "resolve to IPv6",
+			addr:    "host:443",
+			resolve: "host:443:[::1]",
+			want:    [4]string{"host", "443", "[::1]:443", "host"},
+		},
+		{
+			name:    "resolve for another port",
+			addr:    "host:8443",
+			resolve: "host:443:[::1]",
+			want:    [4]string{"host", "8443", "host:8443", "host"},
+		},
+		{
+			name:      "connect-to any host and port",
+			addr:      "[2001:db8::1]:443",
+			connectTo: "::other:8443",
+			want:      [4]string{"2001:db8::1", "443", "other:8443", "2001:db8::1"},
+		},
+		{
+			name:      "connect-to keeping the host",
+			addr:      "EXAMPLE.com:443",
+			connectTo: "example.com:443::8443",
+			want:      [4]string{"EXAMPLE.com", "443", "EXAMPLE.com:8443", "EXAMPLE.com"},
+		},
+		{name: "no port", addr: "example.com", wantErr: true},
+		{name: "unbracketed IPv6", addr: "2001:db8::1:443", wantErr: true},
+		{name: "empty host", addr: ":443", wantErr: true},
+		{name: "empty port", addr: "example.com:", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			do := &dialOptions{sni: tt.sni}
+			if tt.resolve != "" {
+				if err := (resolveparams{&do.connectTo}).Set(tt.resolve); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.connectTo != "" {
+				if err := (connecttoparams{&do.connectTo}).Set(tt.connectTo); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got, err := do.target(tt.addr)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("got %+v, wanted an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g := [4]string{got.host, got.port, got.dialAddr, got.serverName}; g != tt.want {
+				t.Fatalf("got %q, wanted %q", g, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadTargets(t *testing.T) {
+	pemFile := filepath.Join(t.TempDir(), "leaf.pem")
+	if err := os.WriteFile(pemFile, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		in      string
+		want    []targetSpec
+		wantErr string
+	}{
+		{
+			name: "comments, blank lines and options",
+			in: "# payments\n" +
+				"\n" +
+				"   \t\n" +
+				"api.example.com:443   tags=prod,payments  # the api\n" +
+				"mail.example.com:25 starttls=smtp name=mx.example.com tags=,mail,\n" +
+				"#old.example.com:443\n" +
+				"[2001:db8::1]:8443 sni=v6.example.com#no space before the comment\n",
+			want: []targetSpec{
+				{kind: targetKindHost, target: "api.example.com:443", tags: []string{"prod", "payments"}},
+				{kind: targetKindHost, target: "mail.example.com:25", starttls: "smtp", name: "mx.example.com",
+					tags: []string{"mail"}},
+				{kind: targetKindHost, target: "[2001:db8::1]:8443", sni: "v6.example.com"},
+			},
+		},
+		{
+			name: "https urls",
+			in: "https://example.com/\n" +
+				"https://10.0.0.5:8443/status sni=api.example.com\n" +
+				"https://[2001:db8::1]\n",
+			want: []targetSpec{
+				{kind: targetKindHost, target: "example.com:443"},
+				{kind: targetKindHost, target: "10.0.0.5:8443", sni: "api.example.com"},
+				{kind: targetKindHost, target: "[2001:db8::1]:443"},
+			},
+		},
+		{
+			name: "file",
+			in:   pemFile + " name=app.internal tags=internal\n",
+			want: []targetSpec{
+				{kind: targetKindFile, target: pemFile, name: "app.internal", tags: []string{"internal"}},
+			},
+		},
+		{name: "nothing", in: "# just a comment\n\n"},
+		{name: "no port", in: "example.com:443\nexample.com\n", wantErr: "line 2: example.com is neither"},
+		{name: "missing file", in: "/nonexistent/leaf.pem\n", wantErr: "line 1: /nonexistent/leaf.pem is neither"},
+		{name: "http url", in: "http://example.com/\n", wantErr: "only https URLs are supported"},
+		{name: "url without a host", in: "https:///path\n", wantErr: "only https URLs are supported"},
+		{name: "bad url", in: "https://example.com:x/\n", wantErr: "invalid target"},
+		{name: "option without a value", in: "example.com:443 prod\n", wantErr: `invalid option "prod"`},
+		{name: "unknown option", in: "example.com:443 port=8443\n", wantErr: `unknown option "port"`},
+		{name: "bad starttls", in: "example.com:25 starttls=gopher\n", wantErr: "gopher"},
+		{name: "sni on a file", in: pemFile + " sni=example.com\n", wantErr: "don't apply to file"},
+		{name: "starttls on a file", in: pemFile + " starttls=smtp\n", wantErr: "don't apply to file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readTargets(strings.NewReader(tt.in))
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, wanted one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, wanted %+v", got, tt.want)
+			}
+		})
+	}
+}
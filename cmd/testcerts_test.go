@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSerial hands out serial numbers for test certificates.
+var testSerial int64
+
+// testCA is a certificate authority for tests, with the key to sign with.
+type testCA struct {
+	cert *x509.Certificate
+	key  crypto.Signer
+}
+
+// newTestCA returns a CA named cn, issued by parent, or self-signed when
+// parent is nil.
+func newTestCA(t *testing.T, cn string, parent *testCA) *testCA {
+	t.Helper()
+	cert, key := issueTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, parent)
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs tmpl with ca and returns the certificate and its key.
+func (ca *testCA) issue(t *testing.T, tmpl *x509.Certificate) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	return issueTestCert(t, tmpl, ca)
+}
+
+// issueTestCert fills in whatever tmpl leaves out with a serial and a
+// validity period around now, then signs it with parent, or with its own new
+// key when parent is nil.
+func issueTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCA) (*x509.Certificate, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.SerialNumber == nil {
+		tmpl.SerialNumber = big.NewInt(atomic.AddInt64(&testSerial, 1))
+	}
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = time.Now().AddDate(1, 0, 0)
+	}
+	issuer, signer := tmpl, crypto.Signer(key)
+	if parent != nil {
+		issuer, signer = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, issuer, key.Public(), signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
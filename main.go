@@ -29,6 +29,27 @@ func main() {
 		"fetchca": func() (cli.Command, error) {
 			return cmd.NewFetchCACmd(), nil
 		},
+		"lint": func() (cli.Command, error) {
+			return cmd.NewLintCmd(), nil
+		},
+		"prune": func() (cli.Command, error) {
+			return cmd.NewPruneCmd(), nil
+		},
+		"cache": func() (cli.Command, error) {
+			return cmd.NewCacheCmd(""), nil
+		},
+		"cache list": func() (cli.Command, error) {
+			return cmd.NewCacheCmd("list"), nil
+		},
+		"cache prune": func() (cli.Command, error) {
+			return cmd.NewCacheCmd("prune"), nil
+		},
+		"cache import": func() (cli.Command, error) {
+			return cmd.NewCacheCmd("import"), nil
+		},
+		"cache export": func() (cli.Command, error) {
+			return cmd.NewCacheCmd("export"), nil
+		},
 	}
 	systemSpecificCmds(c.Commands)
 	c.Args = os.Args[1:]